@@ -4,14 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	rake "github.com/afjoseph/RAKE.Go"
 	"github.com/gin-gonic/gin"
 	"github.com/hscells/cqr"
 	"github.com/hscells/guru"
+	"github.com/hscells/metawrap"
 	"github.com/hscells/transmute"
 	"github.com/hscells/transmute/fields"
-	tpipeline "github.com/hscells/transmute/pipeline"
 	"github.com/ielab/toolexchange"
 	"github.com/olivere/elastic/v7"
 	log "github.com/sirupsen/logrus"
@@ -22,6 +23,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,6 +37,8 @@ type searchResponse struct {
 	PreviousQueries  []Query
 	Documents        []guru.MedlineDocument
 	Language         string
+	DefaultField     string
+	Version          Query
 	BooleanClauses   float64
 	BooleanKeywords  float64
 	BooleanFields    float64
@@ -53,9 +57,28 @@ type suggestion struct {
 	Source string  `json:"source"`
 }
 
+// Suggestion sources. The "es" alias is what the QueryVis interface requests.
+const (
+	SuggestionSourceES  = "Services"
+	SuggestionSourceCUI = "CUI"
+)
+
+// suggestionTimeout bounds each request made to Elasticsearch or MetaMap while suggesting keywords.
+const suggestionTimeout = 10 * time.Second
+
+// suggestions are the suggestions from each source. When a source fails, its error is reported in Errors,
+// keyed by the name of the source, and the suggestions from the other sources are still returned.
 type suggestions struct {
-	ES  []suggestion `json:"Services"`
-	CUI []suggestion `json:"CUI"`
+	ES     []suggestion      `json:"Services"`
+	CUI    []suggestion      `json:"CUI"`
+	Quiche []suggestion      `json:"Quiche"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// mergedSuggestions are the suggestions from every source, ranked together.
+type mergedSuggestions struct {
+	Suggestions []suggestion      `json:"suggestions"`
+	Errors      map[string]string `json:"errors,omitempty"`
 }
 
 type doc struct {
@@ -72,6 +95,10 @@ func (s Server) ApiKeywordSuggestor(c *gin.Context) {
 	pool := es.DefaultPool
 	merged := es.Merged
 	sources := es.Sources
+	fusion := es.Fusion
+	if len(fusion) == 0 {
+		fusion = FusionMinMax
+	}
 
 	if w, ok := c.GetPostForm("term"); ok {
 		word = w
@@ -114,168 +141,116 @@ func (s Server) ApiKeywordSuggestor(c *gin.Context) {
 	if sour, ok := c.GetPostForm("sources"); ok {
 		sources = sour
 	}
-	splitedSource := strings.Split(sources, ",")
-
-	if merged && len(splitedSource) > 1 {
-		c.JSON(http.StatusOK, s.getsuggestion(word, size, splitedSource, pool))
-		return
-	}
-
-	c.JSON(http.StatusOK, s.getWordSuggestion(word, size, splitedSource, pool))
-	return
-}
-
-func (s Server) getsuggestion(word string, size int, splitedSource []string, pool int) []suggestion {
-	var esRes []suggestion
-	var cuiRes []suggestion
-
-	for _, source := range splitedSource {
-		if strings.EqualFold(source, "Services") {
-			esRes = s.getESWordRanking(word, size, pool)
-		} else if strings.EqualFold(source, "CUI") {
-			cuiRes = s.getCUIWordRanking(word, size)
-		}
-	}
-
-	var normalizedScoreRes = minMax(esRes, cuiRes, size)
-
-	return normalizedScoreRes
-}
-
-func (s Server) getWordSuggestion(word string, size int, splitedSource []string, pool int) suggestions {
-	var ret = suggestions{}
 
-	for _, source := range splitedSource {
-		if strings.EqualFold(source, "Services") {
-			esRes := s.getESWordRanking(word, size, pool)
-			ret.ES = esRes
-		} else if strings.EqualFold(source, "CUI") {
-			cuiRes := s.getCUIWordRanking(word, size)
-			ret.CUI = cuiRes
+	if f, ok := c.GetPostForm("fusion"); ok && len(f) > 0 {
+		if err := ValidateFusion(f); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
 		}
+		fusion = f
 	}
-	return ret
-}
-
-func minMax(esRes []suggestion, cuiRes []suggestion, size int) []suggestion {
-	var ret []suggestion
-	var tempRet []suggestion
-	var sortedTempRet []suggestion
-
-	if len(esRes) == 0 {
-		return cuiRes
-	}
-	if len(cuiRes) == 0 {
-		return esRes
-	}
+	splitedSource := strings.Split(sources, ",")
 
-	esMax, esMin := findMaxAndMin(esRes)
-	cuiMax, cuiMin := findMaxAndMin(cuiRes)
+	ctx := c.Request.Context()
+	ret, requested := s.getWordSuggestion(ctx, word, size, splitedSource, pool)
 
-	for _, esItem := range esRes {
-		var singleESRes suggestion
-		singleESRes.Score = (esItem.Score - esMin.Score) / (esMax.Score - esMin.Score)
-		singleESRes.Source = "Services"
-		singleESRes.Term = esItem.Term
-		tempRet = append(tempRet, singleESRes)
+	// Partial results are still a success; only report a failure when every source failed.
+	status := http.StatusOK
+	if requested > 0 && len(ret.Errors) == requested {
+		status = http.StatusBadGateway
 	}
-
-	for _, cuiItem := range cuiRes {
-		var singleCUIRes suggestion
-		singleCUIRes.Score = (cuiItem.Score - cuiMin.Score) / (cuiMax.Score - cuiMin.Score)
-		singleCUIRes.Source = "CUI"
-		singleCUIRes.Term = cuiItem.Term
-		tempRet = append(tempRet, singleCUIRes)
+	for source, err := range ret.Errors {
+		log.Errorf("[suggest] %s:%s: %s", source, word, err)
 	}
 
-	scores := make([]float64, 0, len(tempRet))
-
-	for _, v := range tempRet {
-		found := false
-		for _, item := range scores {
-			if item == v.Score {
-				found = true
-			}
-		}
-		if !found {
-			scores = append(scores, v.Score)
+	if merged && len(splitedSource) > 1 {
+		fused, err := fuse(fusion, size, ret.ES, ret.CUI, ret.Quiche)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
 		}
+		c.JSON(status, mergedSuggestions{
+			Suggestions: fused,
+			Errors:      ret.Errors,
+		})
+		return
 	}
 
-	sort.Slice(scores, func(i, j int) bool {
-		return scores[i] > scores[j]
-	})
+	c.JSON(status, ret)
+	return
+}
 
-	for _, f := range scores {
-		for _, k := range tempRet {
-			if k.Score == f {
-				sortedTempRet = append(sortedTempRet, k)
-			}
+// getWordSuggestion gets suggestions from each of the sources, and the number of sources that were requested.
+func (s Server) getWordSuggestion(ctx context.Context, word string, size int, splitedSource []string, pool int) (suggestions, int) {
+	var (
+		ret       = suggestions{}
+		requested int
+	)
+	fail := func(source string, err error) {
+		if ret.Errors == nil {
+			ret.Errors = make(map[string]string)
 		}
+		ret.Errors[source] = err.Error()
 	}
 
-	if len(sortedTempRet) < size {
-		ret = sortedTempRet
-	} else {
-		var count = 0
-		for _, val := range sortedTempRet {
-			if count < size {
-				ret = append(ret, val)
-				count = count + 1
+	for _, source := range splitedSource {
+		source = strings.TrimSpace(source)
+		if strings.EqualFold(source, SuggestionSourceES) || strings.EqualFold(source, "es") {
+			requested++
+			esRes, err := s.getESWordRanking(ctx, word, size, pool)
+			if err != nil {
+				fail(SuggestionSourceES, err)
+				continue
 			}
+			ret.ES = esRes
+		} else if strings.EqualFold(source, SuggestionSourceCUI) {
+			requested++
+			cuiRes, err := s.getCUIWordRanking(ctx, word, size)
+			if err != nil {
+				fail(SuggestionSourceCUI, err)
+				continue
+			}
+			ret.CUI = cuiRes
+		} else if strings.EqualFold(source, SuggestionSourceQuiche) {
+			requested++
+			quicheRes, err := s.getQuicheWordRanking(word, size)
+			if err != nil {
+				fail(SuggestionSourceQuiche, err)
+				continue
+			}
+			ret.Quiche = quicheRes
 		}
 	}
-
-	return ret
-}
-
-func findMaxAndMin(res []suggestion) (suggestion, suggestion) {
-	var min = res[0]
-	var max = res[0]
-
-	for _, re := range res {
-		if re.Score > max.Score {
-			max = re
-		}
-		if re.Score < min.Score {
-			min = re
-		}
-	}
-	return max, min
+	return ret, requested
 }
 
-func (s Server) getESWordRanking(word string, size int, pool int) []suggestion {
+func (s Server) getESWordRanking(ctx context.Context, word string, size int, pool int) ([]suggestion, error) {
 	c := s.Config.Services
-	username := c.ElasticsearchPubMedUsername
-	secret := c.ElasticsearchPubMedPassword
-	preurl := c.ElasticsearchPubMedURL
 	indexName := c.IndexName
 
+	if s.Elastic == nil {
+		return nil, errElasticNotConfigured
+	}
+
 	if pool == 0 {
 		pool = c.DefaultPool
 	} else if pool > c.MaxPool {
 		pool = c.MaxPool
 	}
 
-	client, err := elastic.NewSimpleClient(
-		elastic.SetURL(preurl),
-		elastic.SetBasicAuth(username, secret))
-	if err != nil {
-		panic(err)
-	}
-
-	result, err := client.Search().
+	sctx, cancel := context.WithTimeout(ctx, suggestionTimeout)
+	result, err := s.Elastic.Search().
 		Index(indexName).Query(elastic.NewQueryStringQuery(word)).
 		Sort("_score", false).
 		From(0).
 		Size(pool).
 		Pretty(true).
-		Do(context.Background())
+		Do(sctx)
+	cancel()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	var t doc
 	var count = 0
 	var res []string
 	var word1Count = result.Hits.TotalHits.Value
@@ -283,17 +258,17 @@ func (s Server) getESWordRanking(word string, size int, pool int) []suggestion {
 
 	if word1Count > 0 && count < pool {
 		var allTerms []string
+		reg := regexp.MustCompile("[^a-zA-Z0-9-]+")
 		for _, hit := range result.Hits.Hits {
+			var t doc
 			err := json.Unmarshal(hit.Source, &t)
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 
 			title := strings.ToLower(t.Title)
 			abs := strings.ToLower(t.Abstract)
 
-			reg := regexp.MustCompile("[^a-zA-Z0-9-]+")
-
 			// "a b  c"
 			// {"a", "b", "", "c"}
 			//splitTitle := strings.Split(title, " ")
@@ -302,7 +277,6 @@ func (s Server) getESWordRanking(word string, size int, pool int) []suggestion {
 			split := make([]string, len(pairs))
 			for i, pair := range pairs {
 				split[i] = pair.Key
-				fmt.Println(pair.Key, pair.Value)
 			}
 
 			var meshHeadings []string
@@ -328,15 +302,56 @@ func (s Server) getESWordRanking(word string, size int, pool int) []suggestion {
 		}
 	}
 
-	collectionSize, err := client.Count(indexName).Do(context.Background())
+	collectionSize, err := s.Elastic.CollectionSize(ctx)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	// Each candidate requires two counts, so a bounded number of candidates are scored at once.
+	concurrency := c.PMIConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultPMIConcurrency
+	}
+	ctx, cancelPMI := context.WithCancel(ctx)
+	defer cancelPMI()
+	var (
+		ret    = make([]suggestion, len(res))
+		wg     sync.WaitGroup
+		once   sync.Once
+		pmiErr error
+		sem    = make(chan struct{}, concurrency)
+	)
+	for i, term := range res {
+		sem <- struct{}{}
+		// Don't start scoring any more candidates once a failure or the request has cancelled the rest.
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int, term string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			singleRanking, err := s.pmiSimilarity(ctx, float64(word1Count), word, term, collectionSize)
+			if err != nil {
+				// Stop scoring the remaining candidates at the first failure.
+				once.Do(func() {
+					pmiErr = err
+					cancelPMI()
+				})
+				return
+			}
+			ret[i] = singleRanking
+		}(i, term)
 	}
-
-	var ret []suggestion
-	for _, term := range res {
-		singleRanking := s.pmiSimilarity(float64(word1Count), word, term, client, float64(collectionSize))
-		ret = append(ret, singleRanking)
+	wg.Wait()
+	if pmiErr != nil {
+		return nil, pmiErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	sort.Slice(ret, func(i, j int) bool {
@@ -359,18 +374,51 @@ func (s Server) getESWordRanking(word string, size int, pool int) []suggestion {
 		}
 	}
 
-	return returned
+	return returned, nil
+}
+
+// metaMapCandidates finds the MetaMap candidates for some text, giving up once the timeout has passed.
+// The MetaMap client does not accept a context, so a request that times out is left to finish in the background.
+func (s Server) metaMapCandidates(ctx context.Context, text string) ([]metawrap.MappingCandidate, error) {
+	type result struct {
+		candidates []metawrap.MappingCandidate
+		err        error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		// The client panics if the response cannot be read.
+		defer func() {
+			if r := recover(); r != nil {
+				ch <- result{err: fmt.Errorf("metamap: %v", r)}
+			}
+		}()
+		candidates, err := s.MetaMapClient.Candidates(text)
+		ch <- result{candidates: candidates, err: err}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, suggestionTimeout)
+	defer cancel()
+	select {
+	case r := <-ch:
+		return r.candidates, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("metamap: %v", ctx.Err())
+	}
 }
 
-func (s Server) getCUIWordRanking(word string, size int) []suggestion {
+func (s Server) getCUIWordRanking(ctx context.Context, word string, size int) ([]suggestion, error) {
 	var ret []suggestion
 
-	candidates, err := s.MetaMapClient.Candidates(word)
+	if s.CUIEmbeddings == nil {
+		return nil, errors.New("cui2vec embeddings have not been loaded")
+	}
+
+	candidates, err := s.metaMapCandidates(ctx, word)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	if len(candidates) == 0 {
-		return ret
+		return ret, nil
 	}
 
 	if size == 0 {
@@ -381,11 +429,11 @@ func (s Server) getCUIWordRanking(word string, size int) []suggestion {
 
 	similarCUIs, err := s.CUIEmbeddings.Similar(candidates[0].CandidateCUI)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	if len(similarCUIs) == 0 {
-		return ret
+		return ret, nil
 	}
 
 	var term string
@@ -395,8 +443,9 @@ func (s Server) getCUIWordRanking(word string, size int) []suggestion {
 		if val, ok := s.CUIMapping[cui]; ok {
 			term = val
 			oneCUI := suggestion{
-				Score: score,
-				Term:  term,
+				Score:  score,
+				Term:   term,
+				Source: SuggestionSourceCUI,
 			}
 			ret = append(ret, oneCUI)
 		}
@@ -407,41 +456,31 @@ func (s Server) getCUIWordRanking(word string, size int) []suggestion {
 	})
 
 	if len(ret) < size {
-		return ret
+		return ret, nil
 	}
-	return ret[:size]
+	return ret[:size], nil
 }
 
-func (s Server) pmiSimilarity(word1Count float64, word1 string, word2 string, client *elastic.Client, collectionSize float64) suggestion {
-	c := s.Config.Services
-	indexName := c.IndexName
-
-	fmt.Println(word1, word2)
-
-	query2 := elastic.NewQueryStringQuery(word2)
-	//query3 := elastic.NewQueryStringQuery("(" + word1 + ") AND (" + word2 + ")")
-	//query2 := elastic.NewMatchQuery("_all", word2)
-	query3 := elastic.NewBoolQuery().Must(elastic.NewQueryStringQuery(word1), elastic.NewQueryStringQuery(word2))
-
-	result2, err := client.Count(indexName).Query(query2).Do(context.Background())
+func (s Server) pmiSimilarity(ctx context.Context, word1Count float64, word1 string, word2 string, collectionSize float64) (suggestion, error) {
+	result2, err := s.Elastic.DocumentFrequency(ctx, word2)
 	if err != nil {
-		panic(err)
+		return suggestion{}, err
 	}
 
-	result3, err := client.Count(indexName).Query(query3).Do(context.Background())
+	result3, err := s.Elastic.CoDocumentFrequency(ctx, word1, word2)
 	if err != nil {
-		panic(err)
+		return suggestion{}, err
 	}
 
-	score := calculateSimilarity(collectionSize, word1Count, float64(result2), float64(result3))
-	fmt.Println(word1, len(word1), word2, len(word2), collectionSize, word1Count, result2, result3, score)
+	score := calculateSimilarity(collectionSize, word1Count, result2, result3)
 
 	res := suggestion{
-		Term:  word2,
-		Score: score,
+		Term:   word2,
+		Score:  score,
+		Source: SuggestionSourceES,
 	}
 
-	return res
+	return res, nil
 }
 
 func pmi(x float64, y float64, xy float64) float64 {
@@ -468,14 +507,16 @@ func (s Server) ApiScroll(c *gin.Context) {
 		return
 	}
 
-	t := make(map[string]tpipeline.TransmutePipeline)
-	t["medline"] = transmute.Medline2Cqr
-	t["pubmed"] = transmute.Pubmed2Cqr
+	compiler, _, err := RequestParser(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 
 	startString := c.PostForm("start")
 	scroll, err := strconv.ParseInt(startString, 10, 64)
-	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+	if err != nil || scroll < 0 {
+		c.String(http.StatusBadRequest, fmt.Sprintf("invalid start %q", startString))
 		return
 	}
 
@@ -486,56 +527,31 @@ func (s Server) ApiScroll(c *gin.Context) {
 		Finished  bool
 	}
 
-	compiler := t["medline"]
-	if v, ok := t[lang]; ok {
-		compiler = v
-	} else {
-		lang = "medline"
-	}
-
 	cq, err := compiler.Execute(rawQuery)
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	cqString, err := cq.String()
-	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	pubmedQuery, err := transmute.Cqr2Pubmed.Execute(cqString)
-	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	q, err := pubmedQuery.String()
-	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	pmids, err := s.Entrez.Search(q, s.Entrez.SearchStart(int(scroll)), s.Entrez.SearchSize(10))
+	repr, err := cq.Representation()
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	docs, err := s.Entrez.Fetch(pmids)
+	pmids, err := s.Backend.Search(repr.(cqr.CommonQueryRepresentation), int(scroll), 10)
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	repr, err := cq.Representation()
+	docs, err := s.Backend.Fetch(pmids)
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	total, err := s.Entrez.RetrievalSize(repr.(cqr.CommonQueryRepresentation))
+	total, err := s.Backend.RetrievalSize(repr.(cqr.CommonQueryRepresentation))
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
 		return
@@ -551,19 +567,21 @@ func (s Server) ApiScroll(c *gin.Context) {
 	c.JSON(http.StatusOK, scrollResponse{Documents: docs, Start: len(docs), Finished: finished, Total: total})
 }
 
+// TransformedQuery is a query that was translated into another language, and the constructs of the query that
+// could not be translated faithfully.
+type TransformedQuery struct {
+	Query          string                    `json:"query"`
+	Untranslatable []UntranslatableConstruct `json:"untranslatable"`
+}
+
 func ApiTransform(c *gin.Context) {
 	rawQuery := c.PostForm("query")
 	lang := c.PostForm("lang")
 
-	t := make(map[string]tpipeline.TransmutePipeline)
-	t["pubmed"] = transmute.Cqr2Pubmed
-	t["medline"] = transmute.Cqr2Medline
-
-	compiler := t["medline"]
-	if v, ok := t[lang]; ok {
-		compiler = v
-	} else {
-		lang = "medline"
+	compiler, lang, err := Languages.Compiler(lang)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
 	}
 
 	cq, err := compiler.Execute(rawQuery)
@@ -577,7 +595,11 @@ func ApiTransform(c *gin.Context) {
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
-	c.Data(http.StatusOK, "text/plain", []byte(q))
+	var u []UntranslatableConstruct
+	if repr, err := transmute.CompileString2Cqr(rawQuery); err == nil {
+		u = Untranslatable(repr, lang)
+	}
+	c.JSON(http.StatusOK, TransformedQuery{Query: q, Untranslatable: u})
 }
 
 func ApiCQR2Query(c *gin.Context) {
@@ -586,15 +608,10 @@ func ApiCQR2Query(c *gin.Context) {
 
 	log.Infof("[cqr2query] %s:%s", lang, rawQuery)
 
-	p := make(map[string]tpipeline.TransmutePipeline)
-	p["medline"] = transmute.Cqr2Medline
-	p["pubmed"] = transmute.Cqr2Pubmed
-
-	compiler := p["medline"]
-	if v, ok := p[lang]; ok {
-		compiler = v
-	} else {
-		lang = "medline"
+	compiler, lang, err := Languages.Compiler(lang)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
 	}
 
 	cq, err := compiler.Execute(rawQuery)
@@ -614,27 +631,16 @@ func ApiCQR2Query(c *gin.Context) {
 
 func ApiQuery2CQR(c *gin.Context) {
 	rawQuery := c.PostForm("query")
-	lang := c.PostForm("lang")
 	field := c.PostForm("field")
 
-	p := make(map[string]tpipeline.TransmutePipeline)
-	p["medline"] = transmute.Medline2Cqr
-	p["pubmed"] = transmute.Pubmed2Cqr
-
-	compiler := p["medline"]
-	if v, ok := p[lang]; ok {
-		compiler = v
-	} else {
-		lang = "medline"
+	compiler, lang, err := RequestParser(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
 	}
 
 	log.Infof("[query2cqr] %s:%s:%s", field, lang, rawQuery)
 
-	// Use the field parameter to change the default field mapping.
-	if len(field) > 0 {
-		compiler.Parser.FieldMapping["default"] = []string{field}
-	}
-
 	cq, err := compiler.Execute(rawQuery)
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
@@ -655,13 +661,15 @@ func (s Server) ApiHistoryGet(c *gin.Context) {
 		c.Status(http.StatusForbidden)
 		return
 	}
-	username := s.Perm.UserState().Username(c.Request)
-	// reverse the list
-	q := make([]Query, len(s.Queries[username]))
-	j := 0
-	for i := len(s.Queries[username]) - 1; i >= 0; i-- {
-		q[j] = s.Queries[username][i]
-		j++
+	ws, err := s.Workspace(c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	q, err := s.History.Recent(ws.Key)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
 	}
 
 	c.JSON(http.StatusOK, q)
@@ -673,21 +681,24 @@ func (s Server) ApiHistoryAdd(c *gin.Context) {
 		c.Status(http.StatusForbidden)
 		return
 	}
-	username := s.Perm.UserState().Username(c.Request)
+	ws, err := s.Workspace(c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 	rawQuery := c.PostForm("query")
-	lang := c.PostForm("lang")
-	p := make(map[string]tpipeline.TransmutePipeline)
-	p["medline"] = transmute.Medline2Cqr
-	p["pubmed"] = transmute.Pubmed2Cqr
-
-	compiler := p["medline"]
-	if v, ok := p[lang]; ok {
-		compiler = v
-	} else {
-		lang = "medline"
+	options, err := RequestParserOptions(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	compiler, lang, err := Languages.ConfiguredParser(c.PostForm("lang"), options)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
 	}
 
-	log.Infof("[addhistory] %s:%s:%s", username, rawQuery, lang)
+	log.Infof("[addhistory] %s:%s:%s:%s", ws.Username, ws.Key, rawQuery, lang)
 	cq, err := compiler.Execute(rawQuery)
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
@@ -698,32 +709,69 @@ func (s Server) ApiHistoryAdd(c *gin.Context) {
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
+	s.Events.PublishQueryParsed(QueryParsed{Workspace: ws, Query: rawQuery, Language: lang, CQR: repr.(cqr.CommonQueryRepresentation), Source: "history"})
 
+	var limits []string
 	date, ok := c.GetPostForm("date")
 	if ok {
 		repr = cqr.NewBooleanQuery(cqr.AND, []cqr.CommonQueryRepresentation{
 			repr.(cqr.CommonQueryRepresentation),
 			cqr.NewKeyword(date, fields.PublicationDate),
 		})
+		limits = append(limits, fmt.Sprintf("%s [%s]", date, fields.PublicationDate))
+	}
+
+	// Counting the results of each line runs every line of the query, so it is only done when asked for. The last
+	// line is the whole query, so its results are those of the query.
+	var (
+		size  float64
+		lines []ReportLine
+	)
+	if c.PostForm("lines") == "true" {
+		lines, err = s.searchLines(repr.(cqr.CommonQueryRepresentation), lang, nil)
+		if err == nil && len(lines) > 0 {
+			size = lines[len(lines)-1].Hits
+		}
+	} else {
+		size, err = s.Backend.RetrievalSize(repr.(cqr.CommonQueryRepresentation))
 	}
-
-	size, err := s.Entrez.RetrievalSize(repr.(cqr.CommonQueryRepresentation))
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	s.Queries[username] = append(s.Queries[username], Query{
-		Time:        time.Now(),
-		QueryString: rawQuery,
-		Language:    lang,
-		NumRet:      int64(size),
-	})
+	parent, err := requestParent(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 
-	c.Status(http.StatusOK)
+	q, err := s.RecordQuery(ws, Query{
+		Time:          time.Now(),
+		QueryString:   rawQuery,
+		Language:      lang,
+		NumRet:        int64(size),
+		Author:        ws.Username,
+		Strategy:      c.PostForm("strategy"),
+		Parent:        parent,
+		Message:       c.PostForm("message"),
+		Limits:        limits,
+		Lines:         lines,
+		ParserOptions: options,
+	}, repr.(cqr.CommonQueryRepresentation), "history")
+	if err != nil {
+		c.String(historyStatus(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, q)
 	return
 }
-func (s Server) ApiRequestTokenFromExchangeServer(query string) string {
+
+// exchangeTimeout bounds requests made to the tool exchange server.
+const exchangeTimeout = 10 * time.Second
+
+func (s Server) ApiRequestTokenFromExchangeServer(query string) (string, error) {
 
 	body := &toolexchange.Item{
 		Data: map[string]string{
@@ -732,27 +780,28 @@ func (s Server) ApiRequestTokenFromExchangeServer(query string) string {
 		Referrer: "searchrefiner",
 	}
 
-	reqBody, err1 := json.Marshal(body)
-
-	if err1 != nil {
-		panic(err1)
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return "", err
 	}
 
-	resp, err2 := http.Post(s.Config.ExchangeServerAddress, "application/json", bytes.NewBuffer(reqBody))
-
-	if err2 != nil {
-		panic(err2)
+	client := http.Client{Timeout: exchangeTimeout}
+	resp, err := client.Post(s.Config.ExchangeServerAddress, "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return "", err
 	}
-
 	defer resp.Body.Close()
 
-	content, err3 := ioutil.ReadAll(resp.Body)
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
 
-	if err3 != nil {
-		panic(err3)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("exchange server responded with %s: %s", resp.Status, content)
 	}
 
-	return string(content)
+	return string(content), nil
 }
 
 func (s Server) ApiGetQuerySeedFromExchangeServer(token string) (toolexchange.Item, error) {
@@ -784,9 +833,17 @@ func (s Server) ApiHistoryDelete(c *gin.Context) {
 		return
 	}
 
-	username := s.Perm.UserState().Username(c.Request)
-	delete(s.Queries, username)
-	log.Infof("[deletehistory] %s", username)
+	ws, err := s.Workspace(c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = s.History.Clear(ws.Key)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Infof("[deletehistory] %s:%s", ws.Username, ws.Key)
 	c.Status(http.StatusOK)
 	return
 }
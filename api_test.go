@@ -0,0 +1,178 @@
+package searchrefiner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeElastic is an Elasticsearch index of PubMed that finds a single document. The first count is of the whole
+// collection, and the counts of suggested terms after it are answered by df, when it is not nil.
+func fakeElastic(t *testing.T, counts *int32, df http.HandlerFunc) *ElasticClient {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_search"):
+			fmt.Fprint(w, `{"hits": {"total": {"value": 10, "relation": "eq"}, "hits": [{"_id": "1", "_source": {
+				"title": "Aspirin for the prevention of heart attack",
+				"abstract": "Daily aspirin reduces the risk of stroke.",
+				"mesh_headings": ["Myocardial Infarction"]}}]}}`)
+		case strings.HasSuffix(r.URL.Path, "/_count"):
+			switch n := atomic.AddInt32(counts, 1); {
+			case n == 1:
+				fmt.Fprint(w, `{"count": 1000000}`)
+			case df != nil:
+				df(w, r)
+			default:
+				fmt.Fprint(w, `{"count": 5}`)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	e, err := NewElasticClient(Services{ElasticsearchPubMedURL: srv.URL, IndexName: "pubmed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// suggest posts a term to ApiKeywordSuggestor.
+func suggest(s Server, ctx context.Context, form url.Values) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	g.POST("/api/suggest", s.ApiKeywordSuggestor)
+	req := httptest.NewRequest(http.MethodPost, "/api/suggest", strings.NewReader(form.Encode())).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	return rec
+}
+
+func suggestServer() Server {
+	s := Server{Quiche: testQuiche()}
+	s.Config.Services = Services{DefaultRetSize: 10, MaxRetSize: 10, DefaultPool: 10, MaxPool: 10, PMIConcurrency: 1}
+	return s
+}
+
+func TestApiKeywordSuggestor(t *testing.T) {
+	tests := []struct {
+		name, sources string
+		elastic       bool
+		status        int
+		errors        []string
+		suggested     []string
+	}{
+		{"es alias", "es", true, http.StatusOK, nil, []string{SuggestionSourceES}},
+		{"partial", "Services,CUI,Quiche", true, http.StatusOK, []string{SuggestionSourceCUI}, []string{SuggestionSourceES, SuggestionSourceQuiche}},
+		{"unconfigured", "ES, quiche", false, http.StatusOK, []string{SuggestionSourceES}, []string{SuggestionSourceQuiche}},
+		{"every source fails", "es,CUI", false, http.StatusBadGateway, []string{SuggestionSourceES, SuggestionSourceCUI}, nil},
+		{"unknown source", "Google", false, http.StatusOK, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := suggestServer()
+			if tt.elastic {
+				var counts int32
+				s.Elastic = fakeElastic(t, &counts, nil)
+			}
+			rec := suggest(s, context.Background(), url.Values{"term": {"heart attack"}, "sources": {tt.sources}})
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			var ret suggestions
+			if err := json.Unmarshal(rec.Body.Bytes(), &ret); err != nil {
+				t.Fatal(err)
+			}
+			if len(ret.Errors) != len(tt.errors) {
+				t.Errorf("expected errors from %v, got %v", tt.errors, ret.Errors)
+			}
+			for _, source := range tt.errors {
+				if len(ret.Errors[source]) == 0 {
+					t.Errorf("expected an error from %s, got %v", source, ret.Errors)
+				}
+			}
+			bySource := map[string][]suggestion{SuggestionSourceES: ret.ES, SuggestionSourceCUI: ret.CUI, SuggestionSourceQuiche: ret.Quiche}
+			suggested := make(map[string]bool)
+			for _, source := range tt.suggested {
+				suggested[source] = true
+			}
+			for source, ret := range bySource {
+				if suggested[source] != (len(ret) > 0) {
+					t.Errorf("expected suggestions from %s: %v, got %+v", source, suggested[source], ret)
+				}
+				for _, sg := range ret {
+					if sg.Source != source {
+						t.Errorf("expected a suggestion from %s, got %+v", source, sg)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestApiKeywordSuggestorMerged(t *testing.T) {
+	s := suggestServer()
+	rec := suggest(s, context.Background(), url.Values{"term": {"heart attack"}, "sources": {"es,Quiche"}, "merged": {"true"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected partial results to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var ret mergedSuggestions
+	if err := json.Unmarshal(rec.Body.Bytes(), &ret); err != nil {
+		t.Fatal(err)
+	}
+	if len(ret.Suggestions) == 0 || len(ret.Errors[SuggestionSourceES]) == 0 {
+		t.Errorf("expected the quiche suggestions and the error from Elasticsearch, got %+v", ret)
+	}
+}
+
+// TestApiKeywordSuggestorPMI checks that no more candidates are scored once scoring one of them has failed,
+// or the request has been cancelled. Candidates are scored one at a time, so only the collection and the
+// first candidate are ever counted.
+func TestApiKeywordSuggestorPMI(t *testing.T) {
+	tests := []struct {
+		name string
+		df   func(cancel context.CancelFunc) http.HandlerFunc
+	}{
+		{"failure", func(context.CancelFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"error": "unavailable"}`, http.StatusServiceUnavailable)
+			}
+		}},
+		{"cancelled", func(cancel context.CancelFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				// The server only notices that the request was cancelled once it has read the body.
+				io.Copy(ioutil.Discard, r.Body)
+				cancel()
+				<-r.Context().Done()
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var counts int32
+			s := suggestServer()
+			s.Elastic = fakeElastic(t, &counts, tt.df(cancel))
+			rec := suggest(s, ctx, url.Values{"term": {"heart attack"}, "sources": {"es"}})
+			if rec.Code != http.StatusBadGateway {
+				t.Errorf("expected %d, got %d: %s", http.StatusBadGateway, rec.Code, rec.Body.String())
+			}
+			if n := atomic.LoadInt32(&counts); n != 2 {
+				t.Errorf("expected scoring to stop after the first candidate, got %d counts", n)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"time"
 )
 
 func HandleAccountLogin(c *gin.Context) {
@@ -38,6 +39,7 @@ func (s Server) ApiAccountLogin(c *gin.Context) {
 			return
 		}
 		log.Info(fmt.Sprintf("[login=%s]", username))
+		s.Events.PublishUserLoggedIn(UserLoggedIn{Username: username, Time: time.Now()})
 		c.Redirect(http.StatusFound, "/")
 		return
 	}
@@ -99,6 +101,7 @@ func (s Server) ApiAccountCreate(c *gin.Context) {
 		c.HTML(http.StatusUnauthorized, "error.html", ErrorPage{Error: err.Error(), BackLink: "/account/create"})
 		return
 	}
+	s.Events.PublishUserLoggedIn(UserLoggedIn{Username: username, Time: time.Now()})
 	c.Redirect(http.StatusFound, "/")
 	return
 }
@@ -146,9 +149,10 @@ func (s Server) HandleAdmin(c *gin.Context) {
 		Unconfirmed []string
 		Confirmed   []string
 		Storage     map[string]map[string]map[string]string
+		Health      []PluginHealth
 	}
 
-	c.HTML(http.StatusOK, "admin.html", admin{Unconfirmed: u, Confirmed: conf, Storage: storage})
+	c.HTML(http.StatusOK, "admin.html", admin{Unconfirmed: u, Confirmed: conf, Storage: storage, Health: s.State.PluginHealth()})
 }
 
 func (s Server) ApiAdminConfirm(c *gin.Context) {
@@ -194,19 +198,13 @@ func (s Server) ApiAdminUpdateStorage(c *gin.Context) {
 		return
 	}
 
-	var ps *PluginStorage
-	ps, ok := s.Storage[plugin]
-	if !ok {
-		var err error
-		ps, err = OpenPluginStorage(plugin)
-		if err != nil {
-			c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: "cannot update storage", BackLink: "/admin"})
-			return
-		}
-		s.Storage[plugin] = ps
+	ps, err := s.State.OpenStorage(plugin)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: "cannot update storage", BackLink: "/admin"})
+		return
 	}
 
-	err := ps.PutValue(bucket, key, value)
+	err = ps.PutValue(bucket, key, value)
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/admin"})
 		return
@@ -240,7 +238,7 @@ func (s Server) ApiAdminDeleteStorage(c *gin.Context) {
 		return
 	}
 
-	ps, ok := s.Storage[plugin]
+	ps, ok := s.State.Storage(plugin)
 	if !ok {
 		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: "cannot update storage", BackLink: "/admin"})
 		return
@@ -267,7 +265,7 @@ func (s Server) ApiAdminCSVStorage(c *gin.Context) {
 		return
 	}
 	var resp string
-	if ps, ok := s.Storage[plugin]; ok {
+	if ps, ok := s.State.Storage(plugin); ok {
 		var err error
 		resp, err = ps.ToCSV(bucket)
 		if err != nil {
@@ -0,0 +1,80 @@
+package searchrefiner
+
+import (
+	"fmt"
+	"github.com/hscells/cqr"
+	"github.com/hscells/groove/stats"
+	"github.com/hscells/guru"
+	"github.com/ielab/searchrefiner/localindex"
+)
+
+const (
+	BackendEntrez = "entrez"
+	BackendLocal  = "local"
+)
+
+// BackendConfig selects the search backend. The Entrez backend is used when no backend is configured,
+// while the local backend requires the path to an index built with cmd/searchrefiner-index.
+type BackendConfig struct {
+	Name  string
+	Index string
+}
+
+// SearchBackend is the interface to the collection that queries are issued to. As well as searching and fetching
+// citations, a backend must provide the statistics that are needed by the analysis and combinator packages.
+type SearchBackend interface {
+	stats.StatisticsSource
+	Search(query cqr.CommonQueryRepresentation, start, size int) ([]int, error)
+	Fetch(pmids []int) ([]guru.MedlineDocument, error)
+}
+
+// Pager is implemented by search backends that page through every citation a query retrieves in a way of their
+// own, rather than by searching again for each page.
+type Pager interface {
+	Pages(query cqr.CommonQueryRepresentation, size int, fn func(docs []guru.MedlineDocument) error) error
+}
+
+var (
+	_ SearchBackend = EntrezBackend{}
+	_ SearchBackend = &localindex.Index{}
+	_ Pager         = EntrezBackend{}
+)
+
+// Pages calls fn with the citations a query retrieves from a backend, size at a time, until fn returns an error.
+func Pages(b SearchBackend, query cqr.CommonQueryRepresentation, size int, fn func(docs []guru.MedlineDocument) error) error {
+	if p, ok := b.(Pager); ok {
+		return p.Pages(query, size, fn)
+	}
+	for start := 0; ; start += size {
+		pmids, err := b.Search(query, start, size)
+		if err != nil {
+			return err
+		}
+		docs, err := b.Fetch(pmids)
+		if err != nil {
+			return err
+		}
+		err = fn(docs)
+		if err != nil {
+			return err
+		}
+		if len(pmids) < size {
+			return nil
+		}
+	}
+}
+
+// NewSearchBackend creates the search backend that has been selected in the configuration.
+func NewSearchBackend(c Config) (SearchBackend, error) {
+	options := stats.SearchOptions{Size: 100000, RunName: "searchrefiner"}
+	switch c.Backend.Name {
+	case "", BackendEntrez:
+		return NewEntrezBackend(c.Entrez, options)
+	case BackendLocal:
+		if len(c.Backend.Index) == 0 {
+			return nil, fmt.Errorf("the local backend requires the path to an index")
+		}
+		return localindex.Open(c.Backend.Index, options)
+	}
+	return nil, fmt.Errorf("unknown search backend %s", c.Backend.Name)
+}
@@ -0,0 +1,42 @@
+// Command fakeentrez runs a stand-in for the NCBI E-utilities that serves MEDLINE formatted fixture records.
+//
+//	fakeentrez -addr localhost:4854 [-records records.txt]
+//
+// searchrefiner can then be pointed at it by setting "URL": "http://localhost:4854" in the "Entrez" section of
+// config.json.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"github.com/ielab/searchrefiner/fakeentrez"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:4854", "address to listen on")
+	records := flag.String("records", "", "MEDLINE formatted records to serve (defaults to the bundled fixtures)")
+	flag.Parse()
+
+	var r io.Reader = bytes.NewReader(fakeentrez.Fixtures)
+	if len(*records) > 0 {
+		f, err := os.Open(*records)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	s, err := fakeentrez.New(r)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer s.Close()
+
+	log.Infof("[fakeentrez] serving %d records on %s", s.Len(), *addr)
+	log.Fatalln(http.ListenAndServe(*addr, s))
+}
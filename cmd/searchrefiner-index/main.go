@@ -0,0 +1,53 @@
+// Command searchrefiner-index builds a local index of PubMed citations for the "local" search backend.
+//
+//	searchrefiner-index pubmed.idx pubmed21n0001.xml.gz pubmed21n0002.xml.gz ...
+//
+// Baseline and update files may be added to an existing index; citations that appear again replace the
+// stored copy. Files that do not end in .xml or .xml.gz are read as MEDLINE formatted records.
+package main
+
+import (
+	"fmt"
+	"github.com/ielab/searchrefiner/localindex"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+)
+
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, "usage: searchrefiner-index INDEX FILE...")
+		os.Exit(2)
+	}
+
+	b, err := localindex.NewBuilder(os.Args[1])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, path := range os.Args[2:] {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		read := localindex.ReadMedline
+		if strings.HasSuffix(path, ".xml") || strings.HasSuffix(path, ".xml.gz") {
+			read = localindex.ReadBaseline
+		}
+		n := 0
+		err = read(f, func(a localindex.Article) error {
+			n++
+			return b.Add(a)
+		})
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+		log.Infof("[index] %s: %d citations", path, n)
+	}
+
+	err = b.Close()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -1,27 +1,35 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/boltdb/bolt"
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
 	"github.com/hscells/cui2vec"
-	"github.com/hscells/groove/stats"
 	"github.com/hscells/metawrap"
+	"github.com/hscells/quickumlsrest"
 	"github.com/hscells/quickumlsrest/quiche"
 	"github.com/ielab/searchrefiner"
+	"github.com/ielab/searchrefiner/mesh"
 	log "github.com/sirupsen/logrus"
 	"github.com/xyproto/permissionbolt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"plugin"
 	"strings"
+	"syscall"
 	"time"
 )
 
+// shutdownTimeout bounds how long requests and plugins have to finish when the server is shutting down.
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	f, err := os.Open("config.json")
 	if err != nil {
@@ -33,25 +41,51 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	// The fusion strategy is used by every merged keyword suggestion, so a mistake in it should stop the server.
+	if err := searchrefiner.ValidateFusion(c.Services.Fusion); err != nil {
+		log.Fatalln(err)
+	}
 
-	fmt.Println("loading quiche...")
-	quicheCache, err := quiche.Load(c.Resources.Quiche)
-	if err != nil {
-		panic(err)
+	// The resources are only used by the keyword suggestor, so searchrefiner can run without them (e.g., in tests).
+	var (
+		quicheCache quickumlsrest.Cache
+		quicheIndex *searchrefiner.QuicheIndex
+	)
+	if len(c.Resources.Quiche) > 0 {
+		fmt.Println("loading quiche...")
+		quicheCache, err = quiche.Load(c.Resources.Quiche)
+		if err != nil {
+			panic(err)
+		}
+		quicheIndex = searchrefiner.NewQuicheIndex(quicheCache)
 	}
-	fmt.Println("loading cui2vec mapping...")
-	cuiMapping, err := cui2vec.LoadCUIMapping(c.Resources.Cui2VecMappings)
-	if err != nil {
-		panic(err)
+	var meshTree *mesh.Tree
+	if len(c.Resources.MeSH) > 0 {
+		fmt.Println("loading MeSH descriptors...")
+		meshTree, err = mesh.Load(c.Resources.MeSH)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
-	fmt.Println("loading cui2vec model...")
-	cui2vecf, err := os.Open(c.Resources.Cui2VecEmbeddings)
-	if err != nil {
-		panic(err)
+	var cuiMapping cui2vec.Mapping
+	if len(c.Resources.Cui2VecMappings) > 0 {
+		fmt.Println("loading cui2vec mapping...")
+		cuiMapping, err = cui2vec.LoadCUIMapping(c.Resources.Cui2VecMappings)
+		if err != nil {
+			panic(err)
+		}
 	}
-	cuiEmbeddings, err := cui2vec.NewPrecomputedEmbeddings(cui2vecf)
-	if err != nil {
-		panic(err)
+	var cuiEmbeddings *cui2vec.PrecomputedEmbeddings
+	if len(c.Resources.Cui2VecEmbeddings) > 0 {
+		fmt.Println("loading cui2vec model...")
+		cui2vecf, err := os.Open(c.Resources.Cui2VecEmbeddings)
+		if err != nil {
+			panic(err)
+		}
+		cuiEmbeddings, err = cui2vec.NewPrecomputedEmbeddings(cui2vecf)
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	fs, err := ioutil.ReadDir(searchrefiner.PluginStoragePath)
@@ -131,26 +165,56 @@ func main() {
 
 	perm.AddAdminPath("/admin")
 
-	ss, err := stats.NewEntrezStatisticsSource(
-		stats.EntrezOptions(stats.SearchOptions{Size: 100000, RunName: "searchrefiner"}),
-		stats.EntrezTool("searchrefiner"),
-		stats.EntrezEmail(c.Entrez.Email),
-		stats.EntrezAPIKey(c.Entrez.APIKey))
+	stateDB, err := bolt.Open(searchrefiner.StatePath, 0664, nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	history, err := searchrefiner.NewHistoryStore(stateDB)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	seeds, err := searchrefiner.NewSeedStore(stateDB)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	projects, err := searchrefiner.NewProjectStore(stateDB)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	backend, err := searchrefiner.NewSearchBackend(c)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// The Elasticsearch client is long-lived so that connections and cached term frequencies are reused.
+	var elasticClient *searchrefiner.ElasticClient
+	if len(c.Services.ElasticsearchPubMedURL) > 0 {
+		elasticClient, err = searchrefiner.NewElasticClient(c.Services)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	s := searchrefiner.Server{
 		Perm:     perm,
 		Config:   c,
-		Queries:  make(map[string][]searchrefiner.Query),
-		Settings: make(map[string]searchrefiner.Settings),
-		Storage:  storage,
-
-		Entrez:        ss,
+		History:  history,
+		Seeds:    seeds,
+		Projects: projects,
+		State:    searchrefiner.NewState(storage),
+		Events:   searchrefiner.NewEventBus(),
+
+		Backend:       backend,
+		Elastic:       elasticClient,
 		CUIEmbeddings: cuiEmbeddings,
 		CUIMapping:    cuiMapping,
 		QuicheCache:   quicheCache,
+		Quiche:        quicheIndex,
+		MeSH:          meshTree,
 		MetaMapClient: metawrap.HTTPClient{URL: c.Services.MetaMapURL},
 	}
 
@@ -183,30 +247,25 @@ func main() {
 	}
 	for _, file := range files {
 		if file.IsDir() {
-			// Open the shared object file that will become the plugin.
 			p := file.Name()
+			dir := path.Join("plugin", p)
+			remote := searchrefiner.IsRemotePlugin(dir)
 
-			plug, err := plugin.Open(path.Join("plugin", p, "plugin.so"))
-			if err != nil {
-				panic(err)
-			}
-
-			// Grab the exported type.
-			sym, err := plug.Lookup(strings.Title(p))
+			// A plugin that cannot be loaded is disabled, rather than stopping the server from starting.
+			manifest, handle, err := loadPlugin(dir, s.Config.Plugins[p])
 			if err != nil {
-				log.Fatalln(err)
-			}
-
-			// Ensure the type implements the plugin.
-			var handle searchrefiner.Plugin
-			var ok bool
-			if handle, ok = sym.(searchrefiner.Plugin); !ok {
-				log.Fatalln("could not cast", p, "to plugin")
+				log.Errorf("[plugin] %s is disabled: %v", p, err)
+				s.DisabledPlugins = append(s.DisabledPlugins, searchrefiner.DisabledPlugin{Name: p, Manifest: manifest, Error: err.Error()})
+				continue
 			}
 
 			// Configure the permissions for this plugin.
 			p = path.Join("./plugin/", p)
-			switch handle.PermissionType() {
+			permission, ok := manifest.PermissionType()
+			if !ok {
+				permission = handle.PermissionType()
+			}
+			switch permission {
 			case searchrefiner.PluginAdmin:
 				perm.AddAdminPath(p)
 			case searchrefiner.PluginPublic:
@@ -217,51 +276,62 @@ func main() {
 				perm.AddPublicPath(p)
 			}
 
-			pluginFiles, err := ioutil.ReadDir(p)
-			if err != nil {
-				panic(err)
-			}
-			for _, f := range pluginFiles {
-				if !f.IsDir() {
-					parts := strings.Split(f.Name(), ".")
-					if len(parts) < 2 {
-						continue
-					}
-					if parts[len(parts)-2] == "tmpl" && parts[len(parts)-1] == "html" {
-						fmt.Println(path.Join(p, f.Name()))
-						pluginTemplates = append(pluginTemplates, path.Join(p, f.Name()))
-					}
-				}
+			for _, t := range manifest.Templates {
+				fmt.Println(path.Join(dir, t))
+				pluginTemplates = append(pluginTemplates, path.Join(dir, t))
 			}
 
+			s.State.AddPlugin(p, handle)
 			s.Plugins = append(s.Plugins, searchrefiner.InternalPluginDetails{
 				URL:           p,
 				PluginDetails: handle.Details(),
 			})
 
-			g.Static(path.Join(p, "static"), path.Join("plugin", file.Name(), "static"))
+			// Remote plugins serve their own static files, along with anything else under their path.
+			routes := []string{p}
+			if remote {
+				routes = append(routes, path.Join(p, "*path"))
+			} else if len(manifest.Static) > 0 {
+				g.Static(path.Join(p, "static"), path.Join(dir, manifest.Static))
+			}
 
 			if p == s.Config.Mode && s.Config.EnableAll == false {
 				// Register the handler with gin.
-				g.GET(p, func(c *gin.Context) {
-					handle.Serve(s, c)
-				})
-				g.POST(p, func(c *gin.Context) {
-					handle.Serve(s, c)
-				})
-				break
+				for _, route := range routes {
+					g.GET(route, s.RequirePluginRole(handle.Details()), func(c *gin.Context) {
+						handle.Serve(s, c)
+					})
+					g.POST(route, s.RequirePluginRole(handle.Details()), func(c *gin.Context) {
+						handle.Serve(s, c)
+					})
+				}
+				// Plugins may also register their own routes under their path.
+				if router, ok := handle.(searchrefiner.PluginRouter); ok {
+					router.Routes(searchrefiner.NewPluginRoutes(&s, g.Group(p), permission))
+				}
 			} else if s.Config.EnableAll == true {
 				// Register the handler with gin.
-				g.GET(p, func(c *gin.Context) {
-					handle.Serve(s, c)
-				})
-				g.POST(p, func(c *gin.Context) {
-					handle.Serve(s, c)
-				})
+				for _, route := range routes {
+					g.GET(route, s.RequirePluginRole(handle.Details()), func(c *gin.Context) {
+						handle.Serve(s, c)
+					})
+					g.POST(route, s.RequirePluginRole(handle.Details()), func(c *gin.Context) {
+						handle.Serve(s, c)
+					})
+				}
+				// Plugins may also register their own routes under their path.
+				if router, ok := handle.(searchrefiner.PluginRouter); ok {
+					router.Routes(searchrefiner.NewPluginRoutes(&s, g.Group(p), permission))
+				}
 			}
 
 			log.Println("running startup for", p)
 			handle.Startup(s)
+
+			// In single plugin mode, no more plugins are loaded once the plugin of the mode has started.
+			if p == s.Config.Mode && s.Config.EnableAll == false {
+				break
+			}
 		}
 	}
 
@@ -270,6 +340,7 @@ func main() {
 		"web/query.html", "web/index.html", "web/transform.html",
 		"web/account_create.html", "web/account_login.html", "web/admin.html",
 		"web/help.html", "web/error.html", "web/results.html", "web/settings.html", "web/plugins.html",
+		"web/diff.html", "web/report.html",
 	}, append(searchrefiner.Components)...)...)
 	searchrefiner.PluginTemplates = pluginTemplates
 
@@ -290,10 +361,15 @@ func main() {
 	g.GET("/account/api/logout", s.ApiAccountLogout)
 	g.GET("/api/username", s.ApiAccountUsername)
 
+	// Routes that change the history or seed studies of a project require the editor role, and routes that clear
+	// the history of every member of a project require the owner role.
+	editor := s.RequireRole(searchrefiner.RoleEditor)
+	owner := s.RequireRole(searchrefiner.RoleOwner)
+
 	if c.EnableAll == true {
 		// Main query interface.
 		g.GET("/", s.HandleIndex)
-		g.GET("/clear", s.HandleClear)
+		g.GET("/clear", owner, s.HandleClear)
 		g.POST("/query", s.HandleQuery)
 		g.GET("/query", s.HandleQuery)
 	} else {
@@ -308,6 +384,7 @@ func main() {
 	g.POST("/results", s.HandleResults)
 	g.GET("/results", s.HandleResults)
 	g.POST("/api/scroll", s.ApiScroll)
+	g.POST("/api/export", s.ApiExport)
 
 	// Editor interface.
 	g.GET("/transform", searchrefiner.HandleTransform)
@@ -315,15 +392,35 @@ func main() {
 	g.POST("/api/transform", searchrefiner.ApiTransform)
 	g.POST("/api/cqr2query", searchrefiner.ApiCQR2Query)
 	g.POST("/api/query2cqr", searchrefiner.ApiQuery2CQR)
+	g.POST("/api/lint", searchrefiner.ApiLint)
+	g.POST("/api/translate", s.ApiTranslate)
+	g.GET("/api/languages", searchrefiner.ApiLanguages)
 	g.POST("/api/keywordSuggestor", s.ApiKeywordSuggestor)
+	g.GET("/api/mesh/tree", s.ApiMeSHTree)
+	g.GET("/api/mesh/entry", s.ApiMeSHEntry)
+	g.GET("/api/mesh/explode", s.ApiMeSHExplode)
 	g.GET("/api/history", s.ApiHistoryGet)
-	g.POST("/api/history", s.ApiHistoryAdd)
-	g.DELETE("/api/history", s.ApiHistoryDelete)
+	g.POST("/api/history", editor, s.ApiHistoryAdd)
+	g.DELETE("/api/history", owner, s.ApiHistoryDelete)
+	g.GET("/api/history/versions", s.ApiHistoryVersions)
+	g.GET("/api/history/diff", s.ApiHistoryDiff)
+	g.GET("/api/report", s.ApiSearchReport)
+	g.GET("/history/diff", s.HandleHistoryDiff)
+	g.GET("/api/projects", s.ApiProjectsList)
+	g.POST("/api/projects", s.ApiProjectsCreate)
+	g.POST("/api/projects/active", s.ApiProjectsActivate)
+	g.POST("/api/projects/members", s.ApiProjectsMember)
 
 	if s.Config.EnableAll == true {
 		// Settings page.
 		g.GET("/settings", s.HandleSettings)
-		g.POST("/api/settings/relevant", s.ApiSettingsRelevantSet)
+		g.POST("/api/settings/relevant", editor, s.ApiSettingsRelevantSet)
+		g.POST("/api/settings/relevant/import", editor, s.ApiSettingsRelevantImport)
+		g.GET("/api/settings/seeds", s.ApiSeedsList)
+		g.POST("/api/settings/seeds", editor, s.ApiSeedsCreate)
+		g.POST("/api/settings/seeds/rename", editor, s.ApiSeedsRename)
+		g.POST("/api/settings/seeds/delete", editor, s.ApiSeedsDelete)
+		g.POST("/api/settings/seeds/active", editor, s.ApiSeedsActivate)
 
 		// Plugins page.
 		g.GET("/plugins", s.HandlePlugins)
@@ -331,6 +428,12 @@ func main() {
 		// Settings page.
 		g.GET("/settings", s.HandlePluginWithControl)
 		g.POST("/api/settings/relevant", s.HandlePluginWithControl)
+		g.POST("/api/settings/relevant/import", s.HandlePluginWithControl)
+		g.GET("/api/settings/seeds", s.HandlePluginWithControl)
+		g.POST("/api/settings/seeds", s.HandlePluginWithControl)
+		g.POST("/api/settings/seeds/rename", s.HandlePluginWithControl)
+		g.POST("/api/settings/seeds/delete", s.HandlePluginWithControl)
+		g.POST("/api/settings/seeds/active", s.HandlePluginWithControl)
 
 		// Plugins page.
 		g.GET("/plugins", s.HandlePluginWithControl)
@@ -355,5 +458,92 @@ func main() {
  https://ielab.io/searchrefiner
 
 `)
-	log.Fatalln(g.Run(c.Host))
+	srv := &http.Server{Addr: c.Host, Handler: g}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+
+	// Shut down gracefully, so that plugins can flush their state and the databases are closed cleanly.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, os.Interrupt)
+	<-quit
+	log.Println("shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		log.Errorln(err)
+	}
+	err = s.State.Shutdown(ctx)
+	if err != nil {
+		log.Errorln(err)
+	}
+	err = stateDB.Close()
+	if err != nil {
+		log.Errorln(err)
+	}
+	perm.UserState().Host().Close()
+	log.Println("shut down")
+}
+
+// loadPlugin reads the manifest of the plugin in dir, either opens its plugin.so or starts its process, and
+// configures it.
+func loadPlugin(dir string, config json.RawMessage) (manifest searchrefiner.PluginManifest, handle searchrefiner.Plugin, err error) {
+	manifest, err = searchrefiner.LoadPluginManifest(dir)
+	if err != nil {
+		return
+	}
+	err = manifest.ValidateConfig(config)
+	if err != nil {
+		return
+	}
+
+	if searchrefiner.IsRemotePlugin(dir) {
+		// Start the process that serves the plugin.
+		var rp *searchrefiner.RemotePlugin
+		rp, err = searchrefiner.StartRemotePlugin(dir, "/"+dir)
+		if err != nil {
+			return
+		}
+		if err = rp.Configure(config); err != nil {
+			rp.Stop()
+			return
+		}
+		handle = rp
+		return
+	}
+
+	// Plugins built against different versions of packages panic when they are opened.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	// Open the shared object file that will become the plugin.
+	plug, err := plugin.Open(path.Join(dir, "plugin.so"))
+	if err != nil {
+		return
+	}
+
+	// Grab the exported type.
+	sym, err := plug.Lookup(manifest.Symbol)
+	if err != nil {
+		return
+	}
+
+	// Ensure the type implements the plugin.
+	var ok bool
+	if handle, ok = sym.(searchrefiner.Plugin); !ok {
+		err = fmt.Errorf("%s does not implement searchrefiner.Plugin", manifest.Symbol)
+		return
+	}
+
+	if c, ok := handle.(searchrefiner.PluginConfigurer); ok {
+		err = c.Configure(config)
+	}
+	return
 }
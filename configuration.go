@@ -1,14 +1,15 @@
 package searchrefiner
 
 import (
+	"encoding/json"
 	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/render"
 	"github.com/hscells/cui2vec"
 	"github.com/hscells/groove/combinator"
-	"github.com/hscells/groove/stats"
 	"github.com/hscells/metawrap"
 	"github.com/hscells/quickumlsrest"
+	"github.com/ielab/searchrefiner/mesh"
 	"github.com/xyproto/permissionbolt"
 	"html/template"
 	"path"
@@ -33,6 +34,9 @@ const (
 type EntrezConfig struct {
 	Email  string
 	APIKey string
+	// URL is the base URL of an E-utilities compatible server (such as cmd/fakeentrez) that is used instead of
+	// the NCBI E-utilities when set.
+	URL string
 }
 
 type Services struct {
@@ -48,8 +52,10 @@ type Services struct {
 	DefaultRetSize              int
 	MaxRetSize                  int
 	MaxPool                     int
+	PMIConcurrency              int
 	Merged                      bool
 	Sources                     string
+	Fusion                      string
 }
 
 type OtherServiceAddresses struct {
@@ -61,12 +67,15 @@ type Config struct {
 	AdminEmail            string
 	Admins                []string
 	Entrez                EntrezConfig
+	Backend               BackendConfig
 	Resources             Resources // TODO: This should be merged into the Services struct.
 	Mode                  string
 	EnableAll             bool
 	Services              Services
 	ExchangeServerAddress string
 	OtherServiceAddresses OtherServiceAddresses
+	// Plugins configures plugins, by the name of the plugin.
+	Plugins map[string]json.RawMessage
 }
 
 type Resources struct {
@@ -74,6 +83,8 @@ type Resources struct {
 	Cui2VecMappings   string
 	Quiche            string
 	QuickRank         string
+	// MeSH is the path to the NLM MeSH descriptor file (e.g., desc2021.xml or desc2021.xml.gz).
+	MeSH string
 }
 
 type Query struct {
@@ -84,6 +95,27 @@ type Query struct {
 	NumRelRet   int64     `csv:"num_rel_ret"`
 	Relevant    []string  `csv:"relevant"`
 
+	// ID identifies the query in the history of a user.
+	ID uint64 `csv:"id"`
+	// Strategy groups the versions of a search strategy, which are numbered from 1. Each version but the first has
+	// the ID of the version it was revised from as its Parent.
+	Strategy string `csv:"strategy"`
+	Version  int    `csv:"version"`
+	Parent   uint64 `csv:"parent"`
+	Author   string `csv:"author"`
+	Message  string `csv:"message"`
+	// Limits are the limits that were applied to the query by the interface it was run from, rather than in the
+	// query itself, such as a date range.
+	Limits []string `csv:"limits"`
+	// ParserOptions are the field options the query was parsed with, so that it is parsed the same way again.
+	ParserOptions ParserOptions `csv:"parser_options"`
+	// Database and Platform are the database that the query was run on and the interface that searched it, and
+	// Lines are the number of citations that each line of the query retrieved when it was run, so that the search
+	// can be reported as it was run.
+	Database string       `csv:"database"`
+	Platform string       `csv:"platform"`
+	Lines    []ReportLine `csv:"lines"`
+
 	Plugins     []InternalPluginDetails
 	PluginTitle string
 }
@@ -94,20 +126,31 @@ type ErrorPage struct {
 }
 
 type Settings struct {
-	Relevant combinator.Documents
+	Workspace   Workspace
+	Projects    []ProjectMembership
+	Relevant    combinator.Documents
+	Active      SeedCollection
+	Collections []SeedCollection
 }
 
 type Server struct {
 	Perm     *permissionbolt.Permissions
-	Queries  map[string][]Query
-	Settings map[string]Settings
+	History  *HistoryStore
+	Seeds    *SeedStore
+	Projects *ProjectStore
+	State    *State
+	Events   *EventBus
 	Config   Config
 	Plugins  []InternalPluginDetails
-	Storage  map[string]*PluginStorage
+	// DisabledPlugins are the plugins that could not be loaded.
+	DisabledPlugins []DisabledPlugin
 
-	Entrez        stats.EntrezStatisticsSource
+	Backend       SearchBackend
+	Elastic       *ElasticClient
 	CUIEmbeddings *cui2vec.PrecomputedEmbeddings
 	QuicheCache   quickumlsrest.Cache
+	Quiche        *QuicheIndex
+	MeSH          *mesh.Tree
 	CUIMapping    cui2vec.Mapping
 	MetaMapClient metawrap.HTTPClient
 }
@@ -180,7 +223,7 @@ func RenderPlugin(tmpl template.Template, data interface{}) render.HTML {
 
 func (s Server) getAllPluginStorage() (map[string]map[string]map[string]string, error) {
 	st := make(map[string]map[string]map[string]string)
-	for plugin, ps := range s.Storage {
+	for plugin, ps := range s.State.AllStorage() {
 		st[plugin] = make(map[string]map[string]string)
 		buckets, err := ps.GetBuckets()
 		if err != nil {
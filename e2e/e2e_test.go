@@ -0,0 +1,602 @@
+//go:build e2e
+// +build e2e
+
+// Package e2e runs searchrefiner end to end against the fake E-utilities server in fakeentrez.
+//
+// The test builds the server and its plugins into a temporary directory, boots it with a configuration that points
+// Entrez at the fake server, creates an account, and then exercises the query, results, scroll, history, and
+// QueryVis endpoints, and the example remote plugin, checking the responses against the bundled fixture records.
+// It is only built with the e2e tag:
+//
+//	go test -tags e2e ./e2e
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ielab/searchrefiner"
+	"github.com/ielab/searchrefiner/fakeentrez"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The query that is issued in every check, and what it should retrieve from the fixtures.
+const (
+	testQuery = `(statin*[tiab] OR aspirin[tiab] OR beta blockers[tiab]) AND myocardial infarction[tiab]`
+	testLang  = "pubmed"
+	testTitle = "Early statin therapy after acute myocardial infarction"
+	testHits  = 3
+)
+
+var testSeeds = []int64{90000001, 90000003, 90000004}
+
+type harness struct {
+	base   string
+	client *http.Client
+}
+
+// check runs a check as a subtest, so that each failure is reported with the name of the check.
+func check(t *testing.T, name string, f func() error) {
+	t.Run(name, func(t *testing.T) {
+		if err := f(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+type response struct {
+	status int
+	body   []byte
+	err    error
+}
+
+func read(resp *http.Response, err error) response {
+	if err != nil {
+		return response{err: err}
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return response{status: resp.StatusCode, body: b, err: err}
+}
+
+func (h *harness) post(path string, form url.Values) response {
+	return read(h.client.PostForm(h.base+path, form))
+}
+
+func (h *harness) get(path string) response {
+	return read(h.client.Get(h.base + path))
+}
+
+func (h *harness) delete(path string) response {
+	req, err := http.NewRequest(http.MethodDelete, h.base+path, nil)
+	if err != nil {
+		return response{err: err}
+	}
+	return read(h.client.Do(req))
+}
+
+// expect checks that the request succeeded and that the body contains each of the strings.
+func (r response) expect(contains ...string) error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.status != http.StatusOK {
+		return fmt.Errorf("status %d: %s", r.status, truncate(r.body))
+	}
+	for _, s := range contains {
+		if !bytes.Contains(r.body, []byte(s)) {
+			return fmt.Errorf("response does not contain %q", s)
+		}
+	}
+	return nil
+}
+
+func truncate(b []byte) string {
+	if len(b) > 200 {
+		return string(b[:200]) + "..."
+	}
+	return string(b)
+}
+
+func run(dir string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// build compiles the server and plugins into work, and links in the files they need at runtime.
+func build(repo, work string) error {
+	err := run(repo, "go", "build", "-o", filepath.Join(work, "server"), "./cmd/searchrefiner")
+	if err != nil {
+		return err
+	}
+	for _, d := range []string{"web", "components"} {
+		err = os.Symlink(filepath.Join(repo, d), filepath.Join(work, d))
+		if err != nil {
+			return err
+		}
+	}
+	err = os.MkdirAll(filepath.Join(work, searchrefiner.PluginStoragePath), 0777)
+	if err != nil {
+		return err
+	}
+	plugins, err := ioutil.ReadDir(filepath.Join(repo, "plugin"))
+	if err != nil {
+		return err
+	}
+	for _, p := range plugins {
+		if !p.IsDir() {
+			continue
+		}
+		dst := filepath.Join(work, "plugin", p.Name())
+		err = os.MkdirAll(dst, 0777)
+		if err != nil {
+			return err
+		}
+		err = run(repo, "go", "build", "-buildmode=plugin", "-o", filepath.Join(dst, "plugin.so"), "./"+filepath.Join("plugin", p.Name()))
+		if err != nil {
+			return err
+		}
+		files, err := ioutil.ReadDir(filepath.Join(repo, "plugin", p.Name()))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.Name() == "plugin.so" {
+				continue
+			}
+			err = os.Symlink(filepath.Join(repo, "plugin", p.Name(), f.Name()), filepath.Join(dst, f.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// The example remote plugin is run as a separate process, rather than loaded from plugin.so.
+	err = run(repo, "go", "build", "-o", filepath.Join(work, "plugin", "example", searchrefiner.RemotePluginExecutable), "./remote/example")
+	if err != nil {
+		return err
+	}
+
+	// A plugin that requires a later version of searchrefiner is disabled, rather than stopping it from starting.
+	err = os.MkdirAll(filepath.Join(work, "plugin", "broken"), 0777)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(work, "plugin", "broken", searchrefiner.PluginManifestFile), []byte(`{"Name": "broken", "Symbol": "Broken", "Requires": ">=99"}`), 0644)
+}
+
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+func TestEndToEnd(t *testing.T) {
+	repo, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := t.TempDir()
+
+	t.Log("building searchrefiner...")
+	err = build(repo, work)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake, err := fakeentrez.New(bytes.NewReader(fakeentrez.Fixtures))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	entrez := httptest.NewServer(fake)
+	defer entrez.Close()
+
+	addr, err := freeAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := searchrefiner.Config{
+		Host:       addr,
+		AdminEmail: "admin@example.com",
+		Admins:     []string{"admin"},
+		Entrez:     searchrefiner.EntrezConfig{Email: "e2e@example.com", URL: entrez.URL},
+		EnableAll:  true,
+		Plugins:    map[string]json.RawMessage{"example": json.RawMessage(`{"Greeting": "Welcome"}`)},
+	}
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(work, "config.json"), b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logf, err := os.Create(filepath.Join(work, "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logf.Close()
+	// The server logs are reported when something fails, so that they can be inspected.
+	defer func() {
+		if t.Failed() {
+			b, _ := ioutil.ReadFile(logf.Name())
+			t.Logf("server log:\n%s", b)
+		}
+	}()
+	server := exec.Command(filepath.Join(work, "server"))
+	server.Dir = work
+	server.Stdout = logf
+	server.Stderr = logf
+	err = server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Process.Kill()
+
+	jar, _ := cookiejar.New(nil)
+	h := &harness{base: "http://" + addr, client: &http.Client{Jar: jar, Timeout: time.Minute}}
+
+	t.Log("waiting for searchrefiner to start on", addr)
+	started := false
+	for deadline := time.Now().Add(time.Minute); time.Now().Before(deadline); time.Sleep(250 * time.Millisecond) {
+		if h.get("/account/login").expect() == nil {
+			started = true
+			break
+		}
+	}
+	if !started {
+		t.Fatal("searchrefiner did not start")
+	}
+
+	check(t, "create account", func() error {
+		return h.post("/account/api/create", url.Values{
+			"username":  {"e2e"},
+			"password":  {"e2e"},
+			"password2": {"e2e"},
+		}).expect()
+	})
+
+	form := url.Values{"query": {testQuery}, "lang": {testLang}}
+
+	check(t, "/query", func() error {
+		return h.post("/query", form).expect(fmt.Sprintf("<b>%d</b> results", testHits))
+	})
+
+	check(t, "/results", func() error {
+		return h.post("/results", form).expect(testTitle, fmt.Sprintf("Retrieved <b>%d</b> citations", testHits))
+	})
+
+	check(t, "/api/scroll", func() error {
+		scroll := url.Values{"query": {testQuery}, "lang": {testLang}, "start": {"0"}}
+		r := h.post("/api/scroll", scroll)
+		if err := r.expect(); err != nil {
+			return err
+		}
+		var resp struct {
+			Documents []struct{ PMID string }
+			Total     float64
+		}
+		if err := json.Unmarshal(r.body, &resp); err != nil {
+			return err
+		}
+		if int(resp.Total) != testHits || len(resp.Documents) != testHits {
+			return fmt.Errorf("expected %d documents, got %d of %v", testHits, len(resp.Documents), resp.Total)
+		}
+		return nil
+	})
+
+	check(t, "/api/history", func() error {
+		if err := h.post("/api/history", form).expect(); err != nil {
+			return err
+		}
+		r := h.get("/api/history")
+		if err := r.expect(); err != nil {
+			return err
+		}
+		var history []searchrefiner.Query
+		if err := json.Unmarshal(r.body, &history); err != nil {
+			return err
+		}
+		for _, q := range history {
+			if q.QueryString == testQuery && q.NumRet == testHits {
+				return nil
+			}
+		}
+		return fmt.Errorf("query not found in history: %s", truncate(r.body))
+	})
+
+	check(t, "/api/history/diff", func() error {
+		var first, second searchrefiner.Query
+		r := h.post("/api/history", url.Values{"query": {testQuery}, "lang": {testLang}, "message": {"first version"}})
+		if err := r.expect(); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(r.body, &first); err != nil {
+			return err
+		}
+		revised := testQuery + " AND therapy[tiab]"
+		r = h.post("/api/history", url.Values{"query": {revised}, "lang": {testLang}, "parent": {fmt.Sprint(first.ID)}})
+		if err := r.expect(); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(r.body, &second); err != nil {
+			return err
+		}
+		if second.Strategy != first.Strategy || second.Version != first.Version+1 {
+			return fmt.Errorf("expected version %d of %s, got version %d of %s", first.Version+1, first.Strategy, second.Version, second.Strategy)
+		}
+		if err := h.get("/api/history/versions?strategy=" + url.QueryEscape(first.Strategy)).expect(`"Message":"first version"`); err != nil {
+			return err
+		}
+		diff := fmt.Sprintf("diff?from=%d&to=%d", first.ID, second.ID)
+		if err := h.get("/api/history/"+diff).expect(`"added":["AND: therapy [title_abstract] (exploded)"]`, `"removed":[]`); err != nil {
+			return err
+		}
+		if err := h.get("/history/"+diff).expect("AND: therapy [title_abstract] (exploded)", "first version"); err != nil {
+			return err
+		}
+		if r := h.post("/api/history", url.Values{"query": {revised}, "lang": {testLang}, "parent": {"999999"}}); r.status != http.StatusBadRequest {
+			return fmt.Errorf("expected an unknown parent to be rejected with status %d, got %d", http.StatusBadRequest, r.status)
+		}
+		return nil
+	})
+
+	check(t, "/api/report", func() error {
+		r := h.post("/api/history", url.Values{"query": {testQuery}, "lang": {testLang}, "strategy": {"e2e report"}, "date": {"2000:2020"}, "lines": {"true"}})
+		if err := r.expect(); err != nil {
+			return err
+		}
+		report := "/api/report?strategy=" + url.QueryEscape("e2e report")
+		if err := h.get(report).expect("## PubMed", "2000:2020 [publication_date]", "| 1 |"); err != nil {
+			return err
+		}
+		if err := h.get(report+"&format=html").expect("<h2>PubMed</h2>", "<td>1</td>"); err != nil {
+			return err
+		}
+		// The lines of the report are those recorded when the query was run, so the last line is the whole query.
+		r = h.get(report + "&format=json")
+		if err := r.expect(); err != nil {
+			return err
+		}
+		var sr struct {
+			Searches []struct {
+				Database string
+				Syntax   string
+				Hits     int64
+				Lines    []struct{ Hits float64 }
+			}
+		}
+		if err := json.Unmarshal(r.body, &sr); err != nil {
+			return err
+		}
+		switch {
+		case len(sr.Searches) != 1 || len(sr.Searches[0].Lines) == 0:
+			return fmt.Errorf("expected a single search with lines: %s", truncate(r.body))
+		case sr.Searches[0].Database != "PubMed" || sr.Searches[0].Syntax != "PubMed":
+			return fmt.Errorf("expected a PubMed search in PubMed syntax: %s", truncate(r.body))
+		case int64(sr.Searches[0].Lines[len(sr.Searches[0].Lines)-1].Hits) != sr.Searches[0].Hits:
+			return fmt.Errorf("expected the last line to retrieve the %d records of the search: %s", sr.Searches[0].Hits, truncate(r.body))
+		}
+		return nil
+	})
+
+	check(t, "/api/languages", func() error {
+		return h.get("/api/languages").expect(`"name":"pubmed"`, `"name":"embase"`)
+	})
+
+	check(t, "/api/translate", func() error {
+		return h.post("/api/translate", url.Values{"query": {testQuery}, "lang": {testLang}, "target": {"medline"}, "hits": {"true"}}).
+			expect(`"target":"medline"`, `"original":"(statin*[Title/Abstract])"`, `"status":"mapped"`, `"original_hits":`)
+	})
+
+	check(t, "unknown language", func() error {
+		r := h.post("/api/scroll", url.Values{"query": {testQuery}, "lang": {"klingon"}, "start": {"0"}})
+		if r.err != nil {
+			return r.err
+		}
+		if r.status != http.StatusBadRequest {
+			return fmt.Errorf("expected status %d, got %d", http.StatusBadRequest, r.status)
+		}
+		return nil
+	})
+
+	check(t, "/plugin/queryvis tree", func() error {
+		seeds, err := json.Marshal(testSeeds)
+		if err != nil {
+			return err
+		}
+		err = read(h.client.Post(h.base+"/api/settings/relevant", "application/json", bytes.NewReader(seeds))).expect()
+		if err != nil {
+			return err
+		}
+
+		// Trees are served by the route QueryVis registers, and through the query string older clients use.
+		for _, route := range []string{"/plugin/queryvis/api/tree", "/plugin/queryvis?tree=y"} {
+			r := h.post(route, form)
+			if err := r.expect(); err != nil {
+				return err
+			}
+			var t struct {
+				Nodes []struct {
+					Value int `json:"value"`
+				} `json:"nodes"`
+				NumRel    int
+				NumRelRet int
+			}
+			if err := json.Unmarshal(r.body, &t); err != nil {
+				return err
+			}
+			switch {
+			case len(t.Nodes) == 0 || t.Nodes[0].Value != testHits:
+				return fmt.Errorf("%s: expected the root to retrieve %d citations: %s", route, testHits, truncate(r.body))
+			case t.NumRel != len(testSeeds) || t.NumRelRet != 2:
+				return fmt.Errorf("%s: expected 2 of %d seed studies to be retrieved, got %d of %d", route, len(testSeeds), t.NumRelRet, t.NumRel)
+			}
+		}
+		return nil
+	})
+
+	check(t, "/plugin/queryvis/consent", func() error {
+		anonymous := &harness{base: h.base, client: &http.Client{Timeout: time.Minute}}
+		if r := anonymous.post("/plugin/queryvis/consent", url.Values{"consent": {"n"}}); r.status != http.StatusForbidden {
+			return fmt.Errorf("expected users that are not logged in to be forbidden from consenting, got status %d", r.status)
+		}
+		if err := h.post("/plugin/queryvis/consent", url.Values{"consent": {"n"}}).expect("I <b>do not</b> consent"); err != nil {
+			return err
+		}
+		return h.post("/plugin/queryvis/consent", url.Values{"consent": {"y"}}).expect("I consent")
+	})
+
+	check(t, "/plugin/example", func() error {
+		if err := h.get("/plugin/example").expect("Welcome, <b>e2e</b>, working in e2e as owner"); err != nil {
+			return err
+		}
+		// The example plugin counts the QueryExecuted events it is sent, which are sent after the requests that
+		// publish them.
+		r := h.get("/plugin/example/status")
+		if err := r.expect("started: true"); err != nil {
+			return err
+		}
+		var (
+			started bool
+			queries int
+		)
+		if _, err := fmt.Sscanf(string(r.body), "started: %t, queries: %d", &started, &queries); err != nil {
+			return err
+		}
+		if queries == 0 {
+			return fmt.Errorf("the example plugin was not sent any QueryExecuted events")
+		}
+		return h.get("/plugins").expect("A minimal plugin that runs as a separate process.")
+	})
+
+	check(t, "disabled plugin", func() error {
+		return h.get("/plugins").expect("Disabled", "requires searchrefiner &gt;=99")
+	})
+
+	check(t, "plugin health", func() error {
+		ajar, _ := cookiejar.New(nil)
+		a := &harness{base: h.base, client: &http.Client{Jar: ajar, Timeout: time.Minute}}
+		err := a.post("/account/api/create", url.Values{"username": {"admin"}, "password": {"admin"}, "password2": {"admin"}}).expect()
+		if err != nil {
+			return err
+		}
+		return a.get("/admin").expect("Plugin health", "<td class=\"text-success\">healthy</td>")
+	})
+
+	check(t, "projects", func() error {
+		vjar, _ := cookiejar.New(nil)
+		v := &harness{base: h.base, client: &http.Client{Jar: vjar, Timeout: time.Minute}}
+		err := v.post("/account/api/create", url.Values{"username": {"e2e-viewer"}, "password": {"e2e"}, "password2": {"e2e"}}).expect()
+		if err != nil {
+			return err
+		}
+
+		var p searchrefiner.Project
+		r := h.post("/api/projects", url.Values{"name": {"e2e review"}})
+		if err := r.expect(); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(r.body, &p); err != nil {
+			return err
+		}
+		member := func(role string) error {
+			return h.post("/api/projects/members", url.Values{"id": {p.ID}, "username": {"e2e-viewer"}, "role": {role}}).expect()
+		}
+		if err := member("viewer"); err != nil {
+			return err
+		}
+		for _, u := range []*harness{h, v} {
+			if err := u.post("/api/projects/active", url.Values{"id": {p.ID}}).expect(); err != nil {
+				return err
+			}
+		}
+		// Return to the personal workspace so that the project does not affect other checks.
+		defer h.post("/api/projects/active", url.Values{"id": {""}})
+
+		revised := testQuery + " AND project[tiab]"
+		if err := h.post("/api/history", url.Values{"query": {revised}, "lang": {testLang}}).expect(); err != nil {
+			return err
+		}
+		if err := v.get("/api/history").expect(`"Author":"e2e"`, "project[tiab]"); err != nil {
+			return err
+		}
+		if r := v.post("/api/history", form); r.status != http.StatusForbidden {
+			return fmt.Errorf("expected a viewer to be forbidden from adding to the history, got status %d", r.status)
+		}
+		if err := member("editor"); err != nil {
+			return err
+		}
+		if err := h.get("/settings").expect("e2e review (owner)", "e2e-viewer"); err != nil {
+			return err
+		}
+		if err := v.post("/api/history", form).expect(); err != nil {
+			return err
+		}
+		// Clearing the history removes the queries of every member, so only owners may.
+		if r := v.delete("/api/history"); r.status != http.StatusForbidden {
+			return fmt.Errorf("expected an editor to be forbidden from clearing the history, got status %d", r.status)
+		}
+		if err := v.get("/api/history").expect("project[tiab]"); err != nil {
+			return err
+		}
+		if err := h.post("/api/projects/active", url.Values{"id": {""}}).expect(); err != nil {
+			return err
+		}
+		r = h.get("/api/history")
+		if err := r.expect(); err != nil {
+			return err
+		}
+		if bytes.Contains(r.body, []byte("project[tiab]")) {
+			return fmt.Errorf("the history of the project is in the personal history")
+		}
+		return nil
+	})
+
+	check(t, "graceful shutdown", func() error {
+		err := server.Process.Signal(syscall.SIGTERM)
+		if err != nil {
+			return err
+		}
+		exited := make(chan error, 1)
+		go func() { exited <- server.Wait() }()
+		select {
+		case err := <-exited:
+			if err != nil {
+				return fmt.Errorf("server exited with %v", err)
+			}
+		case <-time.After(time.Minute):
+			return fmt.Errorf("server did not shut down")
+		}
+		b, err := ioutil.ReadFile(logf.Name())
+		if err != nil {
+			return err
+		}
+		for _, msg := range []string{"example plugin shutting down", "shut down"} {
+			if !bytes.Contains(b, []byte(msg)) {
+				return fmt.Errorf("%q was not logged", msg)
+			}
+		}
+		return nil
+	})
+
+}
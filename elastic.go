@@ -0,0 +1,81 @@
+package searchrefiner
+
+import (
+	"context"
+	"errors"
+	"github.com/olivere/elastic/v7"
+	"github.com/patrickmn/go-cache"
+	"time"
+)
+
+const (
+	// frequencyCacheExpiration is how long document frequencies are cached for. The index of PubMed is only
+	// updated occasionally, so frequencies can be cached for a long time.
+	frequencyCacheExpiration = 24 * time.Hour
+	// defaultPMIConcurrency is the number of suggestion candidates scored at once when Services.PMIConcurrency
+	// is not configured.
+	defaultPMIConcurrency = 8
+)
+
+var errElasticNotConfigured = errors.New("an Elasticsearch index of PubMed has not been configured")
+
+// ElasticClient is a long-lived client for the Elasticsearch index of PubMed that is used to suggest keywords.
+// The document frequencies of terms (and pairs of terms) are cached, as the same terms are counted many times.
+type ElasticClient struct {
+	*elastic.Client
+	index       string
+	frequencies *cache.Cache
+}
+
+// NewElasticClient creates a client for the index of PubMed configured in the services.
+func NewElasticClient(c Services) (*ElasticClient, error) {
+	client, err := elastic.NewSimpleClient(
+		elastic.SetURL(c.ElasticsearchPubMedURL),
+		elastic.SetBasicAuth(c.ElasticsearchPubMedUsername, c.ElasticsearchPubMedPassword))
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticClient{
+		Client:      client,
+		index:       c.IndexName,
+		frequencies: cache.New(frequencyCacheExpiration, time.Hour),
+	}, nil
+}
+
+// count counts the documents matching a query, using the cached count for key if there is one.
+func (e *ElasticClient) count(ctx context.Context, key string, query elastic.Query) (float64, error) {
+	if v, ok := e.frequencies.Get(key); ok {
+		return v.(float64), nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, suggestionTimeout)
+	defer cancel()
+	s := e.Count(e.index)
+	if query != nil {
+		s = s.Query(query)
+	}
+	n, err := s.Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	e.frequencies.SetDefault(key, float64(n))
+	return float64(n), nil
+}
+
+// CollectionSize is the number of documents in the index.
+func (e *ElasticClient) CollectionSize(ctx context.Context) (float64, error) {
+	return e.count(ctx, "N", nil)
+}
+
+// DocumentFrequency is the number of documents that match a term.
+func (e *ElasticClient) DocumentFrequency(ctx context.Context, term string) (float64, error) {
+	return e.count(ctx, "df\x00"+term, elastic.NewQueryStringQuery(term))
+}
+
+// CoDocumentFrequency is the number of documents that match both terms.
+func (e *ElasticClient) CoDocumentFrequency(ctx context.Context, term1, term2 string) (float64, error) {
+	if term2 < term1 {
+		term1, term2 = term2, term1
+	}
+	return e.count(ctx, "co\x00"+term1+"\x00"+term2,
+		elastic.NewBoolQuery().Must(elastic.NewQueryStringQuery(term1), elastic.NewQueryStringQuery(term2)))
+}
@@ -0,0 +1,568 @@
+package searchrefiner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hscells/cqr"
+	"github.com/hscells/transmute/backend"
+	"github.com/hscells/transmute/fields"
+	"github.com/hscells/transmute/ir"
+	"github.com/hscells/transmute/lexer"
+	"github.com/hscells/transmute/parser"
+	tpipeline "github.com/hscells/transmute/pipeline"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Embase (embase.com) queries use Emtree headings ('heart infarction'/exp), field codes (aspirin:ti,ab), and
+// proximity operators (NEAR/3, NEXT/3), and may be written over several lines that refer to each other (#1 AND #2).
+var (
+	// Embase2Cqr parses Embase queries.
+	Embase2Cqr = tpipeline.NewPipeline(
+		parser.QueryParser{FieldMapping: embaseFieldMapping, Parser: embaseTransformer{}},
+		embaseCQRBackend{},
+		tpipeline.TransmutePipelineOptions{
+			LexOptions:     lexer.LexOptions{FormatParenthesis: false},
+			RequiresLexing: false,
+		})
+	// Cqr2Embase compiles queries into Embase queries.
+	Cqr2Embase = tpipeline.NewPipeline(
+		parser.QueryParser{FieldMapping: parser.NewCQRParser().FieldMapping, Parser: orderedCQRTransformer{}},
+		embaseBackend{},
+		tpipeline.TransmutePipelineOptions{
+			LexOptions:     lexer.LexOptions{FormatParenthesis: false},
+			RequiresLexing: false,
+		})
+)
+
+// embaseFieldMapping maps Embase field codes to fields.
+var embaseFieldMapping = map[string][]string{
+	"ti":       {fields.Title},
+	"ab":       {fields.Abstract},
+	"ti,ab":    {fields.TitleAbstract},
+	"kw":       {fields.OtherTerm},
+	"ti,ab,kw": {fields.TitleAbstract, fields.OtherTerm},
+	"tw":       {fields.TextWord},
+	"au":       {fields.Authors},
+	"jt":       {fields.Journal},
+	"la":       {fields.Language},
+	"py":       {fields.PublicationDate},
+	"it":       {fields.PublicationType},
+	"de":       {fields.MeshHeadings},
+	"mj":       {fields.MeSHMajorTopic},
+	"default":  {fields.AllFields},
+}
+
+// embaseFieldCodes are the field codes that fields are compiled into, the reverse of embaseFieldMapping.
+var embaseFieldCodes = map[string]string{
+	fields.Title:           "ti",
+	fields.Abstract:        "ab",
+	fields.TitleAbstract:   "ti,ab",
+	fields.OtherTerm:       "kw",
+	fields.TextWord:        "tw",
+	fields.Authors:         "au",
+	fields.Author:          "au",
+	fields.Journal:         "jt",
+	fields.Language:        "la",
+	fields.PublicationDate: "py",
+	fields.PublicationType: "it",
+}
+
+// embaseErrorOption is the option of a parsed query that holds the error encountered when parsing it, since the
+// parsers of a pipeline cannot return errors.
+const embaseErrorOption = "embase_error"
+
+// embaseLinePrefix matches the number of a line, e.g., "#1", "1." or "1:". A number that is not marked as one may
+// still be the number of a line, which is decided by embaseLineNumber.
+var embaseLinePrefix = regexp.MustCompile(`^\s*(#)?(\d+)([.:])?\s+`)
+
+// embaseLineNumber finds the number of a line, which is expected to be n if it is not numbered, and the rest of the
+// line. A bare number is only taken to be the number of the line when it is n, so that searches that begin with a
+// number (e.g., 2019 diabetes) are left alone.
+func embaseLineNumber(line string, n int) (int, string) {
+	m := embaseLinePrefix.FindStringSubmatch(line)
+	if m == nil {
+		return n, line
+	}
+	number, err := strconv.Atoi(m[2])
+	if err != nil || (len(m[1]) == 0 && len(m[3]) == 0 && number != n) {
+		return n, line
+	}
+	return number, line[len(m[0]):]
+}
+
+type embaseTransformer struct{}
+
+func (embaseTransformer) TransformSingle(query string, mapping map[string][]string) ir.Keyword {
+	q := embaseTransformer{}.TransformNested(query, mapping)
+	if len(q.Children) == 1 && len(q.Children[0].Keywords) == 1 {
+		return q.Children[0].Keywords[0]
+	}
+	return ir.Keyword{QueryString: query, Fields: mapping["default"]}
+}
+
+// TransformNested parses the whole of an Embase query. Each line may be numbered, and may refer to earlier lines;
+// the last line is the query.
+func (embaseTransformer) TransformNested(query string, mapping map[string][]string) ir.BooleanQuery {
+	var (
+		lines = make(map[int]ir.BooleanQuery)
+		last  ir.BooleanQuery
+		n     int
+	)
+	for _, line := range strings.Split(query, "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		n++
+		number, line := embaseLineNumber(line, n)
+		p := &embaseParser{tokens: embaseTokens(line), mapping: mapping, lines: lines}
+		q, err := p.parse()
+		if err != nil {
+			return ir.BooleanQuery{Options: map[string]interface{}{embaseErrorOption: fmt.Sprintf("line %d: %v", n, err)}}
+		}
+		lines[number] = q
+		last = q
+	}
+	if n == 0 {
+		return ir.BooleanQuery{Options: map[string]interface{}{embaseErrorOption: "empty query"}}
+	}
+	if len(last.Operator) == 0 {
+		last.Operator = "or"
+	}
+	return ir.BooleanQuery{Children: []ir.BooleanQuery{last}}
+}
+
+// embaseTokens splits a line of an Embase query into words, quoted phrases, parentheses, and suffixes
+// (e.g., /exp or :ti,ab), which are kept attached to the word or phrase they follow.
+func embaseTokens(line string) []string {
+	var (
+		tokens []string
+		cur    strings.Builder
+		quote  rune
+	)
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			cur.WriteRune(r)
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			cur.WriteRune(r)
+		case r == '(':
+			flush()
+			tokens = append(tokens, "(")
+		case r == ')':
+			flush()
+			tokens = append(tokens, ")")
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+	// A suffix may follow a closing parenthesis, e.g., (heart OR cardiac):ti,ab.
+	var merged []string
+	for _, t := range tokens {
+		if len(merged) > 0 && merged[len(merged)-1] == ")" && (strings.HasPrefix(t, ":") || strings.HasPrefix(t, "/")) {
+			merged[len(merged)-1] += t
+			continue
+		}
+		merged = append(merged, t)
+	}
+	return merged
+}
+
+var embaseProximity = regexp.MustCompile(`^(?i)(near|next)/(\d+)$`)
+
+// embaseOperator normalises an operator token, returning false if the token is not an operator.
+func embaseOperator(t string) (string, bool) {
+	switch strings.ToLower(t) {
+	case "and", "or", "not":
+		return strings.ToLower(t), true
+	}
+	if m := embaseProximity.FindStringSubmatch(t); m != nil {
+		return "adj" + m[2], true
+	}
+	return "", false
+}
+
+// embasePrecedence orders operators from loosest to tightest binding.
+func embasePrecedence(op string) int {
+	switch op {
+	case "or":
+		return 1
+	case "and":
+		return 2
+	case "not":
+		return 3
+	}
+	return 4
+}
+
+type embaseParser struct {
+	tokens  []string
+	pos     int
+	mapping map[string][]string
+	lines   map[int]ir.BooleanQuery
+}
+
+func (p *embaseParser) parse() (ir.BooleanQuery, error) {
+	q, err := p.expression(1)
+	if err != nil {
+		return q, err
+	}
+	if p.pos < len(p.tokens) {
+		return q, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return q, nil
+}
+
+// expression parses operands joined by operators at least as tight as min.
+func (p *embaseParser) expression(min int) (ir.BooleanQuery, error) {
+	left, err := p.operand()
+	if err != nil {
+		return left, err
+	}
+	// Only the queries created here are extended with further operands; operands that were parenthesised keep
+	// their grouping.
+	combined := false
+	for p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		if strings.HasPrefix(t, ")") {
+			break
+		}
+		op, ok := embaseOperator(t)
+		if !ok {
+			// Adjacent terms are implicitly combined with AND.
+			op = "and"
+		}
+		if embasePrecedence(op) < min {
+			break
+		}
+		if ok {
+			p.pos++
+		}
+		right, err := p.expression(embasePrecedence(op) + 1)
+		if err != nil {
+			return left, err
+		}
+		if combined && left.Operator == op && op != "not" {
+			left = appendOperand(left, right)
+		} else {
+			left = appendOperand(appendOperand(ir.BooleanQuery{Operator: op}, left), right)
+			combined = true
+		}
+	}
+	return left, nil
+}
+
+// appendOperand adds an operand to a query. Operands are always added as children, including single keywords, so
+// that the order of the operands of NOT and NEAR/n is kept.
+func appendOperand(q, operand ir.BooleanQuery) ir.BooleanQuery {
+	q.Children = append(q.Children, operand)
+	return q
+}
+
+func (p *embaseParser) operand() (ir.BooleanQuery, error) {
+	if p.pos >= len(p.tokens) {
+		return ir.BooleanQuery{}, errors.New("unexpected end of query")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+
+	if t == "(" {
+		q, err := p.expression(1)
+		if err != nil {
+			return q, err
+		}
+		if p.pos >= len(p.tokens) || !strings.HasPrefix(p.tokens[p.pos], ")") {
+			return q, errors.New("missing closing parenthesis")
+		}
+		suffix := strings.TrimPrefix(p.tokens[p.pos], ")")
+		p.pos++
+		if len(suffix) > 0 {
+			f, err := p.fields(suffix)
+			if err != nil {
+				return q, err
+			}
+			q = applyFields(q, f)
+		}
+		return q, nil
+	}
+	if _, ok := embaseOperator(t); ok || t == ")" {
+		return ir.BooleanQuery{}, fmt.Errorf("unexpected %q", t)
+	}
+
+	if strings.HasPrefix(t, "#") {
+		n, err := strconv.Atoi(t[1:])
+		if err != nil {
+			return ir.BooleanQuery{}, fmt.Errorf("invalid line reference %s", t)
+		}
+		q, ok := p.lines[n]
+		if !ok {
+			return ir.BooleanQuery{}, fmt.Errorf("line %d has not been defined", n)
+		}
+		return q, nil
+	}
+
+	return p.keyword(t)
+}
+
+// fields resolves the suffix of a term, e.g., "/exp" or ":ti,ab".
+func (p *embaseParser) fields(suffix string) ([]string, error) {
+	switch strings.ToLower(suffix) {
+	case "/exp", "/de", "/syn":
+		return p.mapping["de"], nil
+	case "/mj":
+		return p.mapping["mj"], nil
+	}
+	if !strings.HasPrefix(suffix, ":") {
+		return nil, fmt.Errorf("unknown suffix %s", suffix)
+	}
+	codes := strings.ToLower(strings.TrimPrefix(suffix, ":"))
+	if f, ok := p.mapping[codes]; ok {
+		return f, nil
+	}
+	var f []string
+	for _, code := range strings.Split(codes, ",") {
+		m, ok := p.mapping[code]
+		if !ok {
+			m = p.mapping["default"]
+		}
+		f = append(f, m...)
+	}
+	sort.Strings(f)
+	return dedupeStrings(f), nil
+}
+
+func dedupeStrings(s []string) []string {
+	var ret []string
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// applyFields sets the fields of the keywords in a query that have not been given fields explicitly.
+func applyFields(q ir.BooleanQuery, f []string) ir.BooleanQuery {
+	for i, kw := range q.Keywords {
+		if explicit, ok := kw.Options["explicit_fields"].(bool); !ok || !explicit {
+			q.Keywords[i].Fields = f
+		}
+	}
+	for i, child := range q.Children {
+		q.Children[i] = applyFields(child, f)
+	}
+	return q
+}
+
+var embaseSuffix = regexp.MustCompile(`(/[A-Za-z]+|:[A-Za-z,]+)$`)
+
+func (p *embaseParser) keyword(t string) (ir.BooleanQuery, error) {
+	kw := ir.Keyword{Fields: p.mapping["default"], Options: map[string]interface{}{}}
+	var suffix string
+	if loc := embaseSuffix.FindStringIndex(t); loc != nil {
+		suffix = t[loc[0]:]
+		t = t[:loc[0]]
+	}
+	if len(suffix) > 0 {
+		f, err := p.fields(suffix)
+		if err != nil {
+			return ir.BooleanQuery{}, err
+		}
+		kw.Fields = f
+		kw.Exploded = strings.EqualFold(suffix, "/exp")
+		kw.Options["explicit_fields"] = true
+	}
+	t = strings.Trim(t, `'"`)
+	if len(t) == 0 {
+		return ir.BooleanQuery{}, errors.New("empty term")
+	}
+	kw.QueryString = t
+	kw.Truncated = strings.ContainsAny(t, "*?$")
+	return ir.BooleanQuery{Keywords: []ir.Keyword{kw}}, nil
+}
+
+// embaseCQRBackend compiles parsed Embase queries into the common query representation, reporting errors that
+// were encountered while parsing. The CQR backend of transmute is not used, as it puts the keywords of a query
+// before its children, which would reverse the operands of NOT.
+type embaseCQRBackend struct{}
+
+func (embaseCQRBackend) Compile(q ir.BooleanQuery) (backend.BooleanQuery, error) {
+	if err, ok := q.Options[embaseErrorOption]; ok {
+		return nil, fmt.Errorf("unable to parse Embase query, %v", err)
+	}
+	if len(q.Operator) == 0 && len(q.Children) == 1 {
+		q = q.Children[0]
+	}
+	repr := embaseRepr(q)
+	if _, ok := repr.(cqr.Keyword); ok {
+		repr = cqr.NewBooleanQuery(cqr.OR, []cqr.CommonQueryRepresentation{repr})
+	}
+	return backend.NewCQRQuery(repr), nil
+}
+
+// embaseRepr converts a parsed Embase query into the common query representation, keeping the order of its
+// operands. A query without an operator that has a single keyword is the keyword itself.
+func embaseRepr(q ir.BooleanQuery) cqr.CommonQueryRepresentation {
+	if len(q.Operator) == 0 && len(q.Keywords) == 1 && len(q.Children) == 0 {
+		kw := q.Keywords[0]
+		k := cqr.NewKeyword(kw.QueryString, kw.Fields...)
+		for key, v := range kw.Options {
+			if key != "explicit_fields" {
+				k.Options[key] = v
+			}
+		}
+		return k.SetOption(cqr.ExplodedString, kw.Exploded).SetOption(cqr.TruncatedString, kw.Truncated)
+	}
+	var children []cqr.CommonQueryRepresentation
+	for _, kw := range q.Keywords {
+		children = append(children, embaseRepr(ir.BooleanQuery{Keywords: []ir.Keyword{kw}}))
+	}
+	for _, child := range q.Children {
+		children = append(children, embaseRepr(child))
+	}
+	bq := cqr.NewBooleanQuery(q.Operator, children)
+	for k, v := range q.Options {
+		bq.Options[k] = v
+	}
+	return bq
+}
+
+// EmbaseQuery is a compiled Embase query.
+type EmbaseQuery struct {
+	repr string
+}
+
+func (e EmbaseQuery) Representation() (interface{}, error) {
+	return e.repr, nil
+}
+
+func (e EmbaseQuery) String() (string, error) {
+	return e.repr, nil
+}
+
+func (e EmbaseQuery) StringPretty() (string, error) {
+	return e.repr, nil
+}
+
+// orderedCQRTransformer parses the common query representation like the CQR parser of transmute, except that
+// keywords are kept in order with the other children of a query, as Embase is compiled from the order of the
+// children.
+type orderedCQRTransformer struct{}
+
+func (orderedCQRTransformer) TransformSingle(query string, mapping map[string][]string) ir.Keyword {
+	return parser.CQRTransformer{}.TransformSingle(query, mapping)
+}
+
+func (orderedCQRTransformer) TransformNested(query string, mapping map[string][]string) ir.BooleanQuery {
+	var rep map[string]interface{}
+	if err := json.Unmarshal([]byte(query), &rep); err != nil {
+		return ir.BooleanQuery{}
+	}
+	return orderedCQR(rep, mapping)
+}
+
+func orderedCQR(rep map[string]interface{}, mapping map[string][]string) ir.BooleanQuery {
+	children, ok := rep["children"].([]interface{})
+	if !ok {
+		// Keywords are parsed by the CQR parser, which wraps them in a query of their own.
+		b, err := json.Marshal(rep)
+		if err != nil {
+			return ir.BooleanQuery{}
+		}
+		return ir.BooleanQuery{Keywords: parser.CQRTransformer{}.TransformNested(string(b), mapping).Keywords}
+	}
+	q := ir.BooleanQuery{}
+	q.Operator, _ = rep["operator"].(string)
+	q.Options, _ = rep["options"].(map[string]interface{})
+	for _, child := range children {
+		if c, ok := child.(map[string]interface{}); ok {
+			q.Children = append(q.Children, orderedCQR(c, mapping))
+		}
+	}
+	return q
+}
+
+type embaseBackend struct{}
+
+func (embaseBackend) Compile(q ir.BooleanQuery) (backend.BooleanQuery, error) {
+	return EmbaseQuery{repr: compileEmbase(q, true)}, nil
+}
+
+func compileEmbase(q ir.BooleanQuery, root bool) string {
+	var parts []string
+	for _, kw := range q.Keywords {
+		parts = append(parts, compileEmbaseKeyword(kw))
+	}
+	for _, child := range q.Children {
+		parts = append(parts, compileEmbase(child, false))
+	}
+	op := strings.ToUpper(q.Operator)
+	if strings.HasPrefix(q.Operator, "adj") {
+		n := strings.TrimPrefix(q.Operator, "adj")
+		if len(n) == 0 {
+			n = "1"
+		}
+		op = "NEAR/" + n
+	}
+	if len(op) == 0 {
+		op = "AND"
+	}
+	s := strings.Join(parts, " "+op+" ")
+	if len(parts) > 1 && !root {
+		s = "(" + s + ")"
+	}
+	return s
+}
+
+func isMeSHField(f string) bool {
+	for _, m := range meshFields {
+		if f == m {
+			return true
+		}
+	}
+	return false
+}
+
+func compileEmbaseKeyword(kw ir.Keyword) string {
+	if len(kw.Fields) > 0 && isMeSHField(kw.Fields[0]) {
+		switch {
+		case kw.Fields[0] == fields.MeSHMajorTopic || kw.Fields[0] == fields.MajorFocusMeshHeading:
+			return "'" + kw.QueryString + "'/mj"
+		case kw.Exploded:
+			return "'" + kw.QueryString + "'/exp"
+		default:
+			return "'" + kw.QueryString + "'/de"
+		}
+	}
+	q := kw.QueryString
+	if strings.ContainsAny(q, " -") {
+		q = "'" + q + "'"
+	}
+	var codes []string
+	for _, f := range kw.Fields {
+		if c, ok := embaseFieldCodes[f]; ok && !containsString(codes, c) {
+			codes = append(codes, c)
+		}
+	}
+	if len(codes) == 0 {
+		return q
+	}
+	return q + ":" + strings.Join(codes, ",")
+}
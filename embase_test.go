@@ -0,0 +1,90 @@
+package searchrefiner
+
+import (
+	"github.com/hscells/cqr"
+	"testing"
+)
+
+// embaseRoundTrip parses an Embase query and compiles it back into Embase.
+func embaseRoundTrip(t *testing.T, query string) (cqr.CommonQueryRepresentation, string) {
+	t.Helper()
+	bq, err := Embase2Cqr.Execute(query)
+	if err != nil {
+		t.Fatalf("%q: %v", query, err)
+	}
+	repr, err := bq.Representation()
+	if err != nil {
+		t.Fatalf("%q: %v", query, err)
+	}
+	s, err := bq.String()
+	if err != nil {
+		t.Fatalf("%q: %v", query, err)
+	}
+	eq, err := Cqr2Embase.Execute(s)
+	if err != nil {
+		t.Fatalf("%q: %v", query, err)
+	}
+	out, err := eq.String()
+	if err != nil {
+		t.Fatalf("%q: %v", query, err)
+	}
+	return repr.(cqr.CommonQueryRepresentation), out
+}
+
+func TestEmbaseOperandOrder(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"(heart OR cardiac) NOT animal", "(heart OR cardiac) NOT animal"},
+		{"animal NOT (heart OR cardiac)", "animal NOT (heart OR cardiac)"},
+		{"1. heart OR cardiac\n2. animal\n3. #1 NOT #2", "(heart OR cardiac) NOT animal"},
+		{"#1 animal\n#2 heart OR cardiac\n#3 #2 NOT #1", "(heart OR cardiac) NOT animal"},
+		{"(heart OR cardiac) NEAR/3 failure", "(heart OR cardiac) NEAR/3 failure"},
+		{"failure NEAR/3 (heart OR cardiac)", "failure NEAR/3 (heart OR cardiac)"},
+		{"aspirin NEXT/2 'heart attack'", "aspirin NEAR/2 'heart attack'"},
+		{"'heart infarction'/exp NOT (rat OR mouse):ti,ab", "'heart infarction'/exp NOT (rat:ti,ab OR mouse:ti,ab)"},
+	}
+	for _, test := range tests {
+		_, got := embaseRoundTrip(t, test.query)
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestEmbaseNotRepresentation(t *testing.T) {
+	repr, _ := embaseRoundTrip(t, "(heart OR cardiac) NOT animal")
+	not, ok := repr.(cqr.BooleanQuery)
+	if !ok || not.Operator != "not" || len(not.Children) != 2 {
+		t.Fatalf("expected a NOT query with two operands, got %v", repr)
+	}
+	if _, ok := not.Children[0].(cqr.BooleanQuery); !ok {
+		t.Errorf("expected the first operand of NOT to be the group, got %v", not.Children[0])
+	}
+	if kw, ok := not.Children[1].(cqr.Keyword); !ok || kw.QueryString != "animal" {
+		t.Errorf("expected the second operand of NOT to be animal, got %v", not.Children[1])
+	}
+}
+
+func TestEmbaseLineNumber(t *testing.T) {
+	tests := []struct {
+		line   string
+		n      int
+		number int
+		rest   string
+	}{
+		{"#3 heart", 1, 3, "heart"},
+		{"3. heart", 1, 3, "heart"},
+		{"3: heart", 1, 3, "heart"},
+		{"1 heart", 1, 1, "heart"},
+		{"2019 diabetes", 1, 1, "2019 diabetes"},
+		{"heart", 2, 2, "heart"},
+	}
+	for _, test := range tests {
+		number, rest := embaseLineNumber(test.line, test.n)
+		if number != test.number || rest != test.rest {
+			t.Errorf("%q: got (%d, %q), want (%d, %q)", test.line, number, rest, test.number, test.rest)
+		}
+	}
+}
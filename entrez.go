@@ -0,0 +1,414 @@
+package searchrefiner
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/hscells/cqr"
+	"github.com/hscells/groove/pipeline"
+	"github.com/hscells/groove/stats"
+	"github.com/hscells/guru"
+	"github.com/hscells/transmute"
+	"github.com/hscells/trecresults"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// entrezURL is the base URL of the NCBI E-utilities.
+const entrezURL = "https://eutils.ncbi.nlm.nih.gov/entrez/eutils/"
+
+// EntrezBackend searches PubMed using the NCBI E-utilities. It makes its requests with its own HTTP client, so
+// that they can be sent to another server (such as fakeentrez) without changing how the rest of the process, or
+// the plugins loaded into it, make HTTP requests.
+type EntrezBackend struct {
+	client  *http.Client
+	base    *url.URL
+	limit   *limiter
+	backoff time.Duration
+	tool    string
+	email   string
+	key     string
+	options stats.SearchOptions
+	n       float64
+}
+
+// NewEntrezBackend creates a backend for the E-utilities at the URL of the configuration, or at the NCBI
+// E-utilities when no URL is configured. The size of the collection is requested straight away, so that a server
+// that cannot be reached is reported when searchrefiner starts.
+func NewEntrezBackend(c EntrezConfig, options stats.SearchOptions) (EntrezBackend, error) {
+	base := entrezURL
+	if len(c.URL) > 0 {
+		base = c.URL
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return EntrezBackend{}, err
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return EntrezBackend{}, fmt.Errorf("invalid Entrez URL %s", base)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	e := EntrezBackend{
+		client:  &http.Client{Timeout: 5 * time.Minute},
+		base:    u,
+		limit:   &limiter{interval: time.Second / 9},
+		backoff: time.Second,
+		tool:    "searchrefiner",
+		email:   c.Email,
+		key:     c.APIKey,
+		options: options,
+	}
+	info, err := e.info()
+	if err != nil {
+		return EntrezBackend{}, err
+	}
+	e.n = float64(info.Count)
+	return e, nil
+}
+
+// limiter spaces out requests so that they stay within the rate limits of the E-utilities.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *limiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	d := l.next.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	l.next = now.Add(d + l.interval)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// entrezRetries is how many times a request that NCBI refused because of load is retried. Each retry waits one
+// backoff longer than the last.
+const entrezRetries = 5
+
+// request makes a request to one of the E-utilities. Parameters are sent in the body of a POST, as queries and
+// lists of PMIDs may be too long for a URL.
+func (e EntrezBackend) request(utility string, v url.Values) ([]byte, error) {
+	v.Set("tool", e.tool)
+	if len(e.email) > 0 {
+		v.Set("email", e.email)
+	}
+	if len(e.key) > 0 {
+		v.Set("api_key", e.key)
+	}
+	u := e.base.ResolveReference(&url.URL{Path: utility})
+	for attempt := 0; ; attempt++ {
+		e.limit.wait()
+		resp, err := e.client.PostForm(u.String(), v)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return b, nil
+		case (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500) && attempt < entrezRetries:
+			time.Sleep(time.Duration(attempt+1) * e.backoff)
+		default:
+			return nil, fmt.Errorf("%s: %s: %s", utility, resp.Status, bytes.TrimSpace(b))
+		}
+	}
+}
+
+type entrezInfo struct {
+	Count     int
+	FieldList []struct {
+		Name      string
+		TermCount int
+	} `xml:"FieldList>Field"`
+}
+
+func (e EntrezBackend) info() (entrezInfo, error) {
+	b, err := e.request("einfo.fcgi", url.Values{"db": {"pubmed"}})
+	if err != nil {
+		return entrezInfo{}, err
+	}
+	var r struct {
+		DbInfo entrezInfo
+	}
+	err = xml.Unmarshal(b, &r)
+	return r.DbInfo, err
+}
+
+type entrezSearch struct {
+	Count    int
+	RetStart int
+	IDs      []int
+	WebEnv   string
+	QueryKey string
+}
+
+// search issues a term to esearch. Any parameters in v, such as retstart and retmax, are added to the request.
+func (e EntrezBackend) search(term string, v url.Values) (entrezSearch, error) {
+	v.Set("db", "pubmed")
+	v.Set("term", term)
+	v.Set("retmode", "json")
+	b, err := e.request("esearch.fcgi", v)
+	if err != nil {
+		return entrezSearch{}, err
+	}
+	var r struct {
+		Result struct {
+			Count    string   `json:"count"`
+			RetStart string   `json:"retstart"`
+			IDList   []string `json:"idlist"`
+			WebEnv   string   `json:"webenv"`
+			QueryKey string   `json:"querykey"`
+			ERROR    string   `json:"ERROR"`
+		} `json:"esearchresult"`
+	}
+	err = json.Unmarshal(b, &r)
+	if err != nil {
+		return entrezSearch{}, err
+	}
+	if len(r.Result.ERROR) > 0 {
+		return entrezSearch{}, fmt.Errorf("esearch: %s", r.Result.ERROR)
+	}
+	s := entrezSearch{WebEnv: r.Result.WebEnv, QueryKey: r.Result.QueryKey, IDs: make([]int, len(r.Result.IDList))}
+	s.Count, err = strconv.Atoi(r.Result.Count)
+	if err != nil {
+		return entrezSearch{}, err
+	}
+	if len(r.Result.RetStart) > 0 {
+		s.RetStart, err = strconv.Atoi(r.Result.RetStart)
+		if err != nil {
+			return entrezSearch{}, err
+		}
+	}
+	for i, id := range r.Result.IDList {
+		s.IDs[i], err = strconv.Atoi(id)
+		if err != nil {
+			return entrezSearch{}, err
+		}
+	}
+	return s, nil
+}
+
+// count is the number of citations a term retrieves.
+func (e EntrezBackend) count(term string, v url.Values) (float64, error) {
+	v.Set("rettype", "count")
+	s, err := e.search(term, v)
+	return float64(s.Count), err
+}
+
+// Search compiles the query to PubMed syntax and issues it to Entrez.
+func (e EntrezBackend) Search(query cqr.CommonQueryRepresentation, start, size int) ([]int, error) {
+	q, err := transmute.CompileCqr2PubMed(query)
+	if err != nil {
+		return nil, err
+	}
+	s, err := e.search(q, url.Values{"retstart": {strconv.Itoa(start)}, "retmax": {strconv.Itoa(size)}})
+	return s.IDs, err
+}
+
+// Fetch retrieves the MEDLINE records of the PMIDs.
+func (e EntrezBackend) Fetch(pmids []int) ([]guru.MedlineDocument, error) {
+	if len(pmids) == 0 {
+		return []guru.MedlineDocument{}, nil
+	}
+	ids := make([]string, len(pmids))
+	for i, pmid := range pmids {
+		ids[i] = strconv.Itoa(pmid)
+	}
+	return e.fetch(url.Values{"id": {strings.Join(ids, ",")}})
+}
+
+// fetch retrieves MEDLINE records with efetch, either by their PMIDs or from the history server.
+func (e EntrezBackend) fetch(v url.Values) ([]guru.MedlineDocument, error) {
+	v.Set("db", "pubmed")
+	v.Set("rettype", "medline")
+	v.Set("retmode", "text")
+	b, err := e.request("efetch.fcgi", v)
+	if err != nil {
+		return nil, err
+	}
+	return guru.UnmarshalMedline(bytes.NewReader(b)), nil
+}
+
+// Pages stores the results of the query on the Entrez history server, and then fetches the citations from there,
+// size at a time. Unlike paging through the query with Search, this is not stopped by the limit on how far
+// esearch pages through a query (the first 10,000 PMIDs in PubMed).
+func (e EntrezBackend) Pages(query cqr.CommonQueryRepresentation, size int, fn func(docs []guru.MedlineDocument) error) error {
+	q, err := transmute.CompileCqr2PubMed(query)
+	if err != nil {
+		return err
+	}
+	s, err := e.search(q, url.Values{"usehistory": {"y"}, "retmax": {"0"}})
+	if err != nil {
+		return err
+	}
+	if len(s.WebEnv) == 0 {
+		return fmt.Errorf("esearch did not store the query on the history server")
+	}
+	for start := 0; start < s.Count; start += size {
+		docs, err := e.fetch(url.Values{
+			"WebEnv":    {s.WebEnv},
+			"query_key": {s.QueryKey},
+			"retstart":  {strconv.Itoa(start)},
+			"retmax":    {strconv.Itoa(size)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return fmt.Errorf("Entrez stopped returning citations after %d of %d", start, s.Count)
+		}
+		err = fn(docs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e EntrezBackend) SearchOptions() stats.SearchOptions {
+	return e.options
+}
+
+func (e EntrezBackend) Parameters() map[string]float64 {
+	return map[string]float64{}
+}
+
+// TermFrequency counts the occurrences of a term in the title and abstract of a document.
+func (e EntrezBackend) TermFrequency(term, field, document string) (float64, error) {
+	tf, err := e.termFrequencies(document)
+	if err != nil {
+		return 0, err
+	}
+	return tf[strings.ToLower(term)], nil
+}
+
+// termFrequencies counts the words in the title and abstract of a document.
+func (e EntrezBackend) termFrequencies(document string) (map[string]float64, error) {
+	pmid, err := strconv.Atoi(document)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := e.Fetch([]int{pmid})
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	tf := make(map[string]float64)
+	for _, t := range strings.FieldsFunc(strings.ToLower(docs[0].TI+" "+docs[0].AB), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		tf[t]++
+	}
+	return tf, nil
+}
+
+// TermVector returns the terms in the title and abstract of a document. The document frequency of each term is
+// requested from Entrez, so this makes a request for every distinct term.
+func (e EntrezBackend) TermVector(document string) (stats.TermVector, error) {
+	tf, err := e.termFrequencies(document)
+	if err != nil {
+		return nil, err
+	}
+	var v stats.TermVector
+	for t, n := range tf {
+		df, err := e.DocumentFrequency(t, "tiab")
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, stats.TermVectorTerm{
+			DocumentFrequency:  df,
+			TotalTermFrequency: df,
+			TermFrequency:      n,
+			Field:              "tiab",
+			Term:               t,
+		})
+	}
+	return v, nil
+}
+
+// DocumentFrequency is the number of citations a term appears in for a field.
+func (e EntrezBackend) DocumentFrequency(term, field string) (float64, error) {
+	v := url.Values{}
+	if len(field) > 0 {
+		v.Set("field", field)
+	}
+	return e.count(term, v)
+}
+
+// TotalTermFrequency is approximated by the document frequency, as Entrez does not report term frequencies.
+func (e EntrezBackend) TotalTermFrequency(term, field string) (float64, error) {
+	return e.DocumentFrequency(term, field)
+}
+
+func (e EntrezBackend) InverseDocumentFrequency(term, field string) (float64, error) {
+	nt, err := e.DocumentFrequency(term, field)
+	if err != nil {
+		return 0, err
+	}
+	return math.Log((e.n + 1) / (nt + 1)), nil
+}
+
+func (e EntrezBackend) RetrievalSize(query cqr.CommonQueryRepresentation) (float64, error) {
+	q, err := transmute.CompileCqr2PubMed(query)
+	if err != nil {
+		return 0, err
+	}
+	return e.count(q, url.Values{})
+}
+
+// VocabularySize is the number of distinct terms Entrez has indexed for a field.
+func (e EntrezBackend) VocabularySize(field string) (float64, error) {
+	info, err := e.info()
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range info.FieldList {
+		if strings.EqualFold(f.Name, field) {
+			return float64(f.TermCount), nil
+		}
+	}
+	return 0, nil
+}
+
+func (e EntrezBackend) Execute(query pipeline.Query, options stats.SearchOptions) (trecresults.ResultList, error) {
+	size := options.Size
+	if size <= 0 {
+		size = e.options.Size
+	}
+	pmids, err := e.Search(query.Query, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	r := make(trecresults.ResultList, len(pmids))
+	for i, pmid := range pmids {
+		r[i] = &trecresults.Result{
+			Topic:   query.Topic,
+			DocId:   strconv.Itoa(pmid),
+			Rank:    int64(i + 1),
+			Score:   float64(len(pmids) - i),
+			RunName: options.RunName,
+		}
+	}
+	return r, nil
+}
+
+func (e EntrezBackend) CollectionSize() (float64, error) {
+	return e.n, nil
+}
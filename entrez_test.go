@@ -0,0 +1,255 @@
+package searchrefiner
+
+import (
+	"bytes"
+	"github.com/hscells/groove/pipeline"
+	"github.com/hscells/groove/stats"
+	"github.com/hscells/guru"
+	"github.com/hscells/transmute"
+	"github.com/ielab/searchrefiner/fakeentrez"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testEntrez starts a fakeentrez server behind wrap, and creates a backend for it that retries without waiting.
+func testEntrez(t *testing.T, wrap func(http.Handler) http.Handler) EntrezBackend {
+	t.Helper()
+	fake, err := fakeentrez.New(bytes.NewReader(fakeentrez.Fixtures))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fake.Close() })
+	var h http.Handler = fake
+	if wrap != nil {
+		h = wrap(fake)
+	}
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+
+	e, err := NewEntrezBackend(EntrezConfig{URL: server.URL}, stats.SearchOptions{Size: 100, RunName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.backoff = time.Millisecond
+	return e
+}
+
+// failing fails the first n requests to esearch with status, and then passes requests on to the fake server.
+func failing(n int32, status int, attempts *int32) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "esearch.fcgi") && atomic.AddInt32(attempts, 1) <= n {
+				http.Error(w, "busy", status)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestEntrezBackend(t *testing.T) {
+	fake, err := fakeentrez.New(bytes.NewReader(fakeentrez.Fixtures))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	transport := http.DefaultTransport
+	e, err := NewEntrezBackend(EntrezConfig{Email: "test@example.com", URL: server.URL}, stats.SearchOptions{Size: 100, RunName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if http.DefaultTransport != transport {
+		t.Error("the Entrez backend changed the default transport")
+	}
+	if n, _ := e.CollectionSize(); int(n) != fake.Len() {
+		t.Errorf("expected a collection of %d citations, got %v", fake.Len(), n)
+	}
+
+	q, err := transmute.CompilePubmed2Cqr(`(statin*[tiab] OR aspirin[tiab] OR beta blockers[tiab]) AND myocardial infarction[tiab]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := e.RetrievalSize(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 citations to be retrieved, got %v", n)
+	}
+	pmids, err := e.Search(q, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pmids) != 2 {
+		t.Fatalf("expected 2 citations after the first, got %v", pmids)
+	}
+	docs, err := e.Fetch(pmids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 || len(docs[0].TI) == 0 {
+		t.Errorf("expected the records of %v, got %d", pmids, len(docs))
+	}
+}
+
+// TestEntrezBackendPages checks that every citation of a query is paged through with the history server, past
+// the limit on how far esearch pages through a query.
+func TestEntrezBackendPages(t *testing.T) {
+	fake, err := fakeentrez.New(bytes.NewReader(fakeentrez.Fixtures))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	fake.SearchLimit = 2
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	e, err := NewEntrezBackend(EntrezConfig{URL: server.URL}, stats.SearchOptions{Size: 100, RunName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := transmute.CompilePubmed2Cqr(`(statin*[tiab] OR aspirin[tiab] OR beta blockers[tiab]) AND myocardial infarction[tiab]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Search(q, 2, 1); err == nil {
+		t.Error("expected esearch to refuse to page past its limit")
+	}
+
+	seen := make(map[string]bool)
+	pages := 0
+	err = Pages(e, q, 1, func(docs []guru.MedlineDocument) error {
+		pages++
+		for _, doc := range docs {
+			seen[doc.PMID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 3 || pages != 3 {
+		t.Errorf("expected 3 citations in 3 pages, got %d in %d", len(seen), pages)
+	}
+}
+
+func TestEntrezBackendRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     int32
+		status   int
+		attempts int32
+		err      bool
+	}{
+		{"ok", 0, 0, 1, false},
+		{"too many requests", 2, http.StatusTooManyRequests, 3, false},
+		{"unavailable", entrezRetries, http.StatusServiceUnavailable, entrezRetries + 1, false},
+		{"retries exhausted", entrezRetries + 1, http.StatusServiceUnavailable, entrezRetries + 1, true},
+		{"bad request", 1, http.StatusBadRequest, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			e := testEntrez(t, failing(tt.fail, tt.status, &attempts))
+			n, err := e.count("aspirin[tiab]", url.Values{})
+			if tt.err != (err != nil) {
+				t.Fatalf("expected an error: %v, got %v", tt.err, err)
+			}
+			if !tt.err && n != 1 {
+				t.Errorf("expected 1 citation, got %v", n)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("expected %d attempts, got %d", tt.attempts, attempts)
+			}
+		})
+	}
+}
+
+func TestEntrezBackendCount(t *testing.T) {
+	e := testEntrez(t, nil)
+	tests := []struct {
+		term, field string
+		n           float64
+	}{
+		{"aspirin[tiab]", "", 1},
+		{"aspirin", "tiab", 1},
+		{"myocardial infarction[tiab]", "", 3},
+		{"statin*[tiab] AND diabetes[tiab]", "", 1},
+		{"nothing[tiab]", "", 0},
+	}
+	for _, tt := range tests {
+		n, err := e.DocumentFrequency(tt.term, tt.field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.n {
+			t.Errorf("%s in %q: expected %v citations, got %v", tt.term, tt.field, tt.n, n)
+		}
+	}
+}
+
+func TestEntrezBackendFetch(t *testing.T) {
+	e := testEntrez(t, nil)
+	docs, err := e.Fetch(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 0 {
+		t.Errorf("expected no records, got %d", len(docs))
+	}
+
+	docs, err = e.Fetch([]int{90000003, 90000001, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("expected the records of the two known PMIDs, got %d", len(docs))
+	}
+	titles := map[string]string{}
+	for _, doc := range docs {
+		titles[doc.PMID] = doc.TI
+	}
+	if !strings.HasPrefix(titles["90000003"], "Aspirin compared with placebo") {
+		t.Errorf("unexpected title for 90000003: %q", titles["90000003"])
+	}
+	if !strings.HasPrefix(titles["90000001"], "Early statin therapy") {
+		t.Errorf("unexpected title for 90000001: %q", titles["90000001"])
+	}
+}
+
+func TestEntrezBackendExecute(t *testing.T) {
+	e := testEntrez(t, nil)
+	q, err := transmute.CompilePubmed2Cqr(`(statin*[tiab] OR aspirin[tiab] OR beta blockers[tiab]) AND myocardial infarction[tiab]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 2} {
+		r, err := e.Execute(pipeline.NewQuery("q", "1", q), stats.SearchOptions{Size: size, RunName: "run"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := 3
+		if size > 0 {
+			expected = size
+		}
+		if len(r) != expected {
+			t.Fatalf("size %d: expected %d results, got %d", size, expected, len(r))
+		}
+		for i, res := range r {
+			if res.Topic != "1" || res.RunName != "run" || res.Rank != int64(i+1) {
+				t.Errorf("size %d: unexpected result %+v", size, res)
+			}
+			if i > 0 && res.Score >= r[i-1].Score {
+				t.Errorf("size %d: expected scores to decrease with rank, got %v after %v", size, res.Score, r[i-1].Score)
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package searchrefiner
+
+import (
+	"github.com/hscells/cqr"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Changes that are made to seed studies.
+const (
+	SeedsSet      = "set"
+	SeedsImported = "import"
+	SeedsCreated  = "create"
+	SeedsRenamed  = "rename"
+	SeedsDeleted  = "delete"
+	SeedsActive   = "activate"
+)
+
+// QueryParsed is published when the query of a user has been parsed into the common query representation.
+type QueryParsed struct {
+	Workspace Workspace
+	Query     string
+	Language  string
+	CQR       cqr.CommonQueryRepresentation
+	// Source is what parsed the query, e.g., "query" for the query page or the name of a plugin.
+	Source string
+}
+
+// QueryExecuted is published when a query has been run. The query has the number of citations it retrieved
+// (NumRet), the seed studies it was evaluated against (Relevant), and how many of them it retrieved (NumRelRet).
+// Recorded is whether it was added to the history of the workspace, in which case it has an ID and version.
+type QueryExecuted struct {
+	Workspace Workspace
+	Query     Query
+	CQR       cqr.CommonQueryRepresentation
+	Recorded  bool
+	Source    string
+}
+
+// SeedsChanged is published when the seed studies of a workspace have changed. Collection is the collection after
+// the change, and only has an ID when it was deleted.
+type SeedsChanged struct {
+	Workspace  Workspace
+	Change     string
+	Collection SeedCollection
+}
+
+// UserLoggedIn is published when a user logs in, including when they create an account.
+type UserLoggedIn struct {
+	Username string
+	Time     time.Time
+}
+
+// EventBus publishes events about the queries, seed studies, and users of searchrefiner, so that plugins can act
+// on them without patching the handlers that cause them. Plugins subscribe in Startup. Subscribers are called in
+// the order they subscribed, by the request that published the event, so subscribers that do slow work should do
+// it in their own goroutine. A nil EventBus has no subscribers, and subscribing to it does nothing.
+//
+// Remote plugins receive the events they list in the Events of their details, which are posted to them over their
+// socket, in the order they were published, by a goroutine of their own.
+type EventBus struct {
+	mu            sync.RWMutex
+	queryParsed   []func(QueryParsed)
+	queryExecuted []func(QueryExecuted)
+	seedsChanged  []func(SeedsChanged)
+	userLoggedIn  []func(UserLoggedIn)
+}
+
+// NewEventBus creates an event bus without any subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// deliver calls a subscriber, so that a subscriber that panics does not fail the request that published the event.
+func deliver(event string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("[events] subscriber to %s panicked: %v", event, r)
+		}
+	}()
+	fn()
+}
+
+// OnQueryParsed subscribes to QueryParsed events.
+func (b *EventBus) OnQueryParsed(fn func(QueryParsed)) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queryParsed = append(b.queryParsed, fn)
+}
+
+// OnQueryExecuted subscribes to QueryExecuted events.
+func (b *EventBus) OnQueryExecuted(fn func(QueryExecuted)) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queryExecuted = append(b.queryExecuted, fn)
+}
+
+// OnSeedsChanged subscribes to SeedsChanged events.
+func (b *EventBus) OnSeedsChanged(fn func(SeedsChanged)) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seedsChanged = append(b.seedsChanged, fn)
+}
+
+// OnUserLoggedIn subscribes to UserLoggedIn events.
+func (b *EventBus) OnUserLoggedIn(fn func(UserLoggedIn)) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.userLoggedIn = append(b.userLoggedIn, fn)
+}
+
+func (b *EventBus) PublishQueryParsed(e QueryParsed) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	subscribers := b.queryParsed
+	b.mu.RUnlock()
+	for _, fn := range subscribers {
+		deliver("QueryParsed", func() { fn(e) })
+	}
+}
+
+func (b *EventBus) PublishQueryExecuted(e QueryExecuted) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	subscribers := b.queryExecuted
+	b.mu.RUnlock()
+	for _, fn := range subscribers {
+		deliver("QueryExecuted", func() { fn(e) })
+	}
+}
+
+func (b *EventBus) PublishSeedsChanged(e SeedsChanged) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	subscribers := b.seedsChanged
+	b.mu.RUnlock()
+	for _, fn := range subscribers {
+		deliver("SeedsChanged", func() { fn(e) })
+	}
+}
+
+func (b *EventBus) PublishUserLoggedIn(e UserLoggedIn) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	subscribers := b.userLoggedIn
+	b.mu.RUnlock()
+	for _, fn := range subscribers {
+		deliver("UserLoggedIn", func() { fn(e) })
+	}
+}
+
+// RecordQuery publishes that a query was run in a workspace, and first adds it to the history of the workspace
+// when the user may edit it. The query that was added to the history is returned, which is empty when it was not.
+// The database the query was run on is recorded with it when it has not been set already. The results of each of
+// its lines are only recorded when they are set, as counting them runs every line of the query again.
+func (s Server) RecordQuery(ws Workspace, q Query, repr cqr.CommonQueryRepresentation, source string) (Query, error) {
+	if !ws.Can(RoleEditor) {
+		s.Events.PublishQueryExecuted(QueryExecuted{Workspace: ws, Query: q, CQR: repr, Source: source})
+		return Query{}, nil
+	}
+	if len(q.Database) == 0 {
+		q.Database, q.Platform = s.database(), s.platform()
+	}
+	q, err := s.History.Add(ws.Key, q)
+	if err != nil {
+		return q, err
+	}
+	s.Events.PublishQueryExecuted(QueryExecuted{Workspace: ws, Query: q, CQR: repr, Recorded: true, Source: source})
+	return q, nil
+}
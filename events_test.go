@@ -0,0 +1,36 @@
+package searchrefiner
+
+import (
+	"github.com/hscells/cqr"
+	"testing"
+)
+
+func TestNilEventBus(t *testing.T) {
+	var b *EventBus
+	b.OnQueryParsed(func(QueryParsed) { t.Error("subscriber of a nil bus called") })
+	b.OnQueryExecuted(func(QueryExecuted) { t.Error("subscriber of a nil bus called") })
+	b.OnSeedsChanged(func(SeedsChanged) { t.Error("subscriber of a nil bus called") })
+	b.OnUserLoggedIn(func(UserLoggedIn) { t.Error("subscriber of a nil bus called") })
+	b.PublishQueryParsed(QueryParsed{})
+	b.PublishQueryExecuted(QueryExecuted{})
+	b.PublishSeedsChanged(SeedsChanged{})
+	b.PublishUserLoggedIn(UserLoggedIn{})
+}
+
+// TestRecordQueryDoesNotSearchLines checks that recording a query does not run it again to count the results of
+// its lines.
+func TestRecordQueryDoesNotSearchLines(t *testing.T) {
+	h, _ := testHistory(t)
+	s := Server{History: h, Backend: stubBackend{search: func(q cqr.CommonQueryRepresentation) ([]int, error) {
+		t.Errorf("expected %s not to be searched", q)
+		return nil, nil
+	}}}
+	ws := Workspace{Key: "user", Username: "user", Role: RoleOwner}
+	q, err := s.RecordQuery(ws, Query{QueryString: "heart", Language: "pubmed"}, cqr.NewKeyword("heart"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Lines != nil || q.Database != "PubMed" {
+		t.Errorf("expected the database but no lines to be recorded, got %+v", q)
+	}
+}
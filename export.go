@@ -0,0 +1,300 @@
+package searchrefiner
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/cqr"
+	"github.com/hscells/guru"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// exportPageSize is the number of citations fetched from the search backend at a time while exporting.
+const exportPageSize = 500
+
+const (
+	ExportRIS    = "ris"
+	ExportNBIB   = "nbib"
+	ExportBibTeX = "bibtex"
+	ExportCSV    = "csv"
+)
+
+// exporter writes citations in a citation manager format. Documents are written one at a time so that
+// exports can be streamed to the client without holding the entire result set in memory.
+type exporter interface {
+	ContentType() string
+	Extension() string
+	Begin(w io.Writer) error
+	Write(w io.Writer, doc guru.MedlineDocument) error
+	End(w io.Writer) error
+}
+
+// flusher is implemented by exporters that buffer their output, so that each page can be sent to the client.
+type flusher interface {
+	Flush()
+}
+
+func newExporter(format string) (exporter, bool) {
+	switch format {
+	case ExportRIS:
+		return risExporter{}, true
+	case ExportNBIB:
+		return nbibExporter{}, true
+	case ExportBibTeX:
+		return bibtexExporter{}, true
+	case ExportCSV:
+		return &csvExporter{}, true
+	}
+	return nil, false
+}
+
+// formatDCOM formats a MEDLINE date (YYYYMMDD) with the given separator, falling back to the raw value.
+func formatDCOM(dcom, sep string) string {
+	if len(dcom) != 8 {
+		return dcom
+	}
+	return strings.Join([]string{dcom[:4], dcom[4:6], dcom[6:]}, sep)
+}
+
+func pubmedURL(pmid string) string {
+	return fmt.Sprintf("https://pubmed.ncbi.nlm.nih.gov/%s/", pmid)
+}
+
+type risExporter struct{}
+
+func (risExporter) ContentType() string { return "application/x-research-info-systems" }
+func (risExporter) Extension() string   { return "ris" }
+func (risExporter) Begin(io.Writer) error {
+	return nil
+}
+func (risExporter) End(io.Writer) error {
+	return nil
+}
+
+func (risExporter) Write(w io.Writer, doc guru.MedlineDocument) error {
+	var b strings.Builder
+	// Each tag is a single line, so a line break in a value cannot start a tag (or end the record).
+	tag := func(t, v string) {
+		if v = strings.Join(strings.Fields(v), " "); len(v) > 0 {
+			b.WriteString(fmt.Sprintf("%-2s  - %s\n", t, v))
+		}
+	}
+	tag("TY", "JOUR")
+	tag("TI", doc.TI)
+	for _, au := range doc.AU {
+		tag("AU", au)
+	}
+	tag("AB", doc.AB)
+	if len(doc.DCOM) >= 4 {
+		tag("PY", doc.DCOM[:4])
+	}
+	tag("DA", formatDCOM(doc.DCOM, "/"))
+	for _, mh := range doc.MH {
+		tag("KW", mh)
+	}
+	for _, pt := range doc.PT {
+		tag("M3", pt)
+	}
+	tag("AN", doc.PMID)
+	tag("DB", "PubMed")
+	tag("UR", pubmedURL(doc.PMID))
+	b.WriteString("ER  - \n\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type nbibExporter struct{}
+
+func (nbibExporter) ContentType() string { return "application/nbib" }
+func (nbibExporter) Extension() string   { return "nbib" }
+func (nbibExporter) Begin(io.Writer) error {
+	return nil
+}
+func (nbibExporter) End(io.Writer) error {
+	return nil
+}
+
+// nbibLineWidth is the width MEDLINE formatted records are wrapped to.
+const nbibLineWidth = 88
+
+func (nbibExporter) Write(w io.Writer, doc guru.MedlineDocument) error {
+	var b strings.Builder
+	tag := func(t, v string) {
+		if len(v) == 0 {
+			return
+		}
+		line := fmt.Sprintf("%-4s- ", t)
+		width := len(line)
+		for _, word := range strings.Fields(v) {
+			if width+len(word) > nbibLineWidth && width > 6 {
+				b.WriteString(strings.TrimRight(line, " ") + "\n")
+				line = "      "
+				width = len(line)
+			}
+			line += word + " "
+			width += len(word) + 1
+		}
+		b.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+	tag("PMID", doc.PMID)
+	tag("DCOM", doc.DCOM)
+	tag("TI", doc.TI)
+	tag("AB", doc.AB)
+	for _, au := range doc.AU {
+		tag("AU", au)
+	}
+	for _, pt := range doc.PT {
+		tag("PT", pt)
+	}
+	for _, mh := range doc.MH {
+		tag("MH", mh)
+	}
+	tag("SO", "PubMed")
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type bibtexExporter struct{}
+
+func (bibtexExporter) ContentType() string { return "application/x-bibtex" }
+func (bibtexExporter) Extension() string   { return "bib" }
+func (bibtexExporter) Begin(io.Writer) error {
+	return nil
+}
+func (bibtexExporter) End(io.Writer) error {
+	return nil
+}
+
+var bibtexEscaper = strings.NewReplacer(`\`, `\textbackslash{}`, "{", `\{`, "}", `\}`, "&", `\&`, "%", `\%`, "$", `\$`, "#", `\#`, "_", `\_`)
+
+func (bibtexExporter) Write(w io.Writer, doc guru.MedlineDocument) error {
+	var b strings.Builder
+	field := func(f, v string) {
+		if len(v) > 0 {
+			b.WriteString(fmt.Sprintf("  %s = {%s},\n", f, bibtexEscaper.Replace(v)))
+		}
+	}
+	b.WriteString(fmt.Sprintf("@article{pmid%s,\n", doc.PMID))
+	field("title", doc.TI)
+	field("author", strings.Join(doc.AU, " and "))
+	field("abstract", doc.AB)
+	if len(doc.DCOM) >= 4 {
+		field("year", doc.DCOM[:4])
+	}
+	field("keywords", strings.Join(doc.MH, "; "))
+	field("pmid", doc.PMID)
+	field("url", pubmedURL(doc.PMID))
+	b.WriteString("}\n\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (*csvExporter) ContentType() string { return "text/csv" }
+func (*csvExporter) Extension() string   { return "csv" }
+
+func (e *csvExporter) Begin(w io.Writer) error {
+	e.w = csv.NewWriter(w)
+	return e.w.Write([]string{"pmid", "title", "abstract", "authors", "date_completed", "mesh_headings", "publication_types"})
+}
+
+func (e *csvExporter) Write(_ io.Writer, doc guru.MedlineDocument) error {
+	return e.w.Write([]string{doc.PMID, doc.TI, doc.AB, strings.Join(doc.AU, "; "), formatDCOM(doc.DCOM, "-"), strings.Join(doc.MH, "; "), strings.Join(doc.PT, "; ")})
+}
+
+func (e *csvExporter) Flush() {
+	e.w.Flush()
+}
+
+func (e *csvExporter) End(io.Writer) error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// ApiExport streams the entire result set of a query in RIS, NBIB, BibTeX, or CSV format.
+// Results are fetched from the search backend a page at a time and written to the client as they arrive.
+func (s Server) ApiExport(c *gin.Context) {
+	rawQuery := c.PostForm("query")
+	format := c.PostForm("format")
+
+	if len(rawQuery) == 0 {
+		c.String(http.StatusBadRequest, "no query supplied")
+		return
+	}
+
+	e, ok := newExporter(format)
+	if !ok {
+		c.String(http.StatusBadRequest, fmt.Sprintf("unknown export format %s", format))
+		return
+	}
+
+	compiler, lang, err := RequestParser(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cq, err := compiler.Execute(rawQuery)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	repr, err := cq.Representation()
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	q := repr.(cqr.CommonQueryRepresentation)
+
+	username := s.Perm.UserState().Username(c.Request)
+	log.Infof("[export] %s:%s:%s:%s", username, format, lang, rawQuery)
+
+	c.Header("Content-Type", e.ContentType())
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="searchrefiner.%s"`, e.Extension()))
+	c.Status(http.StatusOK)
+
+	// Once the first bytes have been written, errors can no longer be reported with a status code,
+	// so they are logged and the response is cut short.
+	w := c.Writer
+	err = e.Begin(w)
+	if err != nil {
+		log.Errorf("[export] %v", err)
+		return
+	}
+	n := 0
+	err = Pages(s.Backend, q, exportPageSize, func(docs []guru.MedlineDocument) error {
+		for _, doc := range docs {
+			if len(doc.PMID) == 0 {
+				continue
+			}
+			err := e.Write(w, doc)
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		if f, ok := e.(flusher); ok {
+			f.Flush()
+		}
+		w.Flush()
+		return c.Request.Context().Err()
+	})
+	if err != nil {
+		log.Errorf("[export] %v", err)
+		return
+	}
+	err = e.End(w)
+	if err != nil {
+		log.Errorf("[export] %v", err)
+		return
+	}
+	log.Infof("[export] %s:%s:%d citations", username, format, n)
+}
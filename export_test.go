@@ -0,0 +1,86 @@
+package searchrefiner
+
+import (
+	"bytes"
+	"github.com/hscells/guru"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// exportDocuments are two citations: one with commas, quotes, newlines, and characters that BibTeX escapes in
+// its fields, and one with only a PMID and an incomplete date.
+var exportDocuments = []guru.MedlineDocument{
+	{
+		PMID: "90000001",
+		DCOM: "20190315",
+		TI:   `Aspirin, "statins", and 100% of {heart} attacks_: a trial`,
+		AB:   "BACKGROUND: Aspirin reduces the risk of \"heart attack\", stroke & death.\nER  - \nRESULTS: It works in\nmost patients, at $1 a day #cheap.",
+		AU:   []string{"Smith, John", "O'Brien, A \"Al\""},
+		MH:   []string{"Aspirin/therapeutic use", "Myocardial Infarction/*prevention & control"},
+		PT:   []string{"Journal Article", "Randomized Controlled Trial"},
+	},
+	{
+		PMID: "90000002",
+		DCOM: "2019",
+	},
+}
+
+func TestFormatDCOM(t *testing.T) {
+	tests := []struct {
+		dcom, sep, expected string
+	}{
+		{"20190315", "/", "2019/03/15"},
+		{"20190315", "-", "2019-03-15"},
+		{"2019", "-", "2019"},
+		{"", "-", ""},
+		{"201903150", "-", "201903150"},
+	}
+	for _, tt := range tests {
+		if got := formatDCOM(tt.dcom, tt.sep); got != tt.expected {
+			t.Errorf("%q %q: expected %q, got %q", tt.dcom, tt.sep, tt.expected, got)
+		}
+	}
+}
+
+// TestExporters compares the output of each exporter to the golden files in testdata/export.
+func TestExporters(t *testing.T) {
+	tests := []struct {
+		format, golden string
+	}{
+		{ExportRIS, "citations.ris"},
+		{ExportNBIB, "citations.nbib"},
+		{ExportBibTeX, "citations.bib"},
+		{ExportCSV, "citations.csv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			e, ok := newExporter(tt.format)
+			if !ok {
+				t.Fatalf("expected an exporter for %s", tt.format)
+			}
+			var b bytes.Buffer
+			if err := e.Begin(&b); err != nil {
+				t.Fatal(err)
+			}
+			for _, doc := range exportDocuments {
+				if err := e.Write(&b, doc); err != nil {
+					t.Fatal(err)
+				}
+				if f, ok := e.(flusher); ok {
+					f.Flush()
+				}
+			}
+			if err := e.End(&b); err != nil {
+				t.Fatal(err)
+			}
+			expected, err := ioutil.ReadFile(filepath.Join("testdata", "export", tt.golden))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b.Bytes(), expected) {
+				t.Errorf("expected\n%s\ngot\n%s", expected, b.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+// Package fakeentrez is a stand-in for the NCBI E-utilities that serves a fixed set of MEDLINE formatted records.
+// It implements the parts of einfo, esearch, efetch, and esummary that searchrefiner uses, and evaluates
+// Boolean queries over the records using a local index, so that searchrefiner can be run in tests and demos
+// without access to PubMed.
+//
+// Point searchrefiner at a running server by setting the "URL" field of the "Entrez" configuration.
+package fakeentrez
+
+import (
+	_ "embed"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/hscells/cqr"
+	"github.com/hscells/groove/stats"
+	"github.com/hscells/transmute"
+	"github.com/hscells/transmute/fields"
+	"github.com/ielab/searchrefiner/localindex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fixtures are the records served by default, a small set of made up citations about cardiovascular disease.
+//
+//go:embed fixtures/pubmed.txt
+var Fixtures []byte
+
+var recordSeparator = regexp.MustCompile(`\r?\n[ \t]*\r?\n`)
+
+type record struct {
+	text    string
+	article localindex.Article
+}
+
+// DefaultSearchLimit is how far esearch pages through the results of a query, as with PubMed.
+const DefaultSearchLimit = 10000
+
+// Server is an http.Handler that responds to E-utilities requests.
+type Server struct {
+	// SearchLimit is how far esearch pages through the results of a query. As with PubMed, a retstart past it is an
+	// error, while the results of a query that was stored on the history server (usehistory=y) can be fetched with
+	// efetch past it.
+	SearchLimit int
+
+	index   *localindex.Index
+	dir     string
+	records map[int]record
+
+	mu      sync.Mutex
+	history []cqr.CommonQueryRepresentation
+}
+
+// New creates a server for the MEDLINE formatted records read from r.
+func New(r io.Reader) (*Server, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "fakeentrez")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{SearchLimit: DefaultSearchLimit, dir: dir, records: make(map[int]record)}
+
+	builder, err := localindex.NewBuilder(filepath.Join(dir, "pubmed.idx"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	for _, text := range recordSeparator.Split(strings.TrimSpace(string(b)), -1) {
+		err = localindex.ReadMedline(strings.NewReader(text), func(a localindex.Article) error {
+			pmid, err := strconv.Atoi(a.PMID)
+			if err != nil {
+				return err
+			}
+			s.records[pmid] = record{text: text, article: a}
+			return builder.Add(a)
+		})
+		if err != nil {
+			builder.Close()
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	err = builder.Close()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s.index, err = localindex.Open(filepath.Join(dir, "pubmed.idx"), stats.SearchOptions{})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the index and removes it from disk.
+func (s *Server) Close() error {
+	err := s.index.Close()
+	if rerr := os.RemoveAll(s.dir); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Len is the number of records that are being served.
+func (s *Server) Len() int {
+	return len(s.records)
+}
+
+// params reads the parameters of a request. Long requests are sent as a POST without a content type,
+// so the body must be parsed by hand.
+func params(r *http.Request) (url.Values, error) {
+	v := r.URL.Query()
+	if r.Method == http.MethodPost {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		p, err := url.ParseQuery(string(b))
+		if err != nil {
+			return nil, err
+		}
+		for k, vs := range p {
+			v[k] = append(v[k], vs...)
+		}
+	}
+	return v, nil
+}
+
+// ids reads the identifiers of a request, which may be given as a comma separated list or repeated.
+func ids(v url.Values) ([]int, error) {
+	var pmids []int
+	for _, id := range v["id"] {
+		for _, p := range strings.Split(id, ",") {
+			p = strings.TrimSpace(p)
+			if len(p) == 0 {
+				continue
+			}
+			pmid, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id %s", p)
+			}
+			pmids = append(pmids, pmid)
+		}
+	}
+	return pmids, nil
+}
+
+func intParam(v url.Values, key string, def int) int {
+	if n, err := strconv.Atoi(v.Get(key)); err == nil {
+		return n
+	}
+	return def
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "text/xml; charset=UTF-8")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v, err := params(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if db := v.Get("db"); len(db) > 0 && db != "pubmed" {
+		http.Error(w, fmt.Sprintf("unsupported database %s", db), http.StatusBadRequest)
+		return
+	}
+	switch path.Base(r.URL.Path) {
+	case "einfo.fcgi":
+		s.einfo(w)
+	case "esearch.fcgi":
+		s.esearch(w, v)
+	case "efetch.fcgi":
+		s.efetch(w, v)
+	case "esummary.fcgi":
+		s.esummary(w, v)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type infoField struct {
+	Name          string
+	FullName      string
+	Description   string
+	TermCount     int
+	IsDate        string
+	IsNumerical   string
+	SingleToken   string
+	Hierarchy     string
+	IsHidden      string
+	IsRangable    string
+	IsTruncatable string
+}
+
+func (s *Server) einfo(w http.ResponseWriter) {
+	type dbInfo struct {
+		DbName      string
+		MenuName    string
+		Description string
+		Count       int
+		LastUpdate  string
+		FieldList   []infoField `xml:"FieldList>Field"`
+	}
+	var fl []infoField
+	for _, f := range []struct{ name, full, field string }{
+		{"ALL", "All Fields", fields.AllFields},
+		{"TITL", "Title", fields.Title},
+		{"TIAB", "Title/Abstract", fields.TitleAbstract},
+		{"MESH", "MeSH Terms", fields.MeSHTerms},
+	} {
+		n, _ := s.index.VocabularySize(f.field)
+		fl = append(fl, infoField{
+			Name: f.name, FullName: f.full, Description: f.full, TermCount: int(n),
+			IsDate: "N", IsNumerical: "N", SingleToken: "N", Hierarchy: "N", IsHidden: "N", IsRangable: "N", IsTruncatable: "Y",
+		})
+	}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"eInfoResult"`
+		DbInfo  dbInfo
+	}{DbInfo: dbInfo{
+		DbName:      "pubmed",
+		MenuName:    "PubMed",
+		Description: "PubMed fixtures",
+		Count:       len(s.records),
+		LastUpdate:  "2021/01/01 00:00",
+		FieldList:   fl,
+	}})
+}
+
+type searchResult struct {
+	XMLName          xml.Name `xml:"eSearchResult"`
+	Count            int
+	RetMax           int
+	RetStart         int
+	QueryKey         string `xml:",omitempty"`
+	WebEnv           string `xml:",omitempty"`
+	IdList           []int  `xml:"IdList>Id"`
+	QueryTranslation string `xml:",omitempty"`
+	ERROR            string `xml:",omitempty"`
+}
+
+func (s *Server) esearch(w http.ResponseWriter, v url.Values) {
+	term := v.Get("term")
+	asJSON := v.Get("retmode") == "json"
+
+	var (
+		query cqr.CommonQueryRepresentation
+		err   error
+	)
+	if len(strings.TrimSpace(term)) == 0 {
+		err = fmt.Errorf("empty term")
+	} else {
+		query, err = transmute.CompilePubmed2Cqr(term)
+	}
+	if err != nil {
+		s.writeSearch(w, asJSON, searchResult{ERROR: err.Error()})
+		return
+	}
+
+	n, err := s.index.RetrievalSize(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := searchResult{Count: int(n), QueryTranslation: term}
+	if v.Get("rettype") == "count" {
+		if asJSON {
+			s.writeSearch(w, true, res)
+			return
+		}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"eSearchResult"`
+			Count   int
+		}{Count: res.Count})
+		return
+	}
+
+	if v.Get("usehistory") == "y" {
+		s.mu.Lock()
+		s.history = append(s.history, query)
+		res.WebEnv = fmt.Sprintf("MCID_%d", len(s.history))
+		s.mu.Unlock()
+		res.QueryKey = "1"
+	}
+
+	res.RetStart = intParam(v, "retstart", 0)
+	res.RetMax = intParam(v, "retmax", 20)
+	if res.RetStart >= s.SearchLimit && res.RetMax > 0 {
+		s.writeSearch(w, asJSON, searchResult{ERROR: fmt.Sprintf("retstart cannot be larger than %d", s.SearchLimit-1)})
+		return
+	}
+	if res.RetStart+res.RetMax > s.SearchLimit {
+		res.RetMax = s.SearchLimit - res.RetStart
+	}
+	res.IdList, err = s.index.Search(query, res.RetStart, res.RetMax)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.RetMax = len(res.IdList)
+	s.writeSearch(w, asJSON, res)
+}
+
+func (s *Server) writeSearch(w http.ResponseWriter, asJSON bool, res searchResult) {
+	if !asJSON {
+		writeXML(w, res)
+		return
+	}
+	type result struct {
+		Count            string   `json:"count"`
+		RetMax           string   `json:"retmax"`
+		RetStart         string   `json:"retstart"`
+		IdList           []string `json:"idlist"`
+		QueryKey         string   `json:"querykey,omitempty"`
+		WebEnv           string   `json:"webenv,omitempty"`
+		QueryTranslation string   `json:"querytranslation,omitempty"`
+		ERROR            string   `json:"ERROR,omitempty"`
+	}
+	idList := make([]string, len(res.IdList))
+	for i, id := range res.IdList {
+		idList[i] = strconv.Itoa(id)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(struct {
+		Result result `json:"esearchresult"`
+	}{result{
+		Count:            strconv.Itoa(res.Count),
+		RetMax:           strconv.Itoa(res.RetMax),
+		RetStart:         strconv.Itoa(res.RetStart),
+		IdList:           idList,
+		QueryKey:         res.QueryKey,
+		WebEnv:           res.WebEnv,
+		QueryTranslation: res.QueryTranslation,
+		ERROR:            res.ERROR,
+	}})
+}
+
+func (s *Server) efetch(w http.ResponseWriter, v url.Values) {
+	pmids, err := ids(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if webEnv := v.Get("WebEnv"); len(webEnv) > 0 {
+		pmids, err = s.stored(webEnv, intParam(v, "retstart", 0), intParam(v, "retmax", 20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if t := v.Get("rettype"); len(t) > 0 && t != "medline" {
+		http.Error(w, fmt.Sprintf("unsupported rettype %s", t), http.StatusBadRequest)
+		return
+	}
+	// As with PubMed, each record is preceded by a blank line.
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	for _, pmid := range pmids {
+		if r, ok := s.records[pmid]; ok {
+			io.WriteString(w, "\n"+r.text+"\n")
+		}
+	}
+}
+
+// stored pages through the results of a query on the history server.
+func (s *Server) stored(webEnv string, start, size int) ([]int, error) {
+	var n int
+	if _, err := fmt.Sscanf(webEnv, "MCID_%d", &n); err != nil {
+		return nil, fmt.Errorf("invalid WebEnv %s", webEnv)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n < 1 || n > len(s.history) {
+		return nil, fmt.Errorf("unknown WebEnv %s", webEnv)
+	}
+	return s.index.Search(s.history[n-1], start, size)
+}
+
+func (s *Server) esummary(w http.ResponseWriter, v url.Values) {
+	type item struct {
+		Name  string `xml:"Name,attr"`
+		Type  string `xml:"Type,attr"`
+		Value string `xml:",chardata"`
+		Items []item `xml:"Item"`
+	}
+	type docSum struct {
+		Id    int
+		Items []item `xml:"Item"`
+	}
+	pmids, err := ids(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var docs []docSum
+	for _, pmid := range pmids {
+		r, ok := s.records[pmid]
+		if !ok {
+			continue
+		}
+		a := r.article
+		authors := item{Name: "AuthorList", Type: "List"}
+		for _, au := range a.AU {
+			authors.Items = append(authors.Items, item{Name: "Author", Type: "String", Value: au})
+		}
+		var source string
+		if len(a.Journal) > 0 {
+			source = a.Journal[0]
+		}
+		docs = append(docs, docSum{Id: pmid, Items: []item{
+			{Name: "PubDate", Type: "Date", Value: a.Year},
+			{Name: "Source", Type: "String", Value: source},
+			authors,
+			{Name: "Title", Type: "String", Value: a.TI},
+			{Name: "DOI", Type: "String", Value: a.DOI},
+		}})
+	}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"eSummaryResult"`
+		DocSum  []docSum
+	}{DocSum: docs})
+}
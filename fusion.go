@@ -0,0 +1,202 @@
+package searchrefiner
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Fusion strategies for ranking the suggestions of several sources together.
+const (
+	// FusionMinMax normalises the scores of each source to [0, 1] and takes the highest score of a term.
+	FusionMinMax = "minmax"
+	// FusionZScore standardises the scores of each source and takes the highest score of a term.
+	FusionZScore = "zscore"
+	// FusionRRF scores a term by the sum of its reciprocal ranks in each source.
+	FusionRRF = "rrf"
+	// FusionCombSUM scores a term by the sum of its min-max normalised scores.
+	FusionCombSUM = "combsum"
+	// FusionCombMNZ is CombSUM multiplied by the number of sources that suggested the term.
+	FusionCombMNZ = "combmnz"
+)
+
+// rrfK dampens the contribution of highly ranked suggestions in reciprocal rank fusion.
+const rrfK = 60
+
+// normalisation rescales the scores of the suggestions from a single source.
+type normalisation func(res []suggestion) []float64
+
+// combination combines the normalised scores a term received from each source that suggested it.
+type combination func(scores []float64) float64
+
+type fusionStrategy struct {
+	normalise normalisation
+	combine   combination
+}
+
+var fusionStrategies = map[string]fusionStrategy{
+	FusionMinMax:  {normaliseMinMax, combineMax},
+	FusionZScore:  {normaliseZScore, combineMax},
+	FusionRRF:     {normaliseReciprocalRank, combineSum},
+	FusionCombSUM: {normaliseMinMax, combineSum},
+	FusionCombMNZ: {normaliseMinMax, combineMNZ},
+}
+
+// ValidateFusion checks that a fusion strategy exists. An empty strategy is the default, FusionMinMax.
+func ValidateFusion(strategy string) error {
+	if len(strategy) == 0 {
+		return nil
+	}
+	if _, ok := fusionStrategies[strings.ToLower(strategy)]; !ok {
+		return fmt.Errorf("unknown fusion strategy %s", strategy)
+	}
+	return nil
+}
+
+// fuse ranks the suggestions from each source together using a fusion strategy, returning at most size of them.
+// Terms suggested by more than one source are merged, and the sources that suggested a term are listed in
+// its Source, separated by commas.
+func fuse(strategy string, size int, sources ...[]suggestion) ([]suggestion, error) {
+	f, ok := fusionStrategies[strings.ToLower(strategy)]
+	if !ok {
+		return nil, fmt.Errorf("unknown fusion strategy %s", strategy)
+	}
+
+	type fused struct {
+		suggestion
+		sources []string
+		scores  []float64
+	}
+	var (
+		terms = make(map[string]*fused)
+		order []*fused
+	)
+	for _, res := range sources {
+		for i, score := range f.normalise(res) {
+			item := res[i]
+			key := strings.ToLower(strings.TrimSpace(item.Term))
+			t, ok := terms[key]
+			if !ok {
+				t = &fused{suggestion: suggestion{Term: item.Term}}
+				terms[key] = t
+				order = append(order, t)
+			}
+			t.scores = append(t.scores, score)
+			if len(item.Source) > 0 && !containsString(t.sources, item.Source) {
+				t.sources = append(t.sources, item.Source)
+			}
+		}
+	}
+
+	ret := make([]suggestion, len(order))
+	for i, t := range order {
+		ret[i] = suggestion{
+			Score:  f.combine(t.scores),
+			Term:   t.Term,
+			Source: strings.Join(t.sources, ","),
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Score > ret[j].Score
+	})
+
+	if size > 0 && len(ret) > size {
+		return ret[:size], nil
+	}
+	return ret, nil
+}
+
+func containsString(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func normaliseMinMax(res []suggestion) []float64 {
+	scores := make([]float64, len(res))
+	if len(res) == 0 {
+		return scores
+	}
+	min, max := res[0].Score, res[0].Score
+	for _, r := range res {
+		min = math.Min(min, r.Score)
+		max = math.Max(max, r.Score)
+	}
+	for i, r := range res {
+		// When every suggestion has the same score, they are all equally good.
+		if max == min {
+			scores[i] = 1
+			continue
+		}
+		scores[i] = (r.Score - min) / (max - min)
+	}
+	return scores
+}
+
+func normaliseZScore(res []suggestion) []float64 {
+	scores := make([]float64, len(res))
+	if len(res) == 0 {
+		return scores
+	}
+	var mean float64
+	for _, r := range res {
+		mean += r.Score
+	}
+	mean /= float64(len(res))
+	var variance float64
+	for _, r := range res {
+		variance += (r.Score - mean) * (r.Score - mean)
+	}
+	sd := math.Sqrt(variance / float64(len(res)))
+	for i, r := range res {
+		if sd == 0 {
+			continue
+		}
+		scores[i] = (r.Score - mean) / sd
+	}
+	return scores
+}
+
+// normaliseReciprocalRank ignores the scores, other than to rank the suggestions; ties share a rank.
+func normaliseReciprocalRank(res []suggestion) []float64 {
+	idx := make([]int, len(res))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return res[idx[i]].Score > res[idx[j]].Score
+	})
+	scores := make([]float64, len(res))
+	rank := 0
+	for i, j := range idx {
+		if i == 0 || res[j].Score != res[idx[i-1]].Score {
+			rank = i + 1
+		}
+		scores[j] = 1 / float64(rrfK+rank)
+	}
+	return scores
+}
+
+func combineMax(scores []float64) float64 {
+	max := math.Inf(-1)
+	for _, s := range scores {
+		max = math.Max(max, s)
+	}
+	return max
+}
+
+func combineSum(scores []float64) float64 {
+	var sum float64
+	for _, s := range scores {
+		sum += s
+	}
+	return sum
+}
+
+func combineMNZ(scores []float64) float64 {
+	return combineSum(scores) * float64(len(scores))
+}
@@ -0,0 +1,139 @@
+package searchrefiner
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func scored(scores ...float64) []suggestion {
+	res := make([]suggestion, len(scores))
+	for i, s := range scores {
+		res[i] = suggestion{Score: s}
+	}
+	return res
+}
+
+func approxEqual(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNormaliseMinMax(t *testing.T) {
+	tests := []struct {
+		scores []float64
+		want   []float64
+	}{
+		{nil, []float64{}},
+		{[]float64{2, 4, 6}, []float64{0, 0.5, 1}},
+		{[]float64{-1, 1}, []float64{0, 1}},
+		// Every suggestion of a source with a single score is equally good, rather than dividing by zero.
+		{[]float64{3, 3}, []float64{1, 1}},
+		{[]float64{5}, []float64{1}},
+	}
+	for _, test := range tests {
+		if got := normaliseMinMax(scored(test.scores...)); !approxEqual(got, test.want) {
+			t.Errorf("minmax(%v) = %v, want %v", test.scores, got, test.want)
+		}
+	}
+}
+
+func TestNormaliseZScore(t *testing.T) {
+	tests := []struct {
+		scores []float64
+		want   []float64
+	}{
+		{nil, []float64{}},
+		{[]float64{1, 3}, []float64{-1, 1}},
+		{[]float64{2, 4, 4, 4, 5, 5, 7, 9}, []float64{-1.5, -0.5, -0.5, -0.5, 0, 0, 1, 2}},
+		{[]float64{3, 3}, []float64{0, 0}},
+	}
+	for _, test := range tests {
+		if got := normaliseZScore(scored(test.scores...)); !approxEqual(got, test.want) {
+			t.Errorf("zscore(%v) = %v, want %v", test.scores, got, test.want)
+		}
+	}
+}
+
+func TestNormaliseReciprocalRank(t *testing.T) {
+	tests := []struct {
+		scores []float64
+		want   []float64
+	}{
+		{[]float64{0.1, 0.9, 0.5}, []float64{1.0 / (rrfK + 3), 1.0 / (rrfK + 1), 1.0 / (rrfK + 2)}},
+		// Ties share a rank.
+		{[]float64{0.5, 0.5, 0.1}, []float64{1.0 / (rrfK + 1), 1.0 / (rrfK + 1), 1.0 / (rrfK + 3)}},
+	}
+	for _, test := range tests {
+		if got := normaliseReciprocalRank(scored(test.scores...)); !approxEqual(got, test.want) {
+			t.Errorf("rrf(%v) = %v, want %v", test.scores, got, test.want)
+		}
+	}
+}
+
+func TestFuse(t *testing.T) {
+	a := []suggestion{{Term: "heart", Score: 10, Source: "A"}, {Term: "cardiac", Score: 5, Source: "A"}, {Term: "vessel", Score: 0, Source: "A"}}
+	b := []suggestion{{Term: "Cardiac", Score: 1, Source: "B"}, {Term: "attack", Score: 0.5, Source: "B"}, {Term: "stroke", Score: 0, Source: "B"}}
+
+	tests := []struct {
+		strategy string
+		terms    []string
+		scores   []float64
+	}{
+		// cardiac: 0.5 from A and 1 from B.
+		{FusionMinMax, []string{"heart", "cardiac", "attack", "vessel", "stroke"}, []float64{1, 1, 0.5, 0, 0}},
+		{FusionCombSUM, []string{"cardiac", "heart", "attack", "vessel", "stroke"}, []float64{1.5, 1, 0.5, 0, 0}},
+		{FusionCombMNZ, []string{"cardiac", "heart", "attack", "vessel", "stroke"}, []float64{3, 1, 0.5, 0, 0}},
+		{FusionRRF, []string{"cardiac", "heart", "attack", "vessel", "stroke"}, []float64{
+			1.0/(rrfK+2) + 1.0/(rrfK+1), 1.0 / (rrfK + 1), 1.0 / (rrfK + 2), 1.0 / (rrfK + 3), 1.0 / (rrfK + 3)}},
+		{FusionZScore, []string{"heart", "cardiac", "attack", "vessel", "stroke"}, []float64{
+			1.224744871391589, 1.224744871391589, 0, -1.224744871391589, -1.224744871391589}},
+	}
+	for _, test := range tests {
+		got, err := fuse(test.strategy, 0, a, b)
+		if err != nil {
+			t.Fatalf("%s: %v", test.strategy, err)
+		}
+		var (
+			terms  []string
+			scores []float64
+		)
+		for _, s := range got {
+			terms = append(terms, s.Term)
+			scores = append(scores, s.Score)
+		}
+		if !reflect.DeepEqual(terms, test.terms) || !approxEqual(scores, test.scores) {
+			t.Errorf("%s: got %v %v, want %v %v", test.strategy, terms, scores, test.terms, test.scores)
+		}
+		for _, s := range got {
+			if s.Term == "cardiac" && s.Source != "A,B" {
+				t.Errorf("%s: expected cardiac to be suggested by A,B, got %s", test.strategy, s.Source)
+			}
+		}
+	}
+
+	if got, _ := fuse(FusionCombSUM, 2, a, b); len(got) != 2 {
+		t.Errorf("expected 2 suggestions, got %d", len(got))
+	}
+}
+
+func TestValidateFusion(t *testing.T) {
+	for _, strategy := range []string{"", FusionMinMax, "RRF", FusionCombMNZ} {
+		if err := ValidateFusion(strategy); err != nil {
+			t.Errorf("%q: %v", strategy, err)
+		}
+	}
+	if err := ValidateFusion("borda"); err == nil {
+		t.Error("expected an unknown fusion strategy to be rejected")
+	}
+	if _, err := fuse("borda", 0); err == nil {
+		t.Error("expected fuse to reject an unknown fusion strategy")
+	}
+}
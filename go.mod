@@ -14,6 +14,7 @@ require (
 	github.com/hscells/metawrap v0.0.0-20201123064837-00897f27efb5
 	github.com/hscells/quickumlsrest v0.0.0-20190213061558-2265f0340fd2
 	github.com/hscells/transmute v0.0.0-20191226011638-492a895bec30
+	github.com/hscells/trecresults v0.0.0-20190830042051-938b7ed52aab
 	github.com/ielab/toolexchange v0.0.0-20210118233513-e4083499eb9a
 	github.com/olivere/elastic/v7 v7.0.22
 	github.com/patrickmn/go-cache v2.1.0+incompatible
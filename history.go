@@ -0,0 +1,257 @@
+package searchrefiner
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"net/http"
+	"strconv"
+)
+
+// StatePath is the bolt database that persistent server state (such as query history) is stored in.
+const StatePath = "searchrefiner.db"
+
+var (
+	historyBucket = []byte("history")
+	// strategiesBucket indexes the latest version of each search strategy. Like the history, it has a nested bucket
+	// for each user or project, in which the name of each strategy is the key of the ID of its latest version.
+	strategiesBucket = []byte("strategies")
+)
+
+// UnknownParentError is returned when a query names a parent that is not in the history.
+type UnknownParentError struct {
+	Parent   uint64
+	Username string
+}
+
+func (e UnknownParentError) Error() string {
+	return fmt.Sprintf("no query %d in the history of %s", e.Parent, e.Username)
+}
+
+// historyStatus is the status of a request that failed to add a query to the history.
+func historyStatus(err error) int {
+	if _, ok := err.(UnknownParentError); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// HistoryStore persists the queries issued by each user so that history survives restarts.
+// Each user has their own nested bucket, keyed by an increasing sequence number. Projects have a bucket of their own,
+// named by the key of their Workspace, so the history of a project is shared between its members.
+type HistoryStore struct {
+	db *bolt.DB
+}
+
+// NewHistoryStore creates a history store backed by an open bolt database.
+func NewHistoryStore(db *bolt.DB) (*HistoryStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(strategiesBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &HistoryStore{db: db}, nil
+}
+
+func historyKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// Add appends a query to the history of a user, and returns it as it was stored.
+//
+// Queries are versions of a search strategy. A query that has a Parent is the next version of the strategy of its
+// parent. Otherwise, a query that names a Strategy is the next version of that strategy, and a query that names
+// neither starts a new strategy.
+func (h *HistoryStore) Add(username string, q Query) (Query, error) {
+	// Plugin details are only used for rendering and are not stored.
+	q.Plugins = nil
+	q.PluginTitle = ""
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(username))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		q.ID = seq
+		q.Version = 1
+		strategies, err := h.strategies(tx, username)
+		if err != nil {
+			return err
+		}
+		switch {
+		case q.Parent != 0:
+			v := b.Get(historyKey(q.Parent))
+			if v == nil {
+				return UnknownParentError{Parent: q.Parent, Username: username}
+			}
+			var parent Query
+			if err := json.Unmarshal(v, &parent); err != nil {
+				return err
+			}
+			q.Strategy = parent.Strategy
+			if len(q.Strategy) == 0 {
+				q.Strategy = strconv.FormatUint(q.Parent, 10)
+			}
+			q.Version = parent.Version + 1
+		case len(q.Strategy) > 0:
+			// Continue from the latest version of the strategy.
+			if k := strategies.Get([]byte(q.Strategy)); k != nil {
+				var latest Query
+				if err := json.Unmarshal(b.Get(k), &latest); err != nil {
+					return err
+				}
+				q.Parent = binary.BigEndian.Uint64(k)
+				q.Version = latest.Version + 1
+			}
+		default:
+			q.Strategy = strconv.FormatUint(seq, 10)
+		}
+		v, err := json.Marshal(q)
+		if err != nil {
+			return err
+		}
+		err = b.Put(historyKey(seq), v)
+		if err != nil {
+			return err
+		}
+		// A version revised from an earlier version of a strategy does not replace a later version as the latest. Of
+		// two versions with the same number, the one added last is the latest.
+		if k := strategies.Get([]byte(q.Strategy)); k != nil {
+			var latest Query
+			if err := json.Unmarshal(b.Get(k), &latest); err != nil {
+				return err
+			}
+			if latest.Version > q.Version {
+				return nil
+			}
+		}
+		return strategies.Put([]byte(q.Strategy), historyKey(seq))
+	})
+	return q, err
+}
+
+// strategies gets the index of the strategies in the history of a user. The index of a history that was stored
+// before strategies were indexed is built the first time it is needed.
+func (h *HistoryStore) strategies(tx *bolt.Tx, username string) (*bolt.Bucket, error) {
+	if b := tx.Bucket(strategiesBucket).Bucket([]byte(username)); b != nil {
+		return b, nil
+	}
+	strategies, err := tx.Bucket(strategiesBucket).CreateBucket([]byte(username))
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]int)
+	err = tx.Bucket(historyBucket).Bucket([]byte(username)).ForEach(func(k, v []byte) error {
+		var q Query
+		if err := json.Unmarshal(v, &q); err != nil {
+			return err
+		}
+		if len(q.Strategy) == 0 || q.Version < latest[q.Strategy] {
+			return nil
+		}
+		latest[q.Strategy] = q.Version
+		return strategies.Put([]byte(q.Strategy), append([]byte(nil), k...))
+	})
+	return strategies, err
+}
+
+// Entry finds a query in the history of a user by its ID.
+func (h *HistoryStore) Entry(username string, id uint64) (Query, bool, error) {
+	var (
+		q  Query
+		ok bool
+	)
+	err := h.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket).Bucket([]byte(username))
+		if b == nil {
+			return nil
+		}
+		v := b.Get(historyKey(id))
+		if v == nil {
+			return nil
+		}
+		ok = true
+		if err := json.Unmarshal(v, &q); err != nil {
+			return err
+		}
+		q.ID = id
+		return nil
+	})
+	return q, ok, err
+}
+
+// Versions returns the versions of a search strategy in the history of a user, oldest first.
+func (h *HistoryStore) Versions(username, strategy string) ([]Query, error) {
+	queries, err := h.Get(username)
+	if err != nil {
+		return nil, err
+	}
+	var versions []Query
+	for _, q := range queries {
+		if q.Strategy == strategy {
+			versions = append(versions, q)
+		}
+	}
+	return versions, nil
+}
+
+// Get returns the history of a user in the order the queries were issued.
+func (h *HistoryStore) Get(username string) ([]Query, error) {
+	var queries []Query
+	err := h.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket).Bucket([]byte(username))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var q Query
+			if err := json.Unmarshal(v, &q); err != nil {
+				return err
+			}
+			q.ID = binary.BigEndian.Uint64(k)
+			queries = append(queries, q)
+			return nil
+		})
+	})
+	return queries, err
+}
+
+// Recent returns the history of a user with the most recently issued query first.
+func (h *HistoryStore) Recent(username string) ([]Query, error) {
+	queries, err := h.Get(username)
+	if err != nil {
+		return nil, err
+	}
+	rev := make([]Query, len(queries))
+	j := 0
+	for i := len(queries) - 1; i >= 0; i-- {
+		rev[j] = queries[i]
+		j++
+	}
+	return rev, nil
+}
+
+// Clear removes the entire history of a user.
+func (h *HistoryStore) Clear(username string) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{historyBucket, strategiesBucket} {
+			err := tx.Bucket(bucket).DeleteBucket([]byte(username))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
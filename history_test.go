@@ -0,0 +1,94 @@
+package searchrefiner
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func testHistory(t *testing.T) (*HistoryStore, *bolt.DB) {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), StatePath), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	h, err := NewHistoryStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, db
+}
+
+func TestHistoryUnknownParent(t *testing.T) {
+	h, _ := testHistory(t)
+	_, err := h.Add("user", Query{QueryString: "heart", Parent: 42})
+	if _, ok := err.(UnknownParentError); !ok {
+		t.Fatalf("expected an UnknownParentError, got %v", err)
+	}
+	if status := historyStatus(err); status != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, status)
+	}
+}
+
+func TestHistoryStrategyVersions(t *testing.T) {
+	h, _ := testHistory(t)
+	add := func(q Query) Query {
+		t.Helper()
+		q, err := h.Add("user", q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	v1 := add(Query{QueryString: "a", Strategy: "s"})
+	add(Query{QueryString: "other", Strategy: "t"})
+	v2 := add(Query{QueryString: "b", Strategy: "s"})
+	// Revising the first version again branches from it, without becoming the latest version.
+	branch := add(Query{QueryString: "c", Parent: v1.ID})
+	v3 := add(Query{QueryString: "d", Strategy: "s"})
+
+	switch {
+	case v1.Version != 1 || v2.Version != 2 || v2.Parent != v1.ID:
+		t.Errorf("expected version 2 to revise version 1, got %+v", v2)
+	case branch.Strategy != "s" || branch.Version != 2 || branch.Parent != v1.ID:
+		t.Errorf("expected a second version 2 revising version 1, got %+v", branch)
+	case v3.Version != 3 || v3.Parent != branch.ID:
+		t.Errorf("expected version 3 to revise the version 2 added last, got %+v", v3)
+	}
+}
+
+// TestHistoryStrategyIndexMigration checks that the strategies of a history stored before they were indexed are
+// continued from their latest version.
+func TestHistoryStrategyIndexMigration(t *testing.T) {
+	h, db := testHistory(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(historyBucket).CreateBucket([]byte("user"))
+		if err != nil {
+			return err
+		}
+		for _, q := range []Query{{Strategy: "s", Version: 1}, {Strategy: "s", Version: 2, Parent: 1}, {Strategy: "t", Version: 1}} {
+			id, _ := b.NextSequence()
+			v, err := json.Marshal(q)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(historyKey(id), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := h.Add("user", Query{QueryString: "c", Strategy: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Version != 3 || q.Parent != 2 {
+		t.Errorf("expected version 3 revising query 2, got version %d revising %d", q.Version, q.Parent)
+	}
+}
@@ -0,0 +1,210 @@
+package searchrefiner
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/transmute"
+	tpipeline "github.com/hscells/transmute/pipeline"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// DefaultLanguage is the query language used when a request does not specify one.
+const DefaultLanguage = "medline"
+
+// Language is a query language. A language that has a Parser can be used to write queries, and a language that has
+// a Compiler can be translated into.
+type Language struct {
+	Name  string
+	Title string
+	// Aliases are other names that the language may be requested by, e.g., "ovid" for Ovid MEDLINE. Requests that
+	// use an alias are handled as though they used the name of the language.
+	Aliases []string
+	// Parser translates queries in the language into the common query representation.
+	Parser *tpipeline.TransmutePipeline
+	// Compiler translates queries in the common query representation into the language.
+	Compiler *tpipeline.TransmutePipeline
+}
+
+// LanguageDetails describe a language and what it can be used for.
+type LanguageDetails struct {
+	Name    string   `json:"name"`
+	Title   string   `json:"title"`
+	Aliases []string `json:"aliases,omitempty"`
+	Parse   bool     `json:"parse"`
+	Compile bool     `json:"compile"`
+}
+
+// UnknownLanguageError is returned when a query language has not been registered, or cannot be used as requested.
+type UnknownLanguageError struct {
+	Language string
+	Reason   string
+}
+
+func (e UnknownLanguageError) Error() string {
+	if len(e.Reason) > 0 {
+		return fmt.Sprintf("query language %q %s", e.Language, e.Reason)
+	}
+	return fmt.Sprintf("unknown query language %q", e.Language)
+}
+
+// LanguageRegistry holds the query languages that searchrefiner understands. Plugins may register additional
+// languages in their Startup method.
+type LanguageRegistry struct {
+	mu        sync.RWMutex
+	languages map[string]Language
+	aliases   map[string]string
+}
+
+// Languages is the registry of query languages.
+var Languages = NewLanguageRegistry()
+
+// NewLanguageRegistry creates a registry of the built-in query languages.
+func NewLanguageRegistry() *LanguageRegistry {
+	r := &LanguageRegistry{languages: make(map[string]Language), aliases: make(map[string]string)}
+	medline2Cqr, cqr2Medline := transmute.Medline2Cqr, transmute.Cqr2Medline
+	pubmed2Cqr, cqr2Pubmed := transmute.Pubmed2Cqr, transmute.Cqr2Pubmed
+	embase2Cqr, cqr2Embase := Embase2Cqr, Cqr2Embase
+	// Ovid syntax (exp Heading/, .ti,ab., adj3) is the syntax of Ovid MEDLINE.
+	r.Register(Language{Name: "medline", Title: "Ovid MEDLINE", Aliases: []string{"ovid"}, Parser: &medline2Cqr, Compiler: &cqr2Medline})
+	r.Register(Language{Name: "pubmed", Title: "PubMed", Parser: &pubmed2Cqr, Compiler: &cqr2Pubmed})
+	r.Register(Language{Name: "embase", Title: "Embase", Parser: &embase2Cqr, Compiler: &cqr2Embase})
+	return r
+}
+
+// Register adds a language, replacing any language with the same name or alias.
+func (r *LanguageRegistry) Register(l Language) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.aliases, l.Name)
+	r.languages[l.Name] = l
+	for _, alias := range l.Aliases {
+		delete(r.languages, alias)
+		r.aliases[alias] = l.Name
+	}
+}
+
+// Get finds a language by its name or one of its aliases. The default language is used when name is empty.
+func (r *LanguageRegistry) Get(name string) (Language, error) {
+	if len(name) == 0 {
+		name = DefaultLanguage
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n, ok := r.aliases[name]; ok {
+		name = n
+	}
+	l, ok := r.languages[name]
+	if !ok {
+		return Language{}, UnknownLanguageError{Language: name}
+	}
+	return l, nil
+}
+
+// Parser gets the pipeline that parses queries written in a language, and the name of the language.
+func (r *LanguageRegistry) Parser(name string) (tpipeline.TransmutePipeline, string, error) {
+	l, err := r.Get(name)
+	if err != nil {
+		return tpipeline.TransmutePipeline{}, name, err
+	}
+	if l.Parser == nil {
+		return tpipeline.TransmutePipeline{}, l.Name, UnknownLanguageError{Language: l.Name, Reason: "cannot be parsed"}
+	}
+	return *l.Parser, l.Name, nil
+}
+
+// Compiler gets the pipeline that translates queries into a language, and the name of the language.
+func (r *LanguageRegistry) Compiler(name string) (tpipeline.TransmutePipeline, string, error) {
+	l, err := r.Get(name)
+	if err != nil {
+		return tpipeline.TransmutePipeline{}, name, err
+	}
+	if l.Compiler == nil {
+		return tpipeline.TransmutePipeline{}, l.Name, UnknownLanguageError{Language: l.Name, Reason: "cannot be translated into"}
+	}
+	return *l.Compiler, l.Name, nil
+}
+
+// ParserOptions configure how the query of a single request is parsed, without affecting other requests.
+type ParserOptions struct {
+	// DefaultField is the field that keywords without a field are searched in.
+	DefaultField string
+	// Fields override the fields that the field tags of the language map to, e.g., {"tw": ["title_abstract"]}.
+	Fields map[string][]string
+}
+
+// ConfiguredParser gets the pipeline that parses queries written in a language, configured with options. The
+// field mapping of the pipeline is copied before it is changed, as pipelines are shared by every request.
+func (r *LanguageRegistry) ConfiguredParser(name string, o ParserOptions) (tpipeline.TransmutePipeline, string, error) {
+	p, name, err := r.Parser(name)
+	if err != nil || (len(o.DefaultField) == 0 && len(o.Fields) == 0) {
+		return p, name, err
+	}
+	base := p.Options.FieldMapping
+	if base == nil {
+		base = p.Parser.FieldMapping
+	}
+	mapping := make(map[string][]string, len(base)+len(o.Fields)+1)
+	for k, v := range base {
+		mapping[k] = v
+	}
+	for k, v := range o.Fields {
+		mapping[k] = v
+	}
+	if len(o.DefaultField) > 0 {
+		mapping["default"] = []string{o.DefaultField}
+	}
+	p.Options.FieldMapping = mapping
+	return p, name, nil
+}
+
+// RequestParserOptions reads the parser options of a request from the "field" parameter, the default field, and
+// the "fields" parameter, a JSON object of field mapping overrides.
+func RequestParserOptions(c *gin.Context) (ParserOptions, error) {
+	o := ParserOptions{DefaultField: c.PostForm("field")}
+	if f := c.PostForm("fields"); len(f) > 0 {
+		err := json.Unmarshal([]byte(f), &o.Fields)
+		if err != nil {
+			return o, fmt.Errorf("invalid field mapping: %v", err)
+		}
+	}
+	return o, nil
+}
+
+// RequestParser gets the pipeline that parses the query of a request, in the language of its "lang" parameter and
+// configured with its parser options, and the name of the language.
+func RequestParser(c *gin.Context) (tpipeline.TransmutePipeline, string, error) {
+	lang := c.PostForm("lang")
+	o, err := RequestParserOptions(c)
+	if err != nil {
+		return tpipeline.TransmutePipeline{}, lang, err
+	}
+	return Languages.ConfiguredParser(lang, o)
+}
+
+// List describes the registered languages, ordered by name.
+func (r *LanguageRegistry) List() []LanguageDetails {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	details := make([]LanguageDetails, 0, len(r.languages))
+	for _, l := range r.languages {
+		details = append(details, LanguageDetails{
+			Name:    l.Name,
+			Title:   l.Title,
+			Aliases: l.Aliases,
+			Parse:   l.Parser != nil,
+			Compile: l.Compiler != nil,
+		})
+	}
+	sort.Slice(details, func(i, j int) bool {
+		return details[i].Name < details[j].Name
+	})
+	return details
+}
+
+// ApiLanguages lists the query languages that are available.
+func ApiLanguages(c *gin.Context) {
+	c.JSON(http.StatusOK, Languages.List())
+}
@@ -0,0 +1,108 @@
+package searchrefiner
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/cqr"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLanguageAlias(t *testing.T) {
+	_, lang, err := Languages.Parser("ovid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lang != "medline" {
+		t.Errorf("expected ovid to be handled as medline, got %s", lang)
+	}
+}
+
+// requestFields parses a query as a request with the given form would, and lists the fields of its keywords.
+func requestFields(t *testing.T, form url.Values) ([]string, error) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	compiler, _, err := RequestParser(c)
+	if err != nil {
+		return nil, err
+	}
+	cq, err := compiler.Execute(form.Get("query"))
+	if err != nil {
+		return nil, err
+	}
+	repr, err := cq.Representation()
+	if err != nil {
+		return nil, err
+	}
+	var fields []string
+	var walk func(q cqr.CommonQueryRepresentation)
+	walk = func(q cqr.CommonQueryRepresentation) {
+		switch v := q.(type) {
+		case cqr.Keyword:
+			fields = append(fields, strings.Join(sortedFields(v.Fields), ","))
+		case cqr.BooleanQuery:
+			for _, child := range v.Children {
+				walk(child)
+			}
+		}
+	}
+	walk(repr.(cqr.CommonQueryRepresentation))
+	return fields, nil
+}
+
+// TestRequestParserConcurrentOptions checks that the field options of one request do not leak into the shared
+// pipelines, or into other requests parsed at the same time. Run it with -race (make test).
+func TestRequestParserConcurrentOptions(t *testing.T) {
+	forms := []url.Values{
+		{"lang": {"pubmed"}, "query": {"heart attack AND stroke[tw]"}},
+		{"lang": {"pubmed"}, "query": {"heart attack AND stroke[tw]"}, "field": {"title"}},
+		{"lang": {"pubmed"}, "query": {"heart attack AND stroke[tw]"}, "fields": {`{"tw": ["abstract"]}`}},
+		{"lang": {"pubmed"}, "query": {"heart attack AND stroke[tw]"}, "field": {"mesh_headings"}, "fields": {`{"tw": ["title"]}`}},
+	}
+	want := make([][]string, len(forms))
+	for i, form := range forms {
+		fields, err := requestFields(t, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i] = fields
+	}
+	if want[1][0] != "title" || want[2][1] != "abstract" || want[3][0] != "mesh_headings" || want[3][1] != "title" {
+		t.Fatalf("field options were not applied: %v", want)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64*len(forms))
+	for n := 0; n < 64; n++ {
+		for i := range forms {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				fields, err := requestFields(t, forms[i])
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !reflect.DeepEqual(fields, want[i]) {
+					errs <- fmt.Errorf("request %d: got fields %v, want %v", i, fields, want[i])
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// The options of the requests must not have changed the pipeline of requests without options.
+	if fields, _ := requestFields(t, forms[0]); !reflect.DeepEqual(fields, want[0]) {
+		t.Errorf("got fields %v after configured requests, want %v", fields, want[0])
+	}
+}
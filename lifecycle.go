@@ -0,0 +1,95 @@
+package searchrefiner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// healthTimeout bounds how long a plugin may take to report its health.
+const healthTimeout = 5 * time.Second
+
+// PluginShutdowner may be implemented by a plugin to flush its state before searchrefiner exits.
+type PluginShutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// PluginConfigurer may be implemented by a plugin to receive its configuration, which is the entry for the plugin
+// in the "Plugins" section of config.json. It is called before Startup, and a plugin that returns an error is
+// disabled.
+type PluginConfigurer interface {
+	Configure(config json.RawMessage) error
+}
+
+// PluginHealthChecker may be implemented by a plugin to report that something it depends on is down.
+type PluginHealthChecker interface {
+	Health() error
+}
+
+// PluginHealth is the health of a plugin, as shown on the admin page. Reports is false for plugins that do not
+// report their health.
+type PluginHealth struct {
+	URL     string
+	Title   string
+	Reports bool
+	Error   string
+}
+
+// PluginHealth checks the health of the plugins that have been loaded.
+func (s *State) PluginHealth() []PluginHealth {
+	plugins := s.LoadedPlugins()
+	health := make([]PluginHealth, 0, len(plugins))
+	for url, p := range plugins {
+		h := PluginHealth{URL: url, Title: p.Details().Title}
+		if c, ok := p.(PluginHealthChecker); ok {
+			h.Reports = true
+			// A plugin that does not answer is as unhealthy as one that reports an error.
+			errs := make(chan error, 1)
+			go func() { errs <- c.Health() }()
+			select {
+			case err := <-errs:
+				if err != nil {
+					h.Error = err.Error()
+				}
+			case <-time.After(healthTimeout):
+				h.Error = fmt.Sprintf("did not report its health within %s", healthTimeout)
+			}
+		}
+		health = append(health, h)
+	}
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].URL < health[j].URL
+	})
+	return health
+}
+
+// Shutdown shuts down the plugins that have been loaded, and then closes their storage. Every plugin is shut
+// down, even when some fail to, and the first error is returned.
+func (s *State) Shutdown(ctx context.Context) error {
+	var first error
+	for url, p := range s.LoadedPlugins() {
+		sd, ok := p.(PluginShutdowner)
+		if !ok {
+			continue
+		}
+		log.Infof("[shutdown] %s", url)
+		if err := sd.Shutdown(ctx); err != nil {
+			log.Errorf("[shutdown] %s: %v", url, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	for plugin, ps := range s.AllStorage() {
+		if err := ps.Close(); err != nil {
+			log.Errorf("[shutdown] storage %s: %v", plugin, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
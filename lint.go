@@ -0,0 +1,371 @@
+package searchrefiner
+
+import (
+	_ "embed"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/transmute"
+	"github.com/hscells/transmute/backend"
+	tpipeline "github.com/hscells/transmute/pipeline"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Severities of diagnostics.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// minTruncationStem is the shortest stem that can be truncated without matching an unreasonable number of words.
+const minTruncationStem = 3
+
+// Diagnostic is a problem found in a query. Lines and columns start at 1.
+type Diagnostic struct {
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+//go:embed dictionary/fields.txt
+var fieldDictionary string
+
+// knownFields are the (lower-cased) field tags that PubMed and Ovid MEDLINE queries may use: those in the
+// dictionary, and those that the parsers have a mapping for.
+var knownFields = func() map[string]bool {
+	f := make(map[string]bool)
+	for _, line := range strings.Split(fieldDictionary, "\n") {
+		if line = strings.ToLower(strings.TrimSpace(line)); len(line) > 0 {
+			f[line] = true
+		}
+	}
+	for _, p := range []tpipeline.TransmutePipeline{transmute.Pubmed2Cqr, transmute.Medline2Cqr} {
+		for field := range p.Parser.FieldMapping {
+			f[strings.ToLower(field)] = true
+		}
+	}
+	return f
+}()
+
+var (
+	pubmedFieldRegexp   = regexp.MustCompile(`\[([^\[\]]*)\]`)
+	medlineFieldRegexp  = regexp.MustCompile(`\.([a-z]{2}(?:,[a-z]{2})*)\.\s*$`)
+	medlineNumber       = regexp.MustCompile(`^\s*\d+\.?\s+`)
+	medlineRefsRegexp   = regexp.MustCompile(`^(?i:or|and|not)/([\d\s,-]+)$`)
+	medlineInfixRegexp  = regexp.MustCompile(`^\d+(?:\s+(?i:or|and|not)\s+\d+)+$`)
+	pubmedRefRegexp     = regexp.MustCompile(`#(\d+)`)
+	truncationRegexp    = regexp.MustCompile(`([A-Za-z0-9-]*)[*$?]`)
+	parseErrorLineRegex = regexp.MustCompile(`on line (\d+)`)
+	numberRegexp        = regexp.MustCompile(`\d+`)
+)
+
+// position converts an offset into a line and a column.
+func position(query string, offset int) (int, int) {
+	line := strings.Count(query[:offset], "\n") + 1
+	col := offset - strings.LastIndex(query[:offset], "\n")
+	return line, col
+}
+
+// Lint finds problems in a query written in the language lang.
+func Lint(query, lang string) ([]Diagnostic, error) {
+	compiler, lang, err := Languages.Parser(lang)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(strings.TrimSpace(query)) == 0 {
+		return []Diagnostic{{Line: 1, Column: 1, Severity: SeverityError, Message: "the query is empty"}}, nil
+	}
+
+	diagnostics := lintParentheses(query)
+	diagnostics = append(diagnostics, lintTruncation(query)...)
+	switch lang {
+	case "pubmed":
+		diagnostics = append(diagnostics, lintPubMedFields(query)...)
+	case "embase":
+		for _, u := range UntranslatableInput(query, lang) {
+			line, col := 1, 1
+			if i := strings.Index(query, u.Construct); i >= 0 {
+				line, col = position(query, i)
+			}
+			diagnostics = append(diagnostics, Diagnostic{line, col, SeverityWarning, fmt.Sprintf("%s: %s", u.Construct, u.Reason)})
+		}
+	case "medline":
+		diagnostics = append(diagnostics, lintMedlineLines(query)...)
+	}
+	if lang != "medline" {
+		diagnostics = append(diagnostics, lintDuplicates(query, 0, len(query))...)
+	}
+
+	cq, err := lintParse(compiler, query)
+	if err != nil {
+		line := 1
+		if m := parseErrorLineRegex.FindStringSubmatch(err.Error()); m != nil {
+			line, _ = strconv.Atoi(m[1])
+		}
+		// Only the last line of the error is useful to a searcher; the rest is the state of the parser.
+		msg := strings.Split(strings.TrimSpace(err.Error()), "\n")
+		return append(diagnostics, Diagnostic{Line: line, Column: 1, Severity: SeverityError, Message: msg[len(msg)-1]}), nil
+	}
+	if _, err := cq.Representation(); err != nil {
+		return append(diagnostics, Diagnostic{Line: 1, Column: 1, Severity: SeverityError, Message: err.Error()}), nil
+	}
+	return diagnostics, nil
+}
+
+// lintParse parses a query. The parsers panic on some incomplete queries, e.g., "(" or "((a", which are exactly
+// the queries that are linted while they are being written, so a panic is returned as a parse error.
+func lintParse(compiler tpipeline.TransmutePipeline, query string) (cq backend.BooleanQuery, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to parse query: %v", r)
+		}
+	}()
+	return compiler.Execute(query)
+}
+
+func lintParentheses(query string) []Diagnostic {
+	var (
+		diagnostics []Diagnostic
+		open        []int
+		quoted      bool
+		quote       int
+	)
+	for i, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			quote = i
+		case quoted:
+		case r == '(':
+			open = append(open, i)
+		case r == ')':
+			if len(open) == 0 {
+				line, col := position(query, i)
+				diagnostics = append(diagnostics, Diagnostic{line, col, SeverityError, "closing parenthesis has no matching opening parenthesis"})
+				continue
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	for _, i := range open {
+		line, col := position(query, i)
+		diagnostics = append(diagnostics, Diagnostic{line, col, SeverityError, "opening parenthesis is never closed"})
+	}
+	if quoted {
+		line, col := position(query, quote)
+		diagnostics = append(diagnostics, Diagnostic{line, col, SeverityError, "quotation mark is never closed"})
+	}
+	return diagnostics
+}
+
+func lintTruncation(query string) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, m := range truncationRegexp.FindAllStringSubmatchIndex(query, -1) {
+		stem := query[m[2]:m[3]]
+		// Skip wildcards that are part of a field tag or a line reference, e.g., "exp Heart/" or "or/1-3".
+		if len(stem) == 0 || len(stem) >= minTruncationStem {
+			continue
+		}
+		line, col := position(query, m[2])
+		diagnostics = append(diagnostics, Diagnostic{line, col, SeverityWarning,
+			fmt.Sprintf("truncating the short stem %q will match a very large number of words", stem)})
+	}
+	return diagnostics
+}
+
+func lintPubMedFields(query string) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, m := range pubmedFieldRegexp.FindAllStringSubmatchIndex(query, -1) {
+		tag := strings.ToLower(strings.TrimSpace(query[m[2]:m[3]]))
+		// Modifiers such as [mh:noexp] or [tiab:~3] are not part of the tag.
+		if i := strings.Index(tag, ":"); i >= 0 {
+			tag = tag[:i]
+		}
+		if !knownFields[tag] {
+			line, col := position(query, m[2])
+			diagnostics = append(diagnostics, Diagnostic{line, col, SeverityWarning, fmt.Sprintf("unknown field %q will be searched as all fields", tag)})
+		}
+	}
+	for _, m := range pubmedRefRegexp.FindAllStringSubmatchIndex(query, -1) {
+		line, col := position(query, m[0])
+		diagnostics = append(diagnostics, Diagnostic{line, col, SeverityError,
+			fmt.Sprintf("search history reference %s cannot be resolved in a single query", query[m[0]:m[1]])})
+	}
+	return diagnostics
+}
+
+// lintMedlineLines checks the field tags of each line of an Ovid MEDLINE query, and that the lines that combine
+// other lines only refer to lines that precede them.
+func lintMedlineLines(query string) []Diagnostic {
+	var (
+		diagnostics []Diagnostic
+		offset      int
+		n           int
+		seen        = make(map[string]int)
+	)
+	for _, raw := range strings.SplitAfter(query, "\n") {
+		start := offset
+		offset += len(raw)
+		if len(strings.TrimSpace(raw)) == 0 {
+			continue
+		}
+		n++
+		lineNo, _ := position(query, start)
+		body := strings.TrimRight(raw, "\r\n")
+		if loc := medlineNumber.FindStringIndex(body); loc != nil {
+			start += loc[1]
+			body = body[loc[1]:]
+		}
+		start += len(body) - len(strings.TrimLeft(body, " \t"))
+		body = strings.TrimSpace(body)
+
+		if m := medlineFieldRegexp.FindStringSubmatchIndex(body); m != nil {
+			for _, tag := range strings.Split(body[m[2]:m[3]], ",") {
+				if !knownFields[tag] {
+					_, col := position(query, start+m[2])
+					diagnostics = append(diagnostics, Diagnostic{lineNo, col, SeverityWarning, fmt.Sprintf("unknown field %q will be searched as all fields", tag)})
+				}
+			}
+		}
+
+		if medlineRefsRegexp.MatchString(body) || medlineInfixRegexp.MatchString(body) {
+			for _, ref := range numberRegexp.FindAllString(body, -1) {
+				if i, _ := strconv.Atoi(ref); i >= n || i < 1 {
+					diagnostics = append(diagnostics, Diagnostic{lineNo, 1, SeverityError,
+						fmt.Sprintf("line %d refers to line %s, which does not precede it", n, ref)})
+				}
+			}
+			continue
+		}
+
+		diagnostics = append(diagnostics, lintDuplicates(query, start, start+len(body))...)
+		key := strings.ToLower(body)
+		if prev, ok := seen[key]; ok {
+			diagnostics = append(diagnostics, Diagnostic{lineNo, 1, SeverityWarning, fmt.Sprintf("line %d duplicates line %d", n, prev)})
+			continue
+		}
+		seen[key] = n
+	}
+	return diagnostics
+}
+
+var booleanOperators = map[string]bool{"AND": true, "OR": true, "NOT": true}
+
+// operand is a clause of a query, as written, and where it starts in the query.
+type operand struct {
+	text     string
+	offset   int
+	operator string // The operator that joins the operand to the one before it.
+}
+
+// splitOperands splits query[start:end] at the Boolean operators that are not inside parentheses, quotation marks
+// or field tags. The parenthesised groups are returned so that they can be split in turn.
+func splitOperands(query string, start, end int) ([]operand, [][2]int) {
+	var (
+		operands []operand
+		groups   [][2]int
+		depth    int
+		quoted   bool
+		tag      bool
+		group    int
+		from     = start
+		operator string
+	)
+	cut := func(to int) {
+		text := query[from:to]
+		trimmed := strings.TrimSpace(text)
+		if len(trimmed) > 0 {
+			operands = append(operands, operand{trimmed, from + strings.Index(text, trimmed), operator})
+		}
+	}
+	for i := start; i < end; i++ {
+		switch c := query[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[':
+			tag = true
+		case c == ']':
+			tag = false
+		case tag:
+		case c == '(':
+			if depth == 0 {
+				group = i + 1
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				groups = append(groups, [2]int{group, i})
+			}
+		case depth > 0:
+		case i == start || query[i-1] == ' ' || query[i-1] == '\t' || query[i-1] == '\n' || query[i-1] == ')':
+			// An operator is a whole word, followed by a space or a parenthesis.
+			j := i
+			for j < end && unicode.IsLetter(rune(query[j])) {
+				j++
+			}
+			op := strings.ToUpper(query[i:j])
+			if !booleanOperators[op] || j == end || !(query[j] == ' ' || query[j] == '(' || query[j] == '\t' || query[j] == '\n') {
+				continue
+			}
+			cut(i)
+			operator = op
+			from = j
+			i = j - 1
+		}
+	}
+	cut(end)
+	return operands, groups
+}
+
+// lintDuplicates finds clauses that appear more than once in the same Boolean clause of query[start:end]. The
+// clauses are compared as they are written, because the parsers already merge repeated keywords such as
+// "heart[tiab] OR heart[tiab]". Operators are evaluated from left to right, so a change of operator starts a new
+// clause.
+func lintDuplicates(query string, start, end int) []Diagnostic {
+	var diagnostics []Diagnostic
+	operands, groups := splitOperands(query, start, end)
+	var (
+		seen     = make(map[string]bool)
+		operator string
+	)
+	for i, o := range operands {
+		if i > 1 && o.operator != operator {
+			seen = make(map[string]bool)
+		}
+		operator = o.operator
+		key := strings.ToLower(strings.Join(strings.Fields(o.text), " "))
+		if seen[key] {
+			line, col := position(query, o.offset)
+			diagnostics = append(diagnostics, Diagnostic{line, col, SeverityWarning,
+				fmt.Sprintf("%q appears more than once in the same %s clause", o.text, operator)})
+			continue
+		}
+		seen[key] = true
+	}
+	for _, g := range groups {
+		diagnostics = append(diagnostics, lintDuplicates(query, g[0], g[1])...)
+	}
+	return diagnostics
+}
+
+// ApiLint reports diagnostics for the query in the "query" parameter, written in the language in "lang".
+func ApiLint(c *gin.Context) {
+	rawQuery := c.PostForm("query")
+	lang := c.PostForm("lang")
+	diagnostics, err := Lint(rawQuery, lang)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if diagnostics == nil {
+		diagnostics = []Diagnostic{}
+	}
+	c.JSON(http.StatusOK, diagnostics)
+}
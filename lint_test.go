@@ -0,0 +1,107 @@
+package searchrefiner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLintIncompleteQueries(t *testing.T) {
+	for _, lang := range []string{"pubmed", "medline", "embase"} {
+		for _, query := range []string{"", "(", `"`, "((a"} {
+			diagnostics, err := Lint(query, lang)
+			if err != nil {
+				t.Errorf("%s %q: %v", lang, query, err)
+				continue
+			}
+			var parseError bool
+			for _, d := range diagnostics {
+				parseError = parseError || d.Severity == SeverityError
+			}
+			if !parseError {
+				t.Errorf("%s %q: expected an error diagnostic, got %v", lang, query, diagnostics)
+			}
+		}
+	}
+}
+
+func TestLintParsePanics(t *testing.T) {
+	compiler, _, err := Languages.Parser("pubmed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{"", "(", `"`, "((a"} {
+		if _, err := lintParse(compiler, query); err == nil {
+			t.Errorf("%q: expected a parse error", query)
+		}
+	}
+}
+
+func TestLintDiagnostics(t *testing.T) {
+	tests := []struct {
+		name, lang, query string
+		expected          []Diagnostic
+	}{
+		{"clean", "pubmed", "heart[tiab] OR cardiac[tiab]", nil},
+		{"unknown pubmed field", "pubmed", "heart[tiab] AND attack[xx]", []Diagnostic{
+			{1, 24, SeverityWarning, `unknown field "xx" will be searched as all fields`},
+		}},
+		{"field modifier", "pubmed", "heart[mh:noexp]", nil},
+		{"unknown medline field", "medline", "1. heart.tw,zz.", []Diagnostic{
+			{1, 10, SeverityWarning, `unknown field "zz" will be searched as all fields`},
+		}},
+		{"history reference", "pubmed", "#1 AND heart[tiab]", []Diagnostic{
+			{1, 1, SeverityError, "search history reference #1 cannot be resolved in a single query"},
+		}},
+		{"forward line reference", "medline", "1. heart.tw.\n2. or/1-3\n3. lung.tw.", []Diagnostic{
+			{2, 1, SeverityError, "line 2 refers to line 3, which does not precede it"},
+			{2, 1, SeverityError, "unable to parse, found a possible recursive rule on line 2"},
+		}},
+		{"self line reference", "medline", "1. heart.tw.\n2. 1 and 2", []Diagnostic{
+			{2, 1, SeverityError, "line 2 refers to line 2, which does not precede it"},
+			{2, 1, SeverityError, "unable to parse, found a possible recursive rule on line 2"},
+		}},
+		{"short truncation", "pubmed", "ca*[tiab] AND heart[tiab]", []Diagnostic{
+			{1, 1, SeverityWarning, `truncating the short stem "ca" will match a very large number of words`},
+		}},
+		{"long truncation", "pubmed", "cardi*[tiab]", nil},
+		{"duplicate keyword", "pubmed", "heart[tiab] OR heart[tiab]", []Diagnostic{
+			{1, 16, SeverityWarning, `"heart[tiab]" appears more than once in the same OR clause`},
+		}},
+		{"duplicate keyword in group", "pubmed", "(heart[tiab] OR cardiac[tiab] OR Heart[tiab]) AND lung[tiab]", []Diagnostic{
+			{1, 34, SeverityWarning, `"Heart[tiab]" appears more than once in the same OR clause`},
+		}},
+		{"duplicate group", "pubmed", "(a[tiab] OR b[tiab]) AND (a[tiab] OR b[tiab])", []Diagnostic{
+			{1, 26, SeverityWarning, `"(a[tiab] OR b[tiab])" appears more than once in the same AND clause`},
+		}},
+		{"different operators", "pubmed", "heart[tiab] OR lung[tiab] AND heart[tiab]", nil},
+		{"operator in phrase", "pubmed", `"heart or lung"[tiab] OR "heart or lung"[tiab]`, []Diagnostic{
+			{1, 26, SeverityWarning, `"\"heart or lung\"[tiab]" appears more than once in the same OR clause`},
+		}},
+		{"duplicate medline keyword", "medline", "1. heart.tw. or heart.tw.", []Diagnostic{
+			{1, 17, SeverityWarning, `"heart.tw." appears more than once in the same OR clause`},
+		}},
+		{"duplicate medline line", "medline", "1. heart.tw.\n2. heart.tw.\n3. or/1-2", []Diagnostic{
+			{2, 1, SeverityWarning, "line 2 duplicates line 1"},
+		}},
+		{"duplicate embase keyword", "embase", "'heart'/exp OR 'heart'/exp", []Diagnostic{
+			{1, 16, SeverityWarning, `"'heart'/exp" appears more than once in the same OR clause`},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagnostics, err := Lint(tt.query, tt.lang)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(diagnostics, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, diagnostics)
+			}
+		})
+	}
+}
+
+func TestLintUnknownLanguage(t *testing.T) {
+	if _, err := Lint("heart", "cinahl"); err == nil {
+		t.Error("expected an unknown language to be an error")
+	}
+}
@@ -0,0 +1,382 @@
+package localindex
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/boltdb/bolt"
+	"github.com/hscells/guru"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// builderBatchSize is the number of citations buffered in memory before they are written to the index.
+const builderBatchSize = 50000
+
+// Article is a citation read from a PubMed baseline file, along with the fields that are only used for indexing.
+type Article struct {
+	guru.MedlineDocument
+	MajorMeSH []string
+	Journal   []string
+	Year      string
+	Language  []string
+	DOI       string
+}
+
+// markup is the text of an element that may contain inline markup such as <i> or <sup>.
+type markup struct {
+	Inner string `xml:",innerxml"`
+}
+
+func (m markup) String() string {
+	var b strings.Builder
+	d := xml.NewDecoder(strings.NewReader(m.Inner))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		if c, ok := tok.(xml.CharData); ok {
+			b.Write(c)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+type topic struct {
+	Value        string `xml:",chardata"`
+	MajorTopicYN string `xml:"MajorTopicYN,attr"`
+}
+
+type pubmedArticle struct {
+	MedlineCitation struct {
+		PMID          string `xml:"PMID"`
+		DateCompleted struct {
+			Year  string `xml:"Year"`
+			Month string `xml:"Month"`
+			Day   string `xml:"Day"`
+		} `xml:"DateCompleted"`
+		Article struct {
+			Journal struct {
+				Title           string `xml:"Title"`
+				ISOAbbreviation string `xml:"ISOAbbreviation"`
+				PubDate         struct {
+					Year        string `xml:"Year"`
+					MedlineDate string `xml:"MedlineDate"`
+				} `xml:"JournalIssue>PubDate"`
+			} `xml:"Journal"`
+			ArticleTitle markup   `xml:"ArticleTitle"`
+			AbstractText []markup `xml:"Abstract>AbstractText"`
+			Authors      []struct {
+				LastName       string `xml:"LastName"`
+				Initials       string `xml:"Initials"`
+				CollectiveName string `xml:"CollectiveName"`
+			} `xml:"AuthorList>Author"`
+			Language        []string `xml:"Language"`
+			PublicationType []string `xml:"PublicationTypeList>PublicationType"`
+		} `xml:"Article"`
+		MeshHeadings []struct {
+			DescriptorName topic   `xml:"DescriptorName"`
+			QualifierName  []topic `xml:"QualifierName"`
+		} `xml:"MeshHeadingList>MeshHeading"`
+	} `xml:"MedlineCitation"`
+	ArticleIDs []struct {
+		Value  string `xml:",chardata"`
+		IdType string `xml:"IdType,attr"`
+	} `xml:"PubmedData>ArticleIdList>ArticleId"`
+}
+
+func (p pubmedArticle) article() Article {
+	m := p.MedlineCitation
+	a := Article{}
+	a.PMID = strings.TrimSpace(m.PMID)
+	a.TI = m.Article.ArticleTitle.String()
+	abs := make([]string, len(m.Article.AbstractText))
+	for i, t := range m.Article.AbstractText {
+		abs[i] = t.String()
+	}
+	a.AB = strings.Join(abs, " ")
+	if len(m.DateCompleted.Year) > 0 {
+		a.DCOM = m.DateCompleted.Year + m.DateCompleted.Month + m.DateCompleted.Day
+	}
+	for _, au := range m.Article.Authors {
+		if len(au.CollectiveName) > 0 {
+			a.AU = append(a.AU, au.CollectiveName)
+		} else if len(au.LastName) > 0 {
+			a.AU = append(a.AU, strings.TrimSpace(au.LastName+" "+au.Initials))
+		}
+	}
+	a.PT = m.Article.PublicationType
+	for _, mh := range m.MeshHeadings {
+		a.MH = append(a.MH, mh.DescriptorName.Value)
+		major := mh.DescriptorName.MajorTopicYN == "Y"
+		for _, q := range mh.QualifierName {
+			major = major || q.MajorTopicYN == "Y"
+		}
+		if major {
+			a.MajorMeSH = append(a.MajorMeSH, mh.DescriptorName.Value)
+		}
+	}
+	for _, j := range []string{m.Article.Journal.Title, m.Article.Journal.ISOAbbreviation} {
+		if len(j) > 0 {
+			a.Journal = append(a.Journal, j)
+		}
+	}
+	a.Year = m.Article.Journal.PubDate.Year
+	if len(a.Year) == 0 {
+		a.Year = yearRegexp.FindString(m.Article.Journal.PubDate.MedlineDate)
+	}
+	a.Language = m.Article.Language
+	for _, id := range p.ArticleIDs {
+		if id.IdType == "doi" {
+			a.DOI = strings.TrimSpace(id.Value)
+		}
+	}
+	return a
+}
+
+// ReadBaseline reads the citations in a PubMed baseline XML file, calling fn for each of them.
+// Files may be gzipped, as they are distributed by the NLM.
+func ReadBaseline(r io.Reader, fn func(Article) error) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	d := xml.NewDecoder(br)
+	// Baseline files declare a DTD and may contain entities that the decoder does not know about.
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "PubmedArticle" {
+			continue
+		}
+		var p pubmedArticle
+		if err := d.DecodeElement(&p, &se); err != nil {
+			return err
+		}
+		a := p.article()
+		if len(a.PMID) == 0 {
+			continue
+		}
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+}
+
+// Builder creates or adds citations to a local index.
+type Builder struct {
+	db       *bolt.DB
+	docs     map[uint32][]byte
+	postings map[string][]uint32
+	// terms are the postings keys of each buffered citation, so that they can be replaced when it is revised.
+	terms map[uint32][]string
+}
+
+// NewBuilder opens an index for writing, creating it if it does not exist.
+func NewBuilder(path string) (*Builder, error) {
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{docsBucket, postingsBucket, metaBucket, termsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Builder{
+		db:       db,
+		docs:     make(map[uint32][]byte),
+		postings: make(map[string][]uint32),
+		terms:    make(map[uint32][]string),
+	}, nil
+}
+
+// Add indexes a citation, replacing it if it has already been indexed (e.g., because it has been revised in a later
+// baseline or update file). Citations are written to disk in batches.
+func (b *Builder) Add(a Article) error {
+	id, err := strconv.ParseUint(a.PMID, 10, 32)
+	if err != nil {
+		return err
+	}
+	pmid := uint32(id)
+	v, err := json.Marshal(a.MedlineDocument)
+	if err != nil {
+		return err
+	}
+	b.docs[pmid] = v
+
+	terms := make(map[string]struct{})
+	add := func(field, t string) {
+		if len(t) > 0 {
+			terms[string(postingsKey(field, t))] = struct{}{}
+		}
+	}
+	for _, t := range tokenise(a.TI) {
+		add(fieldTitle, t)
+	}
+	for _, t := range tokenise(a.AB) {
+		add(fieldAbstract, t)
+	}
+	for _, v := range a.MH {
+		add(fieldMeSH, normalise(v))
+	}
+	for _, v := range a.MajorMeSH {
+		add(fieldMajorMeSH, normalise(v))
+	}
+	for _, v := range a.PT {
+		add(fieldPubType, normalise(v))
+	}
+	for _, v := range a.AU {
+		add(fieldAuthor, normalise(v))
+	}
+	for _, v := range a.Journal {
+		add(fieldJournal, normalise(v))
+	}
+	for _, v := range a.Language {
+		add(fieldLanguage, normalise(v))
+	}
+	add(fieldYear, a.Year)
+	add(fieldPMID, a.PMID)
+	add(fieldDOI, normalise(a.DOI))
+	// A citation that was revised within the batch no longer has the terms of its earlier revision.
+	for _, k := range b.terms[pmid] {
+		b.postings[k] = remove(b.postings[k], pmid)
+	}
+	keys := make([]string, 0, len(terms))
+	for k := range terms {
+		b.postings[k] = append(b.postings[k], pmid)
+		keys = append(keys, k)
+	}
+	b.terms[pmid] = keys
+
+	if len(b.docs) >= builderBatchSize {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush writes the buffered citations to disk, merging them into the existing postings lists.
+func (b *Builder) Flush() error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		docs := tx.Bucket(docsBucket)
+		meta := tx.Bucket(metaBucket)
+		var n uint64
+		if v := meta.Get(metaSize); v != nil {
+			n = binary.BigEndian.Uint64(v)
+		}
+		postings := tx.Bucket(postingsBucket)
+		terms := tx.Bucket(termsBucket)
+		for pmid, v := range b.docs {
+			k := pmidKey(pmid)
+			if docs.Get(k) == nil {
+				n++
+			}
+			if err := docs.Put(k, v); err != nil {
+				return err
+			}
+			// Remove a citation that was indexed by an earlier batch from the postings of the terms it no longer has.
+			if old := terms.Get(k); old != nil {
+				current := make(map[string]bool, len(b.terms[pmid]))
+				for _, t := range b.terms[pmid] {
+					current[t] = true
+				}
+				for _, t := range strings.Split(string(old), "\n") {
+					if current[t] {
+						continue
+					}
+					p := remove(decodePostings(postings.Get([]byte(t))), pmid)
+					var err error
+					if len(p) == 0 {
+						err = postings.Delete([]byte(t))
+					} else {
+						err = postings.Put([]byte(t), encodePostings(p))
+					}
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if err := terms.Put(k, []byte(strings.Join(b.terms[pmid], "\n"))); err != nil {
+				return err
+			}
+		}
+		nb := make([]byte, 8)
+		binary.BigEndian.PutUint64(nb, n)
+		if err := meta.Put(metaSize, nb); err != nil {
+			return err
+		}
+
+		for k, p := range b.postings {
+			sort.Slice(p, func(i, j int) bool {
+				return p[i] < p[j]
+			})
+			// A citation may appear more than once in a batch if it has been revised.
+			uniq := p[:0]
+			for i, v := range p {
+				if i == 0 || v != p[i-1] {
+					uniq = append(uniq, v)
+				}
+			}
+			p = uniq
+			if v := postings.Get([]byte(k)); v != nil {
+				p = union(decodePostings(v), p)
+			}
+			if err := postings.Put([]byte(k), encodePostings(p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.docs = make(map[uint32][]byte)
+	b.postings = make(map[string][]uint32)
+	b.terms = make(map[uint32][]string)
+	return nil
+}
+
+// remove removes a PMID from a postings list.
+func remove(p []uint32, pmid uint32) []uint32 {
+	out := p[:0]
+	for _, v := range p {
+		if v != pmid {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Close flushes any buffered citations and closes the index.
+func (b *Builder) Close() error {
+	if err := b.Flush(); err != nil {
+		b.db.Close()
+		return err
+	}
+	return b.db.Close()
+}
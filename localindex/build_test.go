@@ -0,0 +1,70 @@
+package localindex
+
+import (
+	"github.com/hscells/cqr"
+	"github.com/hscells/groove/stats"
+	"github.com/hscells/transmute/fields"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuilderReplacesRevisedArticles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	add := func(articles ...Article) {
+		b, err := NewBuilder(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range articles {
+			if err := b.Add(a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	search := func(q string) []int {
+		i, err := Open(path, stats.SearchOptions{Size: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer i.Close()
+		pmids, err := i.Search(cqr.NewKeyword(q, fields.Title), 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pmids
+	}
+
+	// Revised within a batch.
+	add(article("1", "heart attack"), article("2", "heart failure"), article("1", "cardiac arrest"))
+	if got := search("attack"); len(got) != 0 {
+		t.Errorf("expected the earlier revision to be replaced within a batch, got %v", got)
+	}
+	if got := search("cardiac"); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("got %v, want [1]", got)
+	}
+
+	// Revised by a later batch.
+	add(article("2", "stroke"))
+	if got := search("failure"); len(got) != 0 {
+		t.Errorf("expected the earlier revision to be replaced by a later batch, got %v", got)
+	}
+	if got := search("heart"); len(got) != 0 {
+		t.Errorf("expected no citations to be about the heart any more, got %v", got)
+	}
+	if got := search("stroke"); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("got %v, want [2]", got)
+	}
+
+	i, err := Open(path, stats.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	if n, _ := i.CollectionSize(); n != 2 {
+		t.Errorf("expected 2 citations, got %f", n)
+	}
+}
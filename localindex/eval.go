@@ -0,0 +1,253 @@
+package localindex
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/hscells/cqr"
+	"github.com/hscells/transmute/fields"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Index fields. Text fields are tokenised into words, while the other fields index each value as a single term.
+const (
+	fieldTitle     = "ti"
+	fieldAbstract  = "ab"
+	fieldMeSH      = "mh"
+	fieldMajorMeSH = "mj"
+	fieldPubType   = "pt"
+	fieldAuthor    = "au"
+	fieldJournal   = "ta"
+	fieldYear      = "dp"
+	fieldLanguage  = "la"
+	fieldPMID      = "pmid"
+	fieldDOI       = "doi"
+)
+
+var textFields = map[string]bool{fieldTitle: true, fieldAbstract: true}
+
+// allFields are searched for keywords without a field, or with a field that is not indexed. As in PubMed, this
+// includes identifiers, dates and languages, since the query parsers do not recognise every field tag.
+var allFields = []string{fieldTitle, fieldAbstract, fieldMeSH, fieldPubType, fieldAuthor, fieldJournal, fieldYear, fieldLanguage, fieldPMID, fieldDOI}
+
+// fieldMapping maps the fields of a common query representation keyword to fields in the index.
+var fieldMapping = map[string][]string{
+	fields.Title:                 {fieldTitle},
+	fields.TransliteratedTitle:   {fieldTitle},
+	fields.Abstract:              {fieldAbstract},
+	fields.TitleAbstract:         {fieldTitle, fieldAbstract},
+	fields.TextWord:              {fieldTitle, fieldAbstract, fieldMeSH, fieldPubType},
+	fields.AllFields:             allFields,
+	fields.MeshHeadings:          {fieldMeSH},
+	fields.MeSHTerms:             {fieldMeSH},
+	fields.FloatingMeshHeadings:  {fieldMeSH},
+	fields.MeSHSubheading:        {fieldMeSH},
+	fields.MajorFocusMeshHeading: {fieldMajorMeSH},
+	fields.MeSHMajorTopic:        {fieldMajorMeSH},
+	fields.PublicationType:       {fieldPubType},
+	fields.Author:                {fieldAuthor},
+	fields.Authors:               {fieldAuthor},
+	fields.AuthorFull:            {fieldAuthor},
+	fields.AuthorLast:            {fieldAuthor},
+	fields.AuthorFirst:           {fieldAuthor},
+	fields.Journal:               {fieldJournal},
+	fields.PublicationDate:       {fieldYear},
+	fields.DatePublication:       {fieldYear},
+	fields.Language:              {fieldLanguage},
+	fields.PMID:                  {fieldPMID},
+	fields.LocationID:            {fieldDOI},
+}
+
+// mapField returns the index fields for a query field; fields that cannot be searched locally search all fields.
+func mapField(field string) []string {
+	if f, ok := fieldMapping[field]; ok {
+		return f
+	}
+	return allFields
+}
+
+// tokenise splits text into lowercase words.
+func tokenise(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '*'
+	})
+}
+
+// normalise prepares a whole field value to be indexed or searched as a single term.
+func normalise(s string) string {
+	return strings.Join(tokenise(s), " ")
+}
+
+var yearRegexp = regexp.MustCompile(`[0-9]{4}`)
+
+// years expands a publication date, or a range of dates such as "2000/01/01:2010/12/31", into years.
+func years(s string) []string {
+	parts := strings.SplitN(s, ":", 2)
+	from := yearRegexp.FindString(parts[0])
+	if len(from) == 0 {
+		return nil
+	}
+	if len(parts) == 1 {
+		return []string{from}
+	}
+	to := yearRegexp.FindString(parts[1])
+	f, _ := strconv.Atoi(from)
+	t, err := strconv.Atoi(to)
+	if err != nil || t < f {
+		// An open ended range goes up to the present.
+		t = 3000
+	}
+	var ys []string
+	for y := f; y <= t; y++ {
+		ys = append(ys, strconv.Itoa(y))
+	}
+	return ys
+}
+
+// term finds the documents matching a single term (which may be truncated) in an index field.
+func (i *Index) term(tx *bolt.Tx, field, t string) []uint32 {
+	if strings.HasSuffix(t, "*") {
+		return i.prefix(tx, field, strings.TrimRight(t, "*"))
+	}
+	return i.postings(tx, field, t)
+}
+
+// keyword finds the documents matching a keyword in a single index field.
+func (i *Index) keyword(tx *bolt.Tx, field, qs string) []uint32 {
+	switch field {
+	case fieldTitle, fieldAbstract:
+		tokens := tokenise(qs)
+		if len(tokens) == 0 {
+			return nil
+		}
+		lists := make([][]uint32, len(tokens))
+		for j, t := range tokens {
+			lists[j] = i.term(tx, field, t)
+		}
+		return intersect(lists...)
+	case fieldYear:
+		var lists [][]uint32
+		for _, y := range years(qs) {
+			lists = append(lists, i.postings(tx, field, y))
+		}
+		return union(lists...)
+	case fieldAuthor:
+		// Authors are searched by prefix so that "smith j" also matches "smith ja".
+		return i.prefix(tx, field, strings.TrimRight(normalise(qs), "*"))
+	default:
+		t := normalise(qs)
+		if strings.HasSuffix(strings.TrimSpace(qs), "*") {
+			t += "*"
+		}
+		return i.term(tx, field, t)
+	}
+}
+
+// eval finds the documents matching a query, in ascending order of PMID.
+func (i *Index) eval(tx *bolt.Tx, query cqr.CommonQueryRepresentation) []uint32 {
+	switch q := query.(type) {
+	case cqr.Keyword:
+		qs := strings.Trim(strings.TrimSpace(q.QueryString), `"`)
+		var indexFields []string
+		seen := make(map[string]bool)
+		for _, f := range q.Fields {
+			for _, m := range mapField(f) {
+				if !seen[m] {
+					seen[m] = true
+					indexFields = append(indexFields, m)
+				}
+			}
+		}
+		if len(indexFields) == 0 {
+			indexFields = allFields
+		}
+		lists := make([][]uint32, len(indexFields))
+		for j, f := range indexFields {
+			lists[j] = i.keyword(tx, f, qs)
+		}
+		return union(lists...)
+	case cqr.BooleanQuery:
+		lists := make([][]uint32, len(q.Children))
+		for j, child := range q.Children {
+			lists[j] = i.eval(tx, child)
+		}
+		switch op := strings.ToLower(q.Operator); {
+		case op == cqr.OR:
+			return union(lists...)
+		case op == cqr.NOT:
+			if len(lists) == 0 {
+				return nil
+			}
+			return difference(lists[0], union(lists[1:]...))
+		default:
+			// AND, and adjacency operators, which cannot be evaluated without term positions.
+			return intersect(lists...)
+		}
+	}
+	return nil
+}
+
+func intersect(lists ...[]uint32) []uint32 {
+	if len(lists) == 0 {
+		return nil
+	}
+	r := lists[0]
+	for _, l := range lists[1:] {
+		var out []uint32
+		a, b := 0, 0
+		for a < len(r) && b < len(l) {
+			switch {
+			case r[a] < l[b]:
+				a++
+			case r[a] > l[b]:
+				b++
+			default:
+				out = append(out, r[a])
+				a++
+				b++
+			}
+		}
+		r = out
+	}
+	return r
+}
+
+func union(lists ...[]uint32) []uint32 {
+	var r []uint32
+	for _, l := range lists {
+		out := make([]uint32, 0, len(r)+len(l))
+		a, b := 0, 0
+		for a < len(r) || b < len(l) {
+			switch {
+			case b >= len(l) || (a < len(r) && r[a] < l[b]):
+				out = append(out, r[a])
+				a++
+			case a >= len(r) || l[b] < r[a]:
+				out = append(out, l[b])
+				b++
+			default:
+				out = append(out, r[a])
+				a++
+				b++
+			}
+		}
+		r = out
+	}
+	return r
+}
+
+func difference(a, b []uint32) []uint32 {
+	var out []uint32
+	j := 0
+	for _, v := range a {
+		for j < len(b) && b[j] < v {
+			j++
+		}
+		if j < len(b) && b[j] == v {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
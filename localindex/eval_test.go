@@ -0,0 +1,158 @@
+package localindex
+
+import (
+	"github.com/hscells/cqr"
+	"github.com/hscells/groove/stats"
+	"github.com/hscells/guru"
+	"github.com/hscells/transmute/fields"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIntersect(t *testing.T) {
+	tests := []struct {
+		lists [][]uint32
+		want  []uint32
+	}{
+		{nil, nil},
+		{[][]uint32{{1, 2, 3}}, []uint32{1, 2, 3}},
+		{[][]uint32{{1, 2, 3}, {2, 3, 4}}, []uint32{2, 3}},
+		{[][]uint32{{1, 2, 3}, {2, 3, 4}, {3, 5}}, []uint32{3}},
+		{[][]uint32{{1, 2}, {3, 4}}, nil},
+		{[][]uint32{{1, 2}, nil}, nil},
+	}
+	for _, test := range tests {
+		if got := intersect(test.lists...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("intersect(%v) = %v, want %v", test.lists, got, test.want)
+		}
+	}
+}
+
+func TestUnion(t *testing.T) {
+	tests := []struct {
+		lists [][]uint32
+		want  []uint32
+	}{
+		{nil, nil},
+		{[][]uint32{{1, 3}}, []uint32{1, 3}},
+		{[][]uint32{{1, 3}, {2, 3, 4}}, []uint32{1, 2, 3, 4}},
+		{[][]uint32{{5}, {1}, {3}}, []uint32{1, 3, 5}},
+		{[][]uint32{nil, {1, 2}}, []uint32{1, 2}},
+	}
+	for _, test := range tests {
+		got := union(test.lists...)
+		if len(got) == 0 && len(test.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("union(%v) = %v, want %v", test.lists, got, test.want)
+		}
+	}
+}
+
+func TestDifference(t *testing.T) {
+	tests := []struct {
+		a, b []uint32
+		want []uint32
+	}{
+		{[]uint32{1, 2, 3}, nil, []uint32{1, 2, 3}},
+		{[]uint32{1, 2, 3}, []uint32{2}, []uint32{1, 3}},
+		{[]uint32{1, 2, 3}, []uint32{0, 1, 2, 3, 4}, nil},
+		{nil, []uint32{1}, nil},
+		{[]uint32{2, 4, 6}, []uint32{1, 3, 5, 6}, []uint32{2, 4}},
+	}
+	for _, test := range tests {
+		if got := difference(test.a, test.b); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("difference(%v, %v) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// testIndex builds an index of articles in a temporary directory.
+func testIndex(t *testing.T, articles ...Article) *Index {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "index.db")
+	b, err := NewBuilder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range articles {
+		if err := b.Add(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	i, err := Open(path, stats.SearchOptions{Size: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { i.Close() })
+	return i
+}
+
+func article(pmid, title string, mesh ...string) Article {
+	return Article{MedlineDocument: guru.MedlineDocument{PMID: pmid, TI: title, MH: mesh}}
+}
+
+var testArticles = []Article{
+	article("1", "Statins for heart disease", "Heart Diseases"),
+	article("2", "Statin therapy in children"),
+	article("3", "Heart failure in adults", "Heart Failure"),
+	article("4", "Exercise and heart health"),
+}
+
+func TestEval(t *testing.T) {
+	i := testIndex(t, testArticles...)
+	kw := func(q string, f ...string) cqr.CommonQueryRepresentation {
+		return cqr.NewKeyword(q, f...)
+	}
+	bq := func(op string, children ...cqr.CommonQueryRepresentation) cqr.CommonQueryRepresentation {
+		return cqr.NewBooleanQuery(op, children)
+	}
+	tests := []struct {
+		name  string
+		query cqr.CommonQueryRepresentation
+		want  []int
+	}{
+		{"keyword", kw("heart", fields.Title), []int{4, 3, 1}},
+		{"truncation", kw("statin*", fields.Title), []int{2, 1}},
+		{"phrase", kw("heart failure", fields.Title), []int{3}},
+		{"mesh", kw("heart failure", fields.MeshHeadings), []int{3}},
+		{"and", bq(cqr.AND, kw("heart", fields.Title), kw("statin*", fields.Title)), []int{1}},
+		{"or", bq(cqr.OR, kw("children", fields.Title), kw("adults", fields.Title)), []int{3, 2}},
+		{"not", bq(cqr.NOT, kw("heart", fields.Title), kw("failure", fields.Title)), []int{4, 1}},
+		{"nested", bq(cqr.NOT, bq(cqr.OR, kw("statin*", fields.Title), kw("exercise", fields.Title)), kw("children", fields.Title)), []int{4, 1}},
+		{"no match", kw("cancer", fields.Title), []int{}},
+	}
+	for _, test := range tests {
+		got, err := i.Search(test.query, 0, 100)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSearchStart(t *testing.T) {
+	i := testIndex(t, testArticles...)
+	q := cqr.NewKeyword("heart", fields.Title)
+	got, err := i.Search(q, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []int{3, 1}) {
+		t.Errorf("got %v, want [3 1]", got)
+	}
+	if got, err := i.Search(q, 10, 100); err != nil || len(got) != 0 {
+		t.Errorf("expected no results past the end, got %v (%v)", got, err)
+	}
+	if _, err := i.Search(q, -5, 100); err == nil {
+		t.Error("expected a negative start to be rejected")
+	}
+}
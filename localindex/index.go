@@ -0,0 +1,306 @@
+// Package localindex is an on-disk Boolean index of PubMed citations, built from the PubMed baseline XML files.
+// It allows searchrefiner to run without access to the NCBI E-utilities.
+//
+// The index is a bolt database. Citations are stored as MEDLINE documents keyed by PMID, and each indexed field
+// has postings lists (sorted PMIDs) keyed by the field and term. The terms of each citation are also kept, so that
+// a citation that is indexed again replaces its earlier revision. Term positions are not stored, so phrases are
+// matched as all of their words appearing in the same field, and adjacency operators are treated as AND.
+package localindex
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/hscells/cqr"
+	"github.com/hscells/groove/pipeline"
+	"github.com/hscells/groove/stats"
+	"github.com/hscells/guru"
+	"github.com/hscells/trecresults"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	docsBucket     = []byte("docs")
+	postingsBucket = []byte("postings")
+	metaBucket     = []byte("meta")
+	termsBucket    = []byte("terms")
+	metaSize       = []byte("n")
+)
+
+// Index is a read-only local index of PubMed citations. It implements stats.StatisticsSource so that it can be
+// used anywhere an Entrez statistics source is used.
+type Index struct {
+	db      *bolt.DB
+	n       float64
+	options stats.SearchOptions
+}
+
+// Open opens an index that has been built with a Builder.
+func Open(path string, options stats.SearchOptions) (*Index, error) {
+	db, err := bolt.Open(path, 0444, &bolt.Options{ReadOnly: true, Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	i := &Index{db: db, options: options}
+	err = db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(metaBucket); b != nil {
+			if v := b.Get(metaSize); v != nil {
+				i.n = float64(binary.BigEndian.Uint64(v))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return i, nil
+}
+
+// Close closes the underlying database.
+func (i *Index) Close() error {
+	return i.db.Close()
+}
+
+func pmidKey(pmid uint32) []byte {
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, pmid)
+	return k
+}
+
+func postingsKey(field, term string) []byte {
+	return []byte(field + "\x00" + term)
+}
+
+func encodePostings(p []uint32) []byte {
+	b := make([]byte, 0, len(p)*2)
+	buf := make([]byte, binary.MaxVarintLen32)
+	var last uint32
+	for _, id := range p {
+		n := binary.PutUvarint(buf, uint64(id-last))
+		b = append(b, buf[:n]...)
+		last = id
+	}
+	return b
+}
+
+func decodePostings(b []byte) []uint32 {
+	var (
+		p    []uint32
+		last uint32
+	)
+	for len(b) > 0 {
+		d, n := binary.Uvarint(b)
+		if n <= 0 {
+			break
+		}
+		last += uint32(d)
+		p = append(p, last)
+		b = b[n:]
+	}
+	return p
+}
+
+// postings returns the postings list of a term in a field.
+func (i *Index) postings(tx *bolt.Tx, field, term string) []uint32 {
+	b := tx.Bucket(postingsBucket)
+	if b == nil {
+		return nil
+	}
+	return decodePostings(b.Get(postingsKey(field, term)))
+}
+
+// prefix returns the union of the postings lists of every term in a field that starts with prefix.
+func (i *Index) prefix(tx *bolt.Tx, field, prefix string) []uint32 {
+	b := tx.Bucket(postingsBucket)
+	if b == nil {
+		return nil
+	}
+	var lists [][]uint32
+	p := postingsKey(field, prefix)
+	c := b.Cursor()
+	for k, v := c.Seek(p); k != nil && strings.HasPrefix(string(k), string(p)); k, v = c.Next() {
+		lists = append(lists, decodePostings(v))
+	}
+	return union(lists...)
+}
+
+// Search returns the PMIDs of citations matching the query, most recent (highest PMID) first.
+func (i *Index) Search(query cqr.CommonQueryRepresentation, start, size int) ([]int, error) {
+	if start < 0 {
+		return nil, fmt.Errorf("invalid start %d", start)
+	}
+	var docs []uint32
+	err := i.db.View(func(tx *bolt.Tx) error {
+		docs = i.eval(tx, query)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pmids := make([]int, 0, size)
+	for j := len(docs) - 1 - start; j >= 0 && len(pmids) < size; j-- {
+		pmids = append(pmids, int(docs[j]))
+	}
+	return pmids, nil
+}
+
+// Fetch returns the citations for the PMIDs. PMIDs that are not in the index are skipped.
+func (i *Index) Fetch(pmids []int) ([]guru.MedlineDocument, error) {
+	docs := make([]guru.MedlineDocument, 0, len(pmids))
+	err := i.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(docsBucket)
+		if b == nil {
+			return nil
+		}
+		for _, pmid := range pmids {
+			v := b.Get(pmidKey(uint32(pmid)))
+			if v == nil {
+				continue
+			}
+			var d guru.MedlineDocument
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			docs = append(docs, d)
+		}
+		return nil
+	})
+	return docs, err
+}
+
+func (i *Index) SearchOptions() stats.SearchOptions {
+	return i.options
+}
+
+func (i *Index) Parameters() map[string]float64 {
+	return map[string]float64{}
+}
+
+// TermFrequency counts the occurrences of a term in the title and abstract of a document.
+func (i *Index) TermFrequency(term, field, document string) (float64, error) {
+	v, err := i.TermVector(document)
+	if err != nil {
+		return 0, err
+	}
+	term = strings.ToLower(term)
+	for _, t := range v {
+		if t.Term == term {
+			return t.TermFrequency, nil
+		}
+	}
+	return 0, nil
+}
+
+// TermVector returns the terms in the title and abstract of a document.
+func (i *Index) TermVector(document string) (stats.TermVector, error) {
+	pmid, err := strconv.Atoi(document)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := i.Fetch([]int{pmid})
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	tf := make(map[string]float64)
+	var order []string
+	for _, t := range tokenise(docs[0].TI + " " + docs[0].AB) {
+		if _, ok := tf[t]; !ok {
+			order = append(order, t)
+		}
+		tf[t]++
+	}
+	var v stats.TermVector
+	err = i.db.View(func(tx *bolt.Tx) error {
+		for _, t := range order {
+			df := float64(len(union(i.postings(tx, "ti", t), i.postings(tx, "ab", t))))
+			v = append(v, stats.TermVectorTerm{
+				DocumentFrequency:  df,
+				TotalTermFrequency: df,
+				TermFrequency:      tf[t],
+				Field:              "text",
+				Term:               t,
+			})
+		}
+		return nil
+	})
+	return v, err
+}
+
+// DocumentFrequency is the number of documents a term appears in for a field.
+func (i *Index) DocumentFrequency(term, field string) (float64, error) {
+	n, err := i.RetrievalSize(cqr.NewKeyword(term, field))
+	return n, err
+}
+
+// TotalTermFrequency is approximated by the document frequency, as term frequencies are not indexed.
+func (i *Index) TotalTermFrequency(term, field string) (float64, error) {
+	return i.DocumentFrequency(term, field)
+}
+
+func (i *Index) InverseDocumentFrequency(term, field string) (float64, error) {
+	nt, err := i.DocumentFrequency(term, field)
+	if err != nil {
+		return 0, err
+	}
+	return math.Log((i.n + 1) / (nt + 1)), nil
+}
+
+func (i *Index) RetrievalSize(query cqr.CommonQueryRepresentation) (float64, error) {
+	var n float64
+	err := i.db.View(func(tx *bolt.Tx) error {
+		n = float64(len(i.eval(tx, query)))
+		return nil
+	})
+	return n, err
+}
+
+// VocabularySize is the number of distinct terms indexed for a field.
+func (i *Index) VocabularySize(field string) (float64, error) {
+	var n float64
+	err := i.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(postingsBucket)
+		if b == nil {
+			return nil
+		}
+		for _, f := range mapField(field) {
+			p := []byte(f + "\x00")
+			c := b.Cursor()
+			for k, _ := c.Seek(p); k != nil && strings.HasPrefix(string(k), string(p)); k, _ = c.Next() {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (i *Index) Execute(query pipeline.Query, options stats.SearchOptions) (trecresults.ResultList, error) {
+	size := options.Size
+	if size <= 0 {
+		size = math.MaxInt32
+	}
+	pmids, err := i.Search(query.Query, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	r := make(trecresults.ResultList, len(pmids))
+	for j, pmid := range pmids {
+		r[j] = &trecresults.Result{
+			Topic:   query.Topic,
+			DocId:   strconv.Itoa(pmid),
+			Rank:    int64(j + 1),
+			Score:   float64(len(pmids) - j),
+			RunName: options.RunName,
+		}
+	}
+	return r, nil
+}
+
+func (i *Index) CollectionSize() (float64, error) {
+	return i.n, nil
+}
@@ -0,0 +1,95 @@
+package localindex
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// medlineTag splits a line of a MEDLINE formatted record into its tag and value. Continuation lines have no tag.
+func medlineTag(line string) (string, string, bool) {
+	if len(line) < 6 || line[4] != '-' {
+		return "", strings.TrimSpace(line), false
+	}
+	return strings.TrimSpace(line[:4]), strings.TrimSpace(line[5:]), true
+}
+
+// medlineArticle creates an article from the tags of a MEDLINE formatted record.
+func medlineArticle(tags [][2]string) Article {
+	var a Article
+	for _, t := range tags {
+		v := t[1]
+		switch t[0] {
+		case "PMID":
+			a.PMID = v
+		case "TI":
+			a.TI = v
+		case "AB":
+			a.AB = v
+		case "DCOM":
+			a.DCOM = v
+		case "AU", "CN":
+			a.AU = append(a.AU, v)
+		case "PT":
+			a.PT = append(a.PT, v)
+		case "MH":
+			// Headings are written as "Descriptor/qualifier", with major topics marked by an asterisk.
+			d := strings.TrimPrefix(strings.SplitN(v, "/", 2)[0], "*")
+			a.MH = append(a.MH, d)
+			if strings.Contains(v, "*") {
+				a.MajorMeSH = append(a.MajorMeSH, d)
+			}
+		case "TA", "JT":
+			a.Journal = append(a.Journal, v)
+		case "DP":
+			a.Year = yearRegexp.FindString(v)
+		case "LA":
+			a.Language = append(a.Language, v)
+		case "LID", "AID":
+			if strings.HasSuffix(v, "[doi]") && len(a.DOI) == 0 {
+				a.DOI = strings.TrimSpace(strings.TrimSuffix(v, "[doi]"))
+			}
+		}
+	}
+	return a
+}
+
+// ReadMedline reads the citations in a MEDLINE formatted file, such as those downloaded from PubMed,
+// calling fn for each of them.
+func ReadMedline(r io.Reader, fn func(Article) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 1024*1024), 10*1024*1024)
+	var tags [][2]string
+	end := func() error {
+		if len(tags) == 0 {
+			return nil
+		}
+		a := medlineArticle(tags)
+		tags = nil
+		if len(a.PMID) == 0 {
+			return nil
+		}
+		return fn(a)
+	}
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if len(strings.TrimSpace(line)) == 0 {
+			if err := end(); err != nil {
+				return err
+			}
+			continue
+		}
+		t, v, ok := medlineTag(line)
+		if !ok {
+			if len(tags) > 0 {
+				tags[len(tags)-1][1] += " " + v
+			}
+			continue
+		}
+		tags = append(tags, [2]string{t, v})
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return end()
+}
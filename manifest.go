@@ -0,0 +1,282 @@
+package searchrefiner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of searchrefiner, which plugins may require in their manifest.
+const Version = "1.1.0"
+
+// PluginManifestFile is the file in the directory of a plugin that describes it.
+const PluginManifestFile = "plugin.json"
+
+// Permissions that the manifest of a plugin may require.
+var pluginPermissions = map[string]PluginPermission{
+	"admin":  PluginAdmin,
+	"user":   PluginUser,
+	"public": PluginPublic,
+}
+
+// Types of the configuration options of a plugin.
+var pluginConfigTypes = map[string]bool{
+	"string":  true,
+	"number":  true,
+	"boolean": true,
+	"array":   true,
+	"object":  true,
+}
+
+// PluginConfigOption describes an option that a plugin may be configured with.
+type PluginConfigOption struct {
+	Type        string
+	Description string
+	Required    bool
+}
+
+// PluginManifest describes a plugin, and is read from the plugin.json file in its directory. Paths are relative to
+// the directory of the plugin.
+type PluginManifest struct {
+	// Name is the name of the plugin, which is the name of its directory and the path it is served at.
+	Name string
+	// Symbol is the variable exported by plugin.so that implements Plugin. Remote plugins do not have one.
+	Symbol  string
+	Version string
+	// Requires constrains the versions of searchrefiner that the plugin works with, e.g., ">=1.1.0, <2".
+	Requires string
+	// Permission is who may use the plugin: "admin", "user", or "public". When it is empty, the plugin is asked.
+	Permission string
+	// Templates are the templates the plugin shares with searchrefiner, and Static is the directory of files that
+	// are served under /plugin/<name>/static.
+	Templates []string
+	Static    string
+	Config    map[string]PluginConfigOption
+}
+
+// DisabledPlugin is a plugin that could not be loaded.
+type DisabledPlugin struct {
+	Name     string
+	Manifest PluginManifest
+	Error    string
+}
+
+// DefaultPluginManifest is the manifest of a plugin that does not have one, which follows the conventions plugins
+// were loaded with before manifests: the exported variable is the title-cased name of the plugin, templates are
+// named *.tmpl.html, and static files are in the static directory.
+func DefaultPluginManifest(dir string) (PluginManifest, error) {
+	name := filepath.Base(dir)
+	m := PluginManifest{Name: name}
+	if !IsRemotePlugin(dir) {
+		m.Symbol = strings.Title(name)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return m, err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			if f.Name() == "static" {
+				m.Static = f.Name()
+			}
+			continue
+		}
+		if strings.HasSuffix(f.Name(), ".tmpl.html") {
+			m.Templates = append(m.Templates, f.Name())
+		}
+	}
+	return m, nil
+}
+
+// LoadPluginManifest reads and validates the manifest of the plugin in dir, falling back to the default manifest
+// when the plugin does not have one.
+func LoadPluginManifest(dir string) (PluginManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, PluginManifestFile))
+	if os.IsNotExist(err) {
+		m, err := DefaultPluginManifest(dir)
+		if err != nil {
+			return m, err
+		}
+		return m, m.Validate(dir)
+	} else if err != nil {
+		return PluginManifest{Name: filepath.Base(dir)}, err
+	}
+	var m PluginManifest
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return PluginManifest{Name: filepath.Base(dir)}, fmt.Errorf("%s: %v", PluginManifestFile, err)
+	}
+	return m, m.Validate(dir)
+}
+
+// Validate checks that the plugin in dir can be loaded as its manifest describes.
+func (m PluginManifest) Validate(dir string) error {
+	if name := filepath.Base(dir); m.Name != name {
+		return fmt.Errorf("manifest is for %q, but the plugin is in %q", m.Name, name)
+	}
+	if len(m.Requires) > 0 {
+		ok, err := versionSatisfies(Version, m.Requires)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("requires searchrefiner %s, but this is %s", m.Requires, Version)
+		}
+	}
+	if _, ok := pluginPermissions[m.Permission]; !ok && len(m.Permission) > 0 {
+		return fmt.Errorf("unknown permission %q", m.Permission)
+	}
+	if !IsRemotePlugin(dir) {
+		if len(m.Symbol) == 0 {
+			return fmt.Errorf("manifest must name the symbol that plugin.so exports")
+		}
+		if _, err := os.Stat(filepath.Join(dir, "plugin.so")); err != nil {
+			return fmt.Errorf("neither plugin.so nor a %q executable could be found", RemotePluginExecutable)
+		}
+	}
+	for _, t := range m.Templates {
+		_, err := template.New(filepath.Base(t)).Funcs(template.FuncMap{"dict": TmplDict}).ParseFiles(filepath.Join(dir, t))
+		if err != nil {
+			return fmt.Errorf("template %s: %v", t, err)
+		}
+	}
+	if len(m.Static) > 0 {
+		info, err := os.Stat(filepath.Join(dir, m.Static))
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("static %s is not a directory", m.Static)
+		}
+	}
+	for option, c := range m.Config {
+		if !pluginConfigTypes[c.Type] {
+			return fmt.Errorf("config option %s has unknown type %q", option, c.Type)
+		}
+	}
+	return nil
+}
+
+// PermissionType is the permission required to use the plugin, when the manifest has one.
+func (m PluginManifest) PermissionType() (PluginPermission, bool) {
+	p, ok := pluginPermissions[m.Permission]
+	return p, ok
+}
+
+// parseVersion parses a version such as 1.2.3 into its numbers, where missing numbers are 0.
+func parseVersion(v string) ([3]int, error) {
+	var n [3]int
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(v), "v"), ".")
+	if len(parts) > 3 {
+		return n, fmt.Errorf("invalid version %q", v)
+	}
+	for i, p := range parts {
+		x, err := strconv.Atoi(p)
+		if err != nil || x < 0 {
+			return n, fmt.Errorf("invalid version %q", v)
+		}
+		n[i] = x
+	}
+	return n, nil
+}
+
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionSatisfies reports whether version satisfies every comma separated constraint, such as ">=1.1, <2".
+func versionSatisfies(version, constraints string) (bool, error) {
+	v, err := parseVersion(version)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range strings.Split(constraints, ",") {
+		c = strings.TrimSpace(c)
+		op := strings.TrimRight(c, "0123456789.v ")
+		w, err := parseVersion(c[len(op):])
+		if err != nil {
+			return false, fmt.Errorf("invalid version constraint %q", c)
+		}
+		cmp := compareVersions(v, w)
+		var ok bool
+		switch op {
+		case ">=":
+			ok = cmp >= 0
+		case ">":
+			ok = cmp > 0
+		case "<=":
+			ok = cmp <= 0
+		case "<":
+			ok = cmp < 0
+		case "=", "==", "":
+			ok = cmp == 0
+		default:
+			return false, fmt.Errorf("invalid version constraint %q", c)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// jsonType is the type of a JSON value, in the terms of the configuration options of a plugin.
+func jsonType(v json.RawMessage) string {
+	b := bytes.TrimSpace(v)
+	if len(b) == 0 {
+		return ""
+	}
+	switch b[0] {
+	case '"':
+		return "string"
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	}
+	return "number"
+}
+
+// ValidateConfig checks the configuration of a plugin against the options in its manifest.
+func (m PluginManifest) ValidateConfig(config json.RawMessage) error {
+	if len(m.Config) == 0 {
+		return nil
+	}
+	var options map[string]json.RawMessage
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &options); err != nil {
+			return fmt.Errorf("config: %v", err)
+		}
+	}
+	for name, o := range m.Config {
+		v, ok := options[name]
+		if !ok {
+			if o.Required {
+				return fmt.Errorf("config option %s is required", name)
+			}
+			continue
+		}
+		if t := jsonType(v); t != o.Type {
+			return fmt.Errorf("config option %s must be a %s, not a %s", name, o.Type, t)
+		}
+	}
+	return nil
+}
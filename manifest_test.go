@@ -0,0 +1,182 @@
+package searchrefiner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected [3]int
+		err      bool
+	}{
+		{"1.2.3", [3]int{1, 2, 3}, false},
+		{"1.1", [3]int{1, 1, 0}, false},
+		{" v2 ", [3]int{2, 0, 0}, false},
+		{"", [3]int{}, true},
+		{"1.2.3.4", [3]int{}, true},
+		{"1.x", [3]int{}, true},
+		{"1.-1", [3]int{}, true},
+	}
+	for _, tt := range tests {
+		v, err := parseVersion(tt.version)
+		if tt.err != (err != nil) {
+			t.Errorf("%q: expected an error: %v, got %v", tt.version, tt.err, err)
+			continue
+		}
+		if !tt.err && v != tt.expected {
+			t.Errorf("%q: expected %v, got %v", tt.version, tt.expected, v)
+		}
+	}
+}
+
+func TestVersionSatisfies(t *testing.T) {
+	tests := []struct {
+		version, constraints string
+		ok, err              bool
+	}{
+		{"1.1.0", ">=1.1.0, <2", true, false},
+		{"1.9.9", ">=1.1.0, <2", true, false},
+		{"1.0.9", ">=1.1.0, <2", false, false},
+		{"2.0.0", ">=1.1.0, <2", false, false},
+		{"1.1.0", ">= 1.1", true, false},
+		{"1.1.0", ">1.1", false, false},
+		{"1.1.0", "<=1.1.0", true, false},
+		{"1.1.0", "1.1", true, false},
+		{"1.1.0", "==1.1.0", true, false},
+		{"1.1.0", "=1.2", false, false},
+		{"1.1.0", "v1.1.0", true, false},
+		{"1.1.0", "~1.1", false, true},
+		{"1.1.0", ">=", false, true},
+		{"1.1.0", ">=1.x", false, true},
+		{"1.1.0", ">=1.1,", false, true},
+		{"1.1.0", "", false, true},
+		{"one", ">=1", false, true},
+	}
+	for _, tt := range tests {
+		ok, err := versionSatisfies(tt.version, tt.constraints)
+		if tt.err != (err != nil) {
+			t.Errorf("%s %q: expected an error: %v, got %v", tt.version, tt.constraints, tt.err, err)
+			continue
+		}
+		if ok != tt.ok {
+			t.Errorf("%s %q: expected %v, got %v", tt.version, tt.constraints, tt.ok, ok)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	m := PluginManifest{Config: map[string]PluginConfigOption{
+		"url":     {Type: "string", Required: true},
+		"limit":   {Type: "number"},
+		"enabled": {Type: "boolean"},
+		"tags":    {Type: "array"},
+	}}
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`{"url": "http://localhost", "limit": 10, "enabled": true, "tags": ["a"]}`, ""},
+		{`{"url": "http://localhost"}`, ""},
+		{`{"limit": 10}`, "config option url is required"},
+		{``, "config option url is required"},
+		{`{"url": 1}`, "config option url must be a string, not a number"},
+		{`{"url": "", "enabled": "yes"}`, "config option enabled must be a boolean, not a string"},
+		{`{"url": "", "limit": null}`, "config option limit must be a number, not a null"},
+		{`{"url": "", "tags": {}}`, "config option tags must be a array, not a object"},
+		{`["url"]`, "config: "},
+	}
+	for _, tt := range tests {
+		err := m.ValidateConfig(json.RawMessage(tt.config))
+		switch {
+		case len(tt.err) == 0 && err != nil:
+			t.Errorf("%s: expected the configuration to be valid, got %v", tt.config, err)
+		case len(tt.err) > 0 && (err == nil || !strings.HasPrefix(err.Error(), tt.err)):
+			t.Errorf("%s: expected %q, got %v", tt.config, tt.err, err)
+		}
+	}
+	if err := (PluginManifest{}).ValidateConfig(json.RawMessage(`{"anything": 1}`)); err != nil {
+		t.Errorf("expected a plugin without options to accept any configuration, got %v", err)
+	}
+}
+
+// pluginDir creates the directory of a plugin with the files in it. Files named "plugin" are executable, so
+// that the plugin is a remote plugin.
+func pluginDir(t *testing.T, name string, files map[string]string) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), name)
+	if err := os.MkdirAll(filepath.Join(dir, "static"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for f, contents := range files {
+		mode := os.FileMode(0644)
+		if f == RemotePluginExecutable {
+			mode = 0755
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(contents), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadPluginManifest(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{"valid", map[string]string{"plugin": "", "plugin.json": `{"Name": "valid", "Requires": ">=1.1.0, <2", "Permission": "user", "Templates": ["valid.tmpl.html"], "Static": "static", "Config": {"url": {"Type": "string", "Required": true}}}`, "valid.tmpl.html": `{{ define "valid" }}{{ end }}`}, ""},
+		{"mismatch", map[string]string{"plugin": "", "plugin.json": `{"Name": "other"}`}, `manifest is for "other", but the plugin is in "mismatch"`},
+		{"invalid", map[string]string{"plugin": "", "plugin.json": `{"Name": `}, "plugin.json: "},
+		{"future", map[string]string{"plugin": "", "plugin.json": `{"Name": "future", "Requires": ">=2"}`}, "requires searchrefiner >=2, but this is " + Version},
+		{"constraint", map[string]string{"plugin": "", "plugin.json": `{"Name": "constraint", "Requires": "~1"}`}, `invalid version constraint "~1"`},
+		{"permission", map[string]string{"plugin": "", "plugin.json": `{"Name": "permission", "Permission": "root"}`}, `unknown permission "root"`},
+		{"symbol", map[string]string{"plugin.so": "", "plugin.json": `{"Name": "symbol"}`}, "manifest must name the symbol that plugin.so exports"},
+		{"missing", map[string]string{"plugin.json": `{"Name": "missing", "Symbol": "Missing"}`}, `neither plugin.so nor a "plugin" executable could be found`},
+		{"template", map[string]string{"plugin": "", "plugin.json": `{"Name": "template", "Templates": ["bad.tmpl.html"]}`, "bad.tmpl.html": `{{ if }}`}, "template bad.tmpl.html: "},
+		{"static", map[string]string{"plugin": "", "plugin.json": `{"Name": "static", "Static": "plugin"}`}, "static plugin is not a directory"},
+		{"type", map[string]string{"plugin": "", "plugin.json": `{"Name": "type", "Config": {"url": {"Type": "url"}}}`}, `config option url has unknown type "url"`},
+	}
+	for _, tt := range tests {
+		m, err := LoadPluginManifest(pluginDir(t, tt.name, tt.files))
+		switch {
+		case len(tt.err) == 0 && err != nil:
+			t.Errorf("%s: expected the manifest to be valid, got %v", tt.name, err)
+		case len(tt.err) > 0 && (err == nil || !strings.HasPrefix(err.Error(), tt.err)):
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.err, err)
+		}
+		if m.Name != tt.name && tt.name != "mismatch" {
+			t.Errorf("%s: expected the manifest to be named after the plugin, got %q", tt.name, m.Name)
+		}
+	}
+}
+
+func TestDefaultPluginManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected PluginManifest
+	}{
+		{"remote", map[string]string{"plugin": "", "remote.tmpl.html": "", "notes.txt": ""},
+			PluginManifest{Name: "remote", Templates: []string{"remote.tmpl.html"}, Static: "static"}},
+		{"queryvis", map[string]string{"plugin.so": "", "a.tmpl.html": "", "b.tmpl.html": ""},
+			PluginManifest{Name: "queryvis", Symbol: "Queryvis", Templates: []string{"a.tmpl.html", "b.tmpl.html"}, Static: "static"}},
+	}
+	for _, tt := range tests {
+		m, err := LoadPluginManifest(pluginDir(t, tt.name, tt.files))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, tt.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.expected, m)
+		}
+	}
+}
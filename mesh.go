@@ -0,0 +1,126 @@
+package searchrefiner
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/cqr"
+	"github.com/hscells/groove/analysis"
+	"github.com/hscells/transmute/fields"
+	"github.com/ielab/searchrefiner/mesh"
+	"net/http"
+)
+
+var errMeSHNotLoaded = errors.New("the MeSH descriptor file has not been loaded")
+
+// meshFields are the fields that MeSH headings are searched with.
+var meshFields = []string{fields.MeshHeadings, fields.MeSHTerms, fields.MeSHMajorTopic, fields.MajorFocusMeshHeading, fields.FloatingMeshHeadings}
+
+// meshExplosion is a heading and the headings that exploding it covers.
+type meshExplosion struct {
+	Descriptor *mesh.Descriptor   `json:"descriptor"`
+	Covers     []*mesh.Descriptor `json:"covers"`
+}
+
+// ApiMeSHTree lists the nodes beneath the tree number in the "node" parameter, or the top-level headings
+// when it is empty.
+func (s Server) ApiMeSHTree(c *gin.Context) {
+	if s.MeSH == nil {
+		c.String(http.StatusServiceUnavailable, errMeSHNotLoaded.Error())
+		return
+	}
+	node := c.Query("node")
+	children, ok := s.MeSH.Children(node)
+	if !ok {
+		c.String(http.StatusNotFound, "no such tree number %s", node)
+		return
+	}
+	c.JSON(http.StatusOK, children)
+}
+
+// ApiMeSHEntry finds the headings that the term in the "term" parameter is a heading or entry term of.
+func (s Server) ApiMeSHEntry(c *gin.Context) {
+	if s.MeSH == nil {
+		c.String(http.StatusServiceUnavailable, errMeSHNotLoaded.Error())
+		return
+	}
+	term := c.Query("term")
+	if len(term) == 0 {
+		c.String(http.StatusBadRequest, "no term specified")
+		return
+	}
+	descriptors := s.MeSH.Lookup(term)
+	if descriptors == nil {
+		descriptors = []*mesh.Descriptor{}
+	}
+	c.JSON(http.StatusOK, descriptors)
+}
+
+// ApiMeSHExplode lists the headings that exploding the heading in the "term" parameter covers. Entry terms
+// are resolved to their headings, so more than one explosion may be returned.
+func (s Server) ApiMeSHExplode(c *gin.Context) {
+	if s.MeSH == nil {
+		c.String(http.StatusServiceUnavailable, errMeSHNotLoaded.Error())
+		return
+	}
+	term := c.Query("term")
+	if len(term) == 0 {
+		c.String(http.StatusBadRequest, "no term specified")
+		return
+	}
+	var descriptors []*mesh.Descriptor
+	if d, ok := s.MeSH.Heading(term); ok {
+		descriptors = []*mesh.Descriptor{d}
+	} else {
+		descriptors = s.MeSH.Lookup(term)
+	}
+	if len(descriptors) == 0 {
+		c.String(http.StatusNotFound, "no MeSH heading for %s", term)
+		return
+	}
+	explosions := make([]meshExplosion, len(descriptors))
+	for i, d := range descriptors {
+		explosions[i] = meshExplosion{Descriptor: d, Covers: s.MeSH.Explode(d)}
+	}
+	c.JSON(http.StatusOK, explosions)
+}
+
+// meshStatistics computes the number of exploded MeSH keywords in a query, and the average and maximum depth
+// of the MeSH keywords in the tree. Keywords that are not headings in the tree are not counted towards the depth.
+func (s Server) meshStatistics(repr cqr.CommonQueryRepresentation) (exploded, avgDepth, maxDepth float64) {
+	seen := make(map[string]bool)
+	var keywords []cqr.Keyword
+	for _, f := range meshFields {
+		for _, kw := range analysis.KeywordsWithField(repr, f) {
+			key := kw.String()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			keywords = append(keywords, kw)
+		}
+	}
+
+	var sum, n float64
+	for _, kw := range keywords {
+		if exp, ok := kw.Options[cqr.ExplodedString].(bool); ok && exp {
+			exploded++
+		}
+		if s.MeSH == nil {
+			continue
+		}
+		d, ok := s.MeSH.Heading(kw.QueryString)
+		if !ok {
+			continue
+		}
+		depth := float64(d.MaxDepth())
+		sum += depth
+		n++
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	if n > 0 {
+		avgDepth = sum / n
+	}
+	return
+}
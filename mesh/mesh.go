@@ -0,0 +1,229 @@
+// Package mesh loads the NLM MeSH descriptor file (desc20xx.xml) so that the MeSH tree can be browsed, entry terms
+// can be resolved to their headings, and the headings that an exploded heading covers can be listed.
+//
+// The descriptor file can be downloaded from https://www.nlm.nih.gov/databases/download/mesh.html.
+package mesh
+
+import (
+	"compress/gzip"
+	"encoding/xml"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Descriptor is a MeSH heading.
+type Descriptor struct {
+	UI          string   `json:"ui"`
+	Name        string   `json:"name"`
+	TreeNumbers []string `json:"tree_numbers"`
+	EntryTerms  []string `json:"entry_terms,omitempty"`
+}
+
+// Node is a position of a descriptor in the tree. A descriptor may appear at several positions.
+type Node struct {
+	TreeNumber  string `json:"tree_number"`
+	UI          string `json:"ui"`
+	Name        string `json:"name"`
+	Depth       int    `json:"depth"`
+	NumChildren int    `json:"num_children"`
+}
+
+// Tree is the MeSH tree.
+type Tree struct {
+	descriptors map[string]*Descriptor
+	// nodes maps tree numbers to descriptors.
+	nodes map[string]*Descriptor
+	// children maps tree numbers to the tree numbers directly beneath them; roots are stored under "".
+	children map[string][]string
+	// names maps lower-cased headings and entry terms to descriptors.
+	names map[string][]*Descriptor
+}
+
+type descriptorRecord struct {
+	UI          string   `xml:"DescriptorUI"`
+	Name        string   `xml:"DescriptorName>String"`
+	TreeNumbers []string `xml:"TreeNumberList>TreeNumber"`
+	Terms       []string `xml:"ConceptList>Concept>TermList>Term>String"`
+}
+
+// Load reads a descriptor file, which may be gzipped.
+func Load(path string) (*Tree, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return Read(r)
+}
+
+// Read reads the descriptor records of a descriptor file.
+func Read(r io.Reader) (*Tree, error) {
+	t := &Tree{
+		descriptors: make(map[string]*Descriptor),
+		nodes:       make(map[string]*Descriptor),
+		children:    make(map[string][]string),
+		names:       make(map[string][]*Descriptor),
+	}
+	dec := xml.NewDecoder(r)
+	// The descriptor file declares a DTD and is otherwise plain UTF-8.
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "DescriptorRecord" {
+			continue
+		}
+		var rec descriptorRecord
+		err = dec.DecodeElement(&rec, &se)
+		if err != nil {
+			return nil, err
+		}
+		t.add(rec)
+	}
+	for _, c := range t.children {
+		sort.Strings(c)
+	}
+	return t, nil
+}
+
+func (t *Tree) add(rec descriptorRecord) {
+	d := &Descriptor{UI: rec.UI, Name: rec.Name, TreeNumbers: rec.TreeNumbers}
+	t.descriptors[d.UI] = d
+	t.index(d.Name, d)
+	for _, term := range rec.Terms {
+		if term != d.Name {
+			d.EntryTerms = append(d.EntryTerms, term)
+		}
+		t.index(term, d)
+	}
+	for _, tn := range d.TreeNumbers {
+		t.nodes[tn] = d
+		t.children[parent(tn)] = append(t.children[parent(tn)], tn)
+	}
+}
+
+func (t *Tree) index(name string, d *Descriptor) {
+	key := normalise(name)
+	for _, e := range t.names[key] {
+		if e == d {
+			return
+		}
+	}
+	t.names[key] = append(t.names[key], d)
+}
+
+func normalise(name string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Trim(name, `"`)))
+}
+
+func parent(treeNumber string) string {
+	if i := strings.LastIndex(treeNumber, "."); i >= 0 {
+		return treeNumber[:i]
+	}
+	return ""
+}
+
+// Depth is the depth of a tree number; the tree numbers of top-level headings (e.g., C14) have a depth of 1.
+func Depth(treeNumber string) int {
+	return strings.Count(treeNumber, ".") + 1
+}
+
+// Len is the number of descriptors in the tree.
+func (t *Tree) Len() int {
+	return len(t.descriptors)
+}
+
+// Descriptor gets a descriptor by its unique identifier.
+func (t *Tree) Descriptor(ui string) (*Descriptor, bool) {
+	d, ok := t.descriptors[ui]
+	return d, ok
+}
+
+// Lookup finds the descriptors that have a term as their heading or as one of their entry terms.
+func (t *Tree) Lookup(term string) []*Descriptor {
+	return t.names[normalise(term)]
+}
+
+// Heading finds the descriptor whose heading is term. Unlike Lookup, entry terms are not considered.
+func (t *Tree) Heading(term string) (*Descriptor, bool) {
+	key := normalise(term)
+	for _, d := range t.names[key] {
+		if normalise(d.Name) == key {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+func (t *Tree) node(treeNumber string) Node {
+	d := t.nodes[treeNumber]
+	return Node{
+		TreeNumber:  treeNumber,
+		UI:          d.UI,
+		Name:        d.Name,
+		Depth:       Depth(treeNumber),
+		NumChildren: len(t.children[treeNumber]),
+	}
+}
+
+// Children lists the nodes directly beneath a tree number. When the tree number is empty, the top-level
+// headings are listed. The second return value is false if the tree number does not exist.
+func (t *Tree) Children(treeNumber string) ([]Node, bool) {
+	if _, ok := t.nodes[treeNumber]; !ok && len(treeNumber) > 0 {
+		return nil, false
+	}
+	children := t.children[treeNumber]
+	nodes := make([]Node, len(children))
+	for i, c := range children {
+		nodes[i] = t.node(c)
+	}
+	return nodes, true
+}
+
+// Explode lists the descriptors that exploding a heading covers: the heading itself, and every descriptor
+// beneath any of its positions in the tree.
+func (t *Tree) Explode(d *Descriptor) []*Descriptor {
+	seen := map[string]bool{d.UI: true}
+	ret := []*Descriptor{d}
+	stack := append([]string(nil), d.TreeNumbers...)
+	for len(stack) > 0 {
+		tn := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, c := range t.children[tn] {
+			stack = append(stack, c)
+			if cd := t.nodes[c]; !seen[cd.UI] {
+				seen[cd.UI] = true
+				ret = append(ret, cd)
+			}
+		}
+	}
+	return ret
+}
+
+// MaxDepth is the depth of the deepest position of a descriptor in the tree.
+func (d *Descriptor) MaxDepth() int {
+	var max int
+	for _, tn := range d.TreeNumbers {
+		if n := Depth(tn); n > max {
+			max = n
+		}
+	}
+	return max
+}
@@ -0,0 +1,181 @@
+package mesh
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testTree(t *testing.T) *Tree {
+	t.Helper()
+	tree, err := Load(filepath.Join("testdata", "desc.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func uis(descriptors []*Descriptor) []string {
+	ret := make([]string, len(descriptors))
+	for i, d := range descriptors {
+		ret[i] = d.UI
+	}
+	return ret
+}
+
+func TestRead(t *testing.T) {
+	tree := testTree(t)
+	if tree.Len() != 7 {
+		t.Errorf("expected 7 descriptors, got %d", tree.Len())
+	}
+	d, ok := tree.Descriptor("D006331")
+	if !ok {
+		t.Fatal("expected Heart Diseases to be read")
+	}
+	expected := Descriptor{UI: "D006331", Name: "Heart Diseases", TreeNumbers: []string{"C14.280"}, EntryTerms: []string{"Cardiac Diseases", "Heart Disorders"}}
+	if !reflect.DeepEqual(*d, expected) {
+		t.Errorf("expected %+v, got %+v", expected, *d)
+	}
+	if _, ok := tree.Descriptor("D000000"); ok {
+		t.Error("expected an unknown descriptor not to be found")
+	}
+}
+
+func TestLoadGzip(t *testing.T) {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "desc.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "desc.xml.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write(b)
+	gz.Close()
+	f.Close()
+
+	tree, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Len() != 7 {
+		t.Errorf("expected 7 descriptors, got %d", tree.Len())
+	}
+}
+
+func TestChildren(t *testing.T) {
+	tree := testTree(t)
+	tests := []struct {
+		treeNumber string
+		expected   []Node
+	}{
+		{"", []Node{
+			{TreeNumber: "C14", UI: "D002318", Name: "Cardiovascular Diseases", Depth: 1, NumChildren: 2},
+			{TreeNumber: "C23", UI: "D020000", Name: "Pathological Conditions", Depth: 1, NumChildren: 1},
+		}},
+		{"C14", []Node{
+			{TreeNumber: "C14.280", UI: "D006331", Name: "Heart Diseases", Depth: 2, NumChildren: 1},
+			{TreeNumber: "C14.907", UI: "D014652", Name: "Vascular Diseases", Depth: 2, NumChildren: 1},
+		}},
+		{"C14.907.585", []Node{
+			{TreeNumber: "C14.907.585.500", UI: "D009203", Name: "Myocardial Infarction", Depth: 4, NumChildren: 0},
+		}},
+		{"C14.907.585.500", []Node{}},
+	}
+	for _, tt := range tests {
+		nodes, ok := tree.Children(tt.treeNumber)
+		if !ok {
+			t.Errorf("%q: expected the tree number to exist", tt.treeNumber)
+			continue
+		}
+		if !reflect.DeepEqual(nodes, tt.expected) {
+			t.Errorf("%q: expected %+v, got %+v", tt.treeNumber, tt.expected, nodes)
+		}
+	}
+	if _, ok := tree.Children("C99"); ok {
+		t.Error("expected an unknown tree number not to exist")
+	}
+}
+
+func TestExplode(t *testing.T) {
+	tree := testTree(t)
+	tests := []struct {
+		ui       string
+		expected []string
+	}{
+		// Myocardial Infarction is beneath both positions of Myocardial Ischemia, but is only covered once.
+		{"D017202", []string{"D017202", "D009203"}},
+		{"D006331", []string{"D006331", "D017202", "D009203"}},
+		{"D002318", []string{"D002318", "D006331", "D014652", "D017202", "D009203"}},
+		{"D009203", []string{"D009203"}},
+	}
+	for _, tt := range tests {
+		d, _ := tree.Descriptor(tt.ui)
+		got := uis(tree.Explode(d))
+		if got[0] != tt.ui {
+			t.Errorf("%s: expected the heading to be covered first, got %v", tt.ui, got)
+		}
+		if len(got) != len(tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.ui, tt.expected, got)
+			continue
+		}
+		covered := make(map[string]bool)
+		for _, ui := range got {
+			covered[ui] = true
+		}
+		for _, ui := range tt.expected {
+			if !covered[ui] {
+				t.Errorf("%s: expected %s to be covered, got %v", tt.ui, ui, got)
+			}
+		}
+	}
+}
+
+func TestDepth(t *testing.T) {
+	for treeNumber, depth := range map[string]int{"C14": 1, "C14.280": 2, "C14.907.585.500": 4} {
+		if d := Depth(treeNumber); d != depth {
+			t.Errorf("%s: expected a depth of %d, got %d", treeNumber, depth, d)
+		}
+	}
+	tree := testTree(t)
+	for ui, depth := range map[string]int{"D002318": 1, "D017202": 3, "D009203": 4, "D007511": 2} {
+		d, _ := tree.Descriptor(ui)
+		if n := d.MaxDepth(); n != depth {
+			t.Errorf("%s: expected a maximum depth of %d, got %d", ui, depth, n)
+		}
+	}
+}
+
+func TestLookupAndHeading(t *testing.T) {
+	tree := testTree(t)
+	tests := []struct {
+		term    string
+		lookup  []string
+		heading string
+	}{
+		{"Heart Diseases", []string{"D006331"}, "D006331"},
+		{"cardiac diseases", []string{"D006331"}, ""},
+		{`"Heart Attack"`, []string{"D009203"}, ""},
+		{"  heart disorders ", []string{"D006331"}, ""},
+		// Ischemia is a heading, and an entry term of Myocardial Ischemia.
+		{"Ischemia", []string{"D017202", "D007511"}, "D007511"},
+		{"Angina", []string{}, ""},
+	}
+	for _, tt := range tests {
+		if got := uis(tree.Lookup(tt.term)); !reflect.DeepEqual(got, tt.lookup) {
+			t.Errorf("lookup %q: expected %v, got %v", tt.term, tt.lookup, got)
+		}
+		d, ok := tree.Heading(tt.term)
+		switch {
+		case len(tt.heading) == 0 && ok:
+			t.Errorf("heading %q: expected no heading, got %s", tt.term, d.UI)
+		case len(tt.heading) > 0 && (!ok || d.UI != tt.heading):
+			t.Errorf("heading %q: expected %s, got %v", tt.term, tt.heading, d)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package searchrefiner
+
+import (
+	"github.com/hscells/cqr"
+	"github.com/hscells/transmute/fields"
+	"github.com/ielab/searchrefiner/mesh"
+	"path/filepath"
+	"testing"
+)
+
+func TestMeSHStatistics(t *testing.T) {
+	tree, err := mesh.Load(filepath.Join("mesh", "testdata", "desc.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := cqr.NewBooleanQuery(cqr.OR, []cqr.CommonQueryRepresentation{
+		cqr.NewKeyword("Heart Diseases", fields.MeshHeadings).SetOption(cqr.ExplodedString, true),
+		// The same keyword is only counted once.
+		cqr.NewKeyword("Heart Diseases", fields.MeshHeadings).SetOption(cqr.ExplodedString, true),
+		cqr.NewKeyword("Myocardial Infarction", fields.MeSHMajorTopic).SetOption(cqr.ExplodedString, false),
+		// Entry terms and terms that are not in the tree are not counted towards the depth.
+		cqr.NewKeyword("Heart Attack", fields.MeshHeadings).SetOption(cqr.ExplodedString, true),
+		cqr.NewKeyword("Angina", fields.MeshHeadings),
+		cqr.NewKeyword("Ischemia", fields.TitleAbstract),
+	})
+
+	tests := []struct {
+		name                         string
+		tree                         *mesh.Tree
+		exploded, avgDepth, maxDepth float64
+	}{
+		{"loaded", tree, 2, 3, 4},
+		{"not loaded", nil, 2, 0, 0},
+	}
+	for _, tt := range tests {
+		exploded, avgDepth, maxDepth := Server{MeSH: tt.tree}.meshStatistics(q)
+		if exploded != tt.exploded || avgDepth != tt.avgDepth || maxDepth != tt.maxDepth {
+			t.Errorf("%s: expected %v exploded, an average depth of %v and a maximum of %v, got %v, %v and %v",
+				tt.name, tt.exploded, tt.avgDepth, tt.maxDepth, exploded, avgDepth, maxDepth)
+		}
+	}
+}
@@ -7,8 +7,6 @@ import (
 	"github.com/hscells/cqr"
 	"github.com/hscells/groove/combinator"
 	gpipeline "github.com/hscells/groove/pipeline"
-	"github.com/hscells/transmute"
-	tpipeline "github.com/hscells/transmute/pipeline"
 	"github.com/ielab/searchrefiner"
 	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
@@ -32,21 +30,35 @@ var (
 const pluginStorageName = "queryvis_consent"
 
 func (QueryVisPlugin) Startup(server searchrefiner.Server) {
+	// Queries visualised by users that have consented are logged for research.
+	server.Events.OnQueryExecuted(func(e searchrefiner.QueryExecuted) {
+		if e.Source != "queryvis" {
+			return
+		}
+		storage, err := server.State.OpenStorage(pluginStorageName)
+		if err != nil {
+			log.Errorln(err)
+			return
+		}
+		username := e.Workspace.Username
+		if v, err := storage.GetValue("consent", username); err == nil && v != "n" {
+			log.Infof(fmt.Sprintf("[username=%s][query=%s][lang=%s][pmids=%v][numrel=%d][numret=%d][numrelret=%d]", username, e.Query.QueryString, e.Query.Language, e.Query.Relevant, len(e.Query.Relevant), e.Query.NumRet, e.Query.NumRelRet))
+		}
+	})
 }
 
 func handleTree(s searchrefiner.Server, c *gin.Context, relevant ...combinator.Document) {
 	rawQuery := c.PostForm("query")
-	lang := c.PostForm("lang")
-
-	p := make(map[string]tpipeline.TransmutePipeline)
-	p["medline"] = transmute.Medline2Cqr
-	p["pubmed"] = transmute.Pubmed2Cqr
 
-	compiler := p["medline"]
-	if v, ok := p[lang]; ok {
-		compiler = v
-	} else {
-		lang = "medline"
+	options, err := searchrefiner.RequestParserOptions(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	compiler, lang, err := searchrefiner.Languages.ConfiguredParser(c.PostForm("lang"), options)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
 	}
 	username := s.Perm.UserState().Username(c.Request)
 	if len(username) == 0 {
@@ -54,6 +66,11 @@ func handleTree(s searchrefiner.Server, c *gin.Context, relevant ...combinator.D
 			username = token
 		}
 	}
+	ws, err := s.UserWorkspace(username)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	cq, err := compiler.Execute(rawQuery)
 	if err != nil {
@@ -66,13 +83,18 @@ func handleTree(s searchrefiner.Server, c *gin.Context, relevant ...combinator.D
 		return
 
 	}
+	s.Events.PublishQueryParsed(searchrefiner.QueryParsed{Workspace: ws, Query: rawQuery, Language: lang, CQR: repr.(cqr.CommonQueryRepresentation), Source: "queryvis"})
 
 	if len(relevant) == 0 {
-		relevant = s.Settings[username].Relevant
+		relevant, err = s.Seeds.Relevant(ws.Key)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
 	}
 
 	var root combinator.LogicalTree
-	root, err = combinator.NewShallowLogicalTree(gpipeline.NewQuery("searchrefiner", "0", repr.(cqr.CommonQueryRepresentation)), s.Entrez, relevant)
+	root, err = combinator.NewShallowLogicalTree(gpipeline.NewQuery("searchrefiner", "0", repr.(cqr.CommonQueryRepresentation)), s.Backend, relevant)
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
 		return
@@ -93,45 +115,84 @@ func handleTree(s searchrefiner.Server, c *gin.Context, relevant ...combinator.D
 		numRet = int64(t.Nodes[0].Value)
 	}
 
-	err = s.Storage[pluginStorageName].CreateBucket("consent")
+	storage, err := s.State.OpenStorage(pluginStorageName)
 	if err != nil {
-		panic(err)
+		c.String(http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	if v, err := s.Storage[pluginStorageName].GetValue("consent", username); err == nil {
-		if v != "n" {
-			log.Infof(fmt.Sprintf("[username=%s][query=%s][lang=%s][pmids=%v][numrel=%d][numret=%d][numrelret=%d]", username, rawQuery, lang, relevant, t.NumRel, numRet, t.NumRelRet))
-		}
+	err = storage.CreateBucket("consent")
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	s.Queries[username] = append(s.Queries[username], searchrefiner.Query{
-		Time:        time.Now(),
-		QueryString: rawQuery,
-		Language:    lang,
-		NumRet:      numRet,
-		NumRelRet:   int64(t.NumRelRet),
-	})
+	rel := make([]string, len(relevant))
+	for i, r := range relevant {
+		rel[i] = r.String()
+	}
+
+	_, err = s.RecordQuery(ws, searchrefiner.Query{
+		Time:          time.Now(),
+		QueryString:   rawQuery,
+		Language:      lang,
+		NumRet:        numRet,
+		NumRelRet:     int64(t.NumRelRet),
+		Relevant:      rel,
+		Author:        username,
+		Lines:         searchrefiner.ReportLines(root.Root, lang),
+		ParserOptions: options,
+	}, repr.(cqr.CommonQueryRepresentation), "queryvis")
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	c.JSON(200, t)
 }
 
-func (QueryVisPlugin) Serve(s searchrefiner.Server, c *gin.Context) {
-	if _, ok := s.Storage[pluginStorageName]; !ok {
-		var err error
-		s.Storage[pluginStorageName], err = searchrefiner.OpenPluginStorage("queryvis_consent")
-		if err != nil {
-			panic(err)
+// serveTree serves the tree of a query, using the seed studies that were sent with the token of the request.
+func serveTree(s searchrefiner.Server, c *gin.Context) {
+	var item cachedItem
+	if token, ok := c.GetQuery("token"); ok {
+		if i, ok := tokenCache.Get(token); ok {
+			item = i.(cachedItem)
 		}
 	}
+	handleTree(s, c, item.seeds...)
+}
+
+// serveConsent records whether the user consents to their queries being logged, and then shows the interface.
+func serveConsent(s searchrefiner.Server, c *gin.Context) {
+	storage, err := s.State.OpenStorage(pluginStorageName)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = storage.PutValue("consent", s.Perm.UserState().Username(c.Request), c.PostForm("consent"))
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	QueryVisPlugin{}.Serve(s, c)
+}
+
+func (QueryVisPlugin) Routes(r *searchrefiner.PluginRoutes) {
+	// Trees only record queries in the history of editors, so viewers may request one too.
+	r.Handle(http.MethodPost, "/api/tree", searchrefiner.PluginUser, searchrefiner.RoleViewer, serveTree)
+	r.Handle(http.MethodPost, "/consent", searchrefiner.PluginUser, searchrefiner.RoleViewer, serveConsent)
+}
+
+func (QueryVisPlugin) Serve(s searchrefiner.Server, c *gin.Context) {
+	storage, err := s.State.OpenStorage(pluginStorageName)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
+	// Older clients request trees and change consent through query strings, rather than their own routes.
 	if c.Request.Method == "POST" && (c.Query("tree") == "y") {
-		var item cachedItem
-		if token, ok := c.GetQuery("token"); ok {
-			if i, ok := tokenCache.Get(token); ok {
-				item = i.(cachedItem)
-			}
-		}
-		handleTree(s, c, item.seeds...)
+		serveTree(s, c)
 		return
 	}
 
@@ -142,12 +203,12 @@ func (QueryVisPlugin) Serve(s searchrefiner.Server, c *gin.Context) {
 		}
 	}
 	if c.Request.Method == "POST" && (len(c.Query("consent")) > 0) {
-		s.Storage[pluginStorageName].PutValue("consent", username, c.Query("consent"))
+		storage.PutValue("consent", username, c.Query("consent"))
 	}
 
 	var consent bool
 	{
-		c, err := s.Storage[pluginStorageName].GetValue("consent", username)
+		c, err := storage.GetValue("consent", username)
 		if err != nil {
 			panic(err)
 		}
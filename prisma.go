@@ -0,0 +1,374 @@
+package searchrefiner
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/cqr"
+	"github.com/hscells/groove/combinator"
+	gpipeline "github.com/hscells/groove/pipeline"
+	"github.com/hscells/transmute/fields"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Formats of search reports.
+const (
+	ReportMarkdown = "markdown"
+	ReportHTML     = "html"
+	ReportJSON     = "json"
+)
+
+// limitFields are the fields that limit a search rather than describe its topic.
+var limitFields = map[string]bool{
+	fields.PublicationDate:   true,
+	fields.DatePublication:   true,
+	fields.DateCreate:        true,
+	fields.DateEntrez:        true,
+	fields.Language:          true,
+	fields.PublicationType:   true,
+	fields.PublicationStatus: true,
+	fields.Filter:            true,
+}
+
+// ReportLine is a line of a search, and the number of citations and seed studies it retrieves. Lines that combine
+// other lines refer to them by number, as in the search history of a database interface.
+type ReportLine struct {
+	Number int
+	Search string
+	Hits   float64
+	Seeds  float64
+}
+
+// DatabaseSearch is the final search strategy that was run on a database. Language is the syntax that the strategy
+// was written in, and Syntax its title, which need not be the syntax of the database.
+type DatabaseSearch struct {
+	Database string
+	Language string
+	Syntax   string
+	Platform string
+	Strategy string
+	Version  int
+	Author   string
+	Message  string
+	Date     time.Time
+	Query    string
+	CQR      string
+	Lines    []ReportLine
+	Limits   []string
+	Hits     int64
+	// Seeds is the number of seed studies that the search was evaluated against, and SeedsRetrieved how many of
+	// them it retrieved.
+	Seeds          int
+	SeedsRetrieved float64
+	Recall         float64
+}
+
+// SearchReport describes the searches of a review in the way that PRISMA-S asks them to be reported.
+type SearchReport struct {
+	Workspace string
+	Generated time.Time
+	Searches  []DatabaseSearch
+}
+
+var markdownReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"date": func(t time.Time) string { return t.Format("2 January 2006") },
+	// cell escapes text so that it stays in a single cell of a table.
+	"cell": func(s string) string {
+		return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+	},
+}).Parse(`# Search strategies: {{ .Workspace }}
+
+Generated by searchrefiner on {{ date .Generated }}.
+{{ range .Searches }}
+## {{ .Database }}
+
+- **Platform:** {{ .Platform }}
+- **Syntax:** {{ .Syntax }}
+- **Date searched:** {{ date .Date }}
+- **Strategy:** {{ .Strategy }}, version {{ .Version }}{{ if .Author }} by {{ .Author }}{{ end }}{{ if .Message }} ({{ .Message }}){{ end }}
+- **Limits:** {{ if .Limits }}{{ range $i, $l := .Limits }}{{ if $i }}; {{ end }}{{ $l }}{{ end }}{{ else }}none{{ end }}
+- **Records retrieved:** {{ .Hits }}
+{{- if .Seeds }}
+- **Seed studies retrieved:** {{ .SeedsRetrieved }} of {{ .Seeds }} (recall {{ printf "%.2f" .Recall }})
+{{- end }}
+{{ if .Lines }}
+| # | Search | Results |{{ if .Seeds }} Seed studies |{{ end }}
+|---|--------|---------|{{ if .Seeds }}--------------|{{ end }}
+{{ $seeds := .Seeds }}{{ range .Lines }}| {{ .Number }} | {{ cell .Search }} | {{ .Hits }} |{{ if $seeds }} {{ .Seeds }} |{{ end }}
+{{ end }}{{ else }}
+The results of each line were not recorded when this search was run.
+{{ end }}
+### Strategy as written
+
+` + "```" + `
+{{ .Query }}
+` + "```" + `
+
+### Common query representation
+
+` + "```json" + `
+{{ .CQR }}
+` + "```" + `
+{{ end }}`))
+
+// ReportLines numbers the clauses of a search from the combinator tree of the query, so that lines which combine
+// other lines come after them. The last line is the whole query.
+func ReportLines(root combinator.LogicalTreeNode, lang string) []ReportLine {
+	compiler, lang, err := Languages.Compiler(lang)
+	if err != nil {
+		return nil
+	}
+	var lines []ReportLine
+	text := func(q cqr.CommonQueryRepresentation) string {
+		s, err := compileClause(compiler, q)
+		if err != nil {
+			return q.String()
+		}
+		// Ovid numbers the lines of a search itself, so only the first line is the clause.
+		if lang == "medline" {
+			return clauseText(s)
+		}
+		return strings.Join(strings.Fields(s), " ")
+	}
+	var walk func(node combinator.LogicalTreeNode) int
+	walk = func(node combinator.LogicalTreeNode) int {
+		line := ReportLine{}
+		switch n := node.(type) {
+		case combinator.Atom:
+			line.Search, line.Hits, line.Seeds = text(n.Query()), n.N, n.R
+		case combinator.Combinator:
+			line.Hits, line.Seeds = n.N, n.R
+			b, ok := n.Query().(cqr.BooleanQuery)
+			// Adjacency can only be searched as a whole, so it is a single line.
+			if ok && strings.HasPrefix(strings.ToLower(b.Operator), "adj") {
+				line.Search = text(b)
+				break
+			}
+			refs := make([]string, len(n.Clauses))
+			for i, child := range n.Clauses {
+				refs[i] = strconv.Itoa(walk(child))
+			}
+			op := strings.ToUpper(n.Operator.String())
+			if lang == "medline" {
+				line.Search = strings.Join(refs, " "+strings.ToLower(op)+" ")
+			} else {
+				line.Search = "#" + strings.Join(refs, " "+op+" #")
+			}
+		default:
+			line.Search = node.String()
+		}
+		line.Number = len(lines) + 1
+		lines = append(lines, line)
+		return line.Number
+	}
+	walk(root)
+	return lines
+}
+
+// queryLimits finds the keywords of a query that limit it.
+func queryLimits(repr cqr.CommonQueryRepresentation) []string {
+	var limits []string
+	var walk func(q cqr.CommonQueryRepresentation)
+	walk = func(q cqr.CommonQueryRepresentation) {
+		switch v := q.(type) {
+		case cqr.Keyword:
+			for _, f := range v.Fields {
+				if !limitFields[f] {
+					return
+				}
+			}
+			if len(v.Fields) > 0 {
+				limits = append(limits, fmt.Sprintf("%s [%s]", v.QueryString, strings.Join(v.Fields, ",")))
+			}
+		case cqr.BooleanQuery:
+			for _, child := range v.Children {
+				walk(child)
+			}
+		}
+	}
+	walk(repr)
+	return limits
+}
+
+// database names the database that the search backend searches, whatever the syntax of the query.
+func (s Server) database() string {
+	switch s.Config.Backend.Name {
+	case "", BackendEntrez, BackendLocal:
+		return "PubMed"
+	}
+	return s.Config.Backend.Name
+}
+
+// platform names the search backend that queries are run on.
+func (s Server) platform() string {
+	switch s.Config.Backend.Name {
+	case "", BackendEntrez:
+		return "NCBI E-utilities"
+	case BackendLocal:
+		return "searchrefiner local index"
+	}
+	return s.Config.Backend.Name
+}
+
+// searchLines runs each line of a query on the search backend, counting the citations and seed studies it
+// retrieves, so that they can be recorded with the query.
+func (s Server) searchLines(repr cqr.CommonQueryRepresentation, lang string, relevant []string) ([]ReportLine, error) {
+	rel := make(combinator.Documents, 0, len(relevant))
+	for _, pmid := range relevant {
+		if n, err := strconv.ParseUint(pmid, 10, 32); err == nil {
+			rel = append(rel, combinator.Document(n))
+		}
+	}
+	t, err := combinator.NewShallowLogicalTree(gpipeline.NewQuery("searchrefiner", "0", repr), s.Backend, rel)
+	if err != nil {
+		return nil, err
+	}
+	return ReportLines(t.Root, lang), nil
+}
+
+// databaseSearch reports the search of a database from the query in the history that it was last run with. The
+// results of the search are those that were recorded when it was run, so that the report matches the date it was
+// searched on; queries are not run again.
+func (s Server) databaseSearch(q Query) (DatabaseSearch, error) {
+	d := DatabaseSearch{
+		Database:       q.Database,
+		Language:       q.Language,
+		Syntax:         q.Language,
+		Platform:       q.Platform,
+		Strategy:       q.Strategy,
+		Version:        q.Version,
+		Author:         q.Author,
+		Message:        q.Message,
+		Date:           q.Time,
+		Query:          q.QueryString,
+		Hits:           q.NumRet,
+		Limits:         q.Limits,
+		Lines:          q.Lines,
+		Seeds:          len(q.Relevant),
+		SeedsRetrieved: float64(q.NumRelRet),
+	}
+	// Queries that were recorded before the database was recorded with them were run on the configured backend.
+	if len(d.Database) == 0 {
+		d.Database = s.database()
+	}
+	if len(d.Platform) == 0 {
+		d.Platform = s.platform()
+	}
+	if l, err := Languages.Get(q.Language); err == nil {
+		d.Syntax = l.Title
+	}
+	if d.Seeds > 0 {
+		d.Recall = d.SeedsRetrieved / float64(d.Seeds)
+	}
+
+	// The query is parsed with the options it was run with, so that the representation is of the query that was run.
+	compiler, _, err := Languages.ConfiguredParser(q.Language, q.ParserOptions)
+	if err != nil {
+		return d, err
+	}
+	cq, err := compiler.Execute(q.QueryString)
+	if err != nil {
+		return d, err
+	}
+	d.CQR, err = cq.StringPretty()
+	if err != nil {
+		return d, err
+	}
+	r, err := cq.Representation()
+	if err != nil {
+		return d, err
+	}
+	repr, ok := r.(cqr.CommonQueryRepresentation)
+	if !ok {
+		return d, fmt.Errorf("query could not be parsed")
+	}
+	d.Limits = append(d.Limits, queryLimits(repr)...)
+	return d, nil
+}
+
+// SearchReport reports the final search of each database in a workspace: the query in each syntax that was run on
+// the database most recently. When strategy is not empty, only the versions of that strategy are reported.
+func (s Server) SearchReport(ws Workspace, strategy string) (SearchReport, error) {
+	r := SearchReport{Workspace: ws.Project.Name, Generated: time.Now()}
+	if ws.Personal() {
+		r.Workspace = ws.Username
+	}
+	queries, err := s.History.Get(ws.Key)
+	if err != nil {
+		return r, err
+	}
+	type search struct {
+		database, platform, language string
+	}
+	final := make(map[search]Query)
+	for _, q := range queries {
+		if len(strategy) > 0 && q.Strategy != strategy {
+			continue
+		}
+		k := search{q.Database, q.Platform, q.Language}
+		if prev, ok := final[k]; !ok || !q.Time.Before(prev.Time) {
+			final[k] = q
+		}
+	}
+	for _, q := range final {
+		d, err := s.databaseSearch(q)
+		if err != nil {
+			return r, fmt.Errorf("%s: %v", q.Language, err)
+		}
+		r.Searches = append(r.Searches, d)
+	}
+	sort.Slice(r.Searches, func(i, j int) bool {
+		if r.Searches[i].Database != r.Searches[j].Database {
+			return r.Searches[i].Database < r.Searches[j].Database
+		}
+		return r.Searches[i].Syntax < r.Searches[j].Syntax
+	})
+	return r, nil
+}
+
+// ApiSearchReport reports the searches in the history of the workspace of the user, in the format in the "format"
+// parameter: Markdown (the default), HTML, which word processors can open, or JSON.
+func (s Server) ApiSearchReport(c *gin.Context) {
+	if !s.Perm.UserState().IsLoggedIn(s.Perm.UserState().Username(c.Request)) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+	ws, err := s.Workspace(c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	format := c.DefaultQuery("format", ReportMarkdown)
+	if format != ReportMarkdown && format != ReportHTML && format != ReportJSON {
+		c.String(http.StatusBadRequest, fmt.Sprintf("unknown report format %s", format))
+		return
+	}
+
+	r, err := s.SearchReport(ws, c.Query("strategy"))
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Infof("[report] %s:%s:%s:%d searches", ws.Username, ws.Key, format, len(r.Searches))
+
+	switch format {
+	case ReportJSON:
+		c.JSON(http.StatusOK, r)
+	case ReportHTML:
+		c.HTML(http.StatusOK, "report.html", r)
+	default:
+		var b bytes.Buffer
+		if err := markdownReport.Execute(&b, r); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Header("Content-Disposition", `attachment; filename="searchrefiner-prisma-s.md"`)
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", b.Bytes())
+	}
+}
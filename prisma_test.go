@@ -0,0 +1,64 @@
+package searchrefiner
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarkdownReportEscapesCells(t *testing.T) {
+	r := SearchReport{Workspace: "test", Generated: time.Now(), Searches: []DatabaseSearch{{
+		Database: "PubMed",
+		Hits:     10,
+		Lines:    []ReportLine{{Number: 1, Search: "a|b\nc", Hits: 10}},
+	}}}
+	var b bytes.Buffer
+	if err := markdownReport.Execute(&b, r); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `| 1 | a\|b c | 10 |`) {
+		t.Errorf("expected the search to be escaped in a single cell:\n%s", b.String())
+	}
+}
+
+func TestDatabaseSearchUsesRecordedResults(t *testing.T) {
+	q := Query{
+		QueryString: "heart attack",
+		Language:    "embase",
+		NumRet:      42,
+		NumRelRet:   1,
+		Relevant:    []string{"1", "2"},
+		Database:    "PubMed",
+		Platform:    "NCBI E-utilities",
+		Lines:       []ReportLine{{Number: 1, Search: "heart AND attack", Hits: 42, Seeds: 1}},
+	}
+	d, err := Server{}.databaseSearch(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Database != "PubMed" || d.Syntax != "Embase" {
+		t.Errorf("expected an Embase strategy searched on PubMed, got %s in %s", d.Database, d.Syntax)
+	}
+	if len(d.Lines) != 1 || d.Lines[0].Hits != 42 || d.Hits != 42 {
+		t.Errorf("expected the recorded results, got %v", d.Lines)
+	}
+	if d.Recall != 0.5 {
+		t.Errorf("expected a recall of 0.5, got %f", d.Recall)
+	}
+}
+
+func TestDatabaseSearchUsesRecordedParserOptions(t *testing.T) {
+	q := Query{
+		QueryString:   "heart[tiab]",
+		Language:      "pubmed",
+		ParserOptions: ParserOptions{Fields: map[string][]string{"tiab": {"title"}}},
+	}
+	d, err := Server{}.databaseSearch(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(d.CQR, `"title"`) || strings.Contains(d.CQR, "title_abstract") {
+		t.Errorf("expected the field mapping the query was run with, got %s", d.CQR)
+	}
+}
@@ -0,0 +1,431 @@
+package searchrefiner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Role is what a member of a project may do in it.
+type Role string
+
+const (
+	// RoleViewer members may see the history, seed studies, and plugin data of a project.
+	RoleViewer Role = "viewer"
+	// RoleEditor members may also run queries that are recorded in the history, and change the seed studies.
+	RoleEditor Role = "editor"
+	// RoleOwner members may also manage the members of a project, and clear its history, which removes the queries of
+	// every member.
+	RoleOwner Role = "owner"
+)
+
+var roleRank = map[Role]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+// Allows reports whether a member with the role may do what requires another role.
+func (r Role) Allows(required Role) bool {
+	return roleRank[r] >= roleRank[required]
+}
+
+var (
+	ErrProjectNotFound  = errors.New("project not found")
+	ErrProjectNameEmpty = errors.New("project must have a name")
+	ErrProjectForbidden = errors.New("not permitted in this project")
+	ErrProjectLastOwner = errors.New("a project must have an owner")
+	ErrUnknownRole      = errors.New("unknown role")
+)
+
+var (
+	projectsBucket = []byte("projects")
+	projectsList   = []byte("list")
+	projectsActive = []byte("active")
+)
+
+// projectPrefix starts the workspace key of a project, keeping the data of a project apart from that of a user.
+const projectPrefix = "project:"
+
+// Project is a review that several users work on together, sharing query history, seed studies, and plugin data.
+type Project struct {
+	ID      string
+	Name    string
+	Members map[string]Role
+	Created time.Time
+}
+
+// ProjectStore persists projects and the project that each user is working in.
+type ProjectStore struct {
+	db *bolt.DB
+}
+
+// NewProjectStore creates a project store backed by an open bolt database.
+func NewProjectStore(db *bolt.DB) (*ProjectStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(projectsBucket)
+		if err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists(projectsList); err != nil {
+			return err
+		}
+		_, err = b.CreateBucketIfNotExists(projectsActive)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ProjectStore{db: db}, nil
+}
+
+func getProject(tx *bolt.Tx, id string) (Project, error) {
+	var p Project
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return p, ErrProjectNotFound
+	}
+	v := tx.Bucket(projectsBucket).Bucket(projectsList).Get(historyKey(n))
+	if v == nil {
+		return p, ErrProjectNotFound
+	}
+	err = json.Unmarshal(v, &p)
+	return p, err
+}
+
+func putProject(tx *bolt.Tx, p Project) error {
+	n, err := strconv.ParseUint(p.ID, 10, 64)
+	if err != nil {
+		return ErrProjectNotFound
+	}
+	v, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(projectsBucket).Bucket(projectsList).Put(historyKey(n), v)
+}
+
+// Create starts a project owned by a user.
+func (s *ProjectStore) Create(owner, name string) (Project, error) {
+	var p Project
+	if len(name) == 0 {
+		return p, ErrProjectNameEmpty
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(projectsBucket).Bucket(projectsList).NextSequence()
+		if err != nil {
+			return err
+		}
+		p = Project{
+			ID:      strconv.FormatUint(seq, 10),
+			Name:    name,
+			Members: map[string]Role{owner: RoleOwner},
+			Created: time.Now(),
+		}
+		return putProject(tx, p)
+	})
+	return p, err
+}
+
+// Get returns a single project.
+func (s *ProjectStore) Get(id string) (Project, error) {
+	var p Project
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		p, err = getProject(tx, id)
+		return err
+	})
+	return p, err
+}
+
+// List returns the projects that a user is a member of, in the order they were created.
+func (s *ProjectStore) List(username string) ([]Project, error) {
+	var projects []Project
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(projectsBucket).Bucket(projectsList).ForEach(func(k, v []byte) error {
+			var p Project
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			if _, ok := p.Members[username]; ok {
+				projects = append(projects, p)
+			}
+			return nil
+		})
+	})
+	return projects, err
+}
+
+// SetMember gives a user a role in a project, or removes them from it when the role is empty. Only owners of the
+// project may change its members, and the last owner may not be removed or demoted.
+func (s *ProjectStore) SetMember(owner, id, username string, role Role) (Project, error) {
+	var p Project
+	if _, ok := roleRank[role]; !ok && len(role) > 0 {
+		return p, ErrUnknownRole
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		p, err = getProject(tx, id)
+		if err != nil {
+			return err
+		}
+		if !p.Members[owner].Allows(RoleOwner) {
+			return ErrProjectForbidden
+		}
+		if p.Members[username] == RoleOwner && role != RoleOwner {
+			owners := 0
+			for _, r := range p.Members {
+				if r == RoleOwner {
+					owners++
+				}
+			}
+			if owners == 1 {
+				return ErrProjectLastOwner
+			}
+		}
+		if len(role) == 0 {
+			delete(p.Members, username)
+		} else {
+			p.Members[username] = role
+		}
+		return putProject(tx, p)
+	})
+	return p, err
+}
+
+// SetActive picks the project that a user works in. An empty id returns the user to their personal workspace.
+func (s *ProjectStore) SetActive(username, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		active := tx.Bucket(projectsBucket).Bucket(projectsActive)
+		if len(id) == 0 {
+			return active.Delete([]byte(username))
+		}
+		p, err := getProject(tx, id)
+		if err != nil {
+			return err
+		}
+		if _, ok := p.Members[username]; !ok {
+			return ErrProjectNotFound
+		}
+		return active.Put([]byte(username), []byte(id))
+	})
+}
+
+// Active returns the project that a user works in. The boolean is false if the user works in their personal
+// workspace, including when they have been removed from the project they were working in.
+func (s *ProjectStore) Active(username string) (Project, bool, error) {
+	var (
+		p  Project
+		ok bool
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(projectsBucket).Bucket(projectsActive).Get([]byte(username))
+		if id == nil {
+			return nil
+		}
+		var err error
+		p, err = getProject(tx, string(id))
+		if err == ErrProjectNotFound {
+			return nil
+		}
+		_, ok = p.Members[username]
+		return err
+	})
+	return p, ok, err
+}
+
+// Workspace is where the history, seed studies, and plugin data that a user works with are kept: either the
+// personal workspace of the user, or the project they are working in.
+type Workspace struct {
+	// Key identifies the workspace in the history, seed, and plugin stores.
+	Key      string
+	Username string
+	Project  Project
+	Role     Role
+}
+
+// Personal reports whether the workspace is the personal workspace of the user.
+func (w Workspace) Personal() bool {
+	return len(w.Project.ID) == 0
+}
+
+// Can reports whether the user may do what requires a role in the workspace.
+func (w Workspace) Can(required Role) bool {
+	return w.Role.Allows(required)
+}
+
+const workspaceContextKey = "searchrefiner.workspace"
+
+// UserWorkspace finds the workspace that a user works in. Users own their personal workspace.
+func (s Server) UserWorkspace(username string) (Workspace, error) {
+	ws := Workspace{Key: username, Username: username, Role: RoleOwner}
+	if s.Projects == nil || len(username) == 0 {
+		return ws, nil
+	}
+	p, ok, err := s.Projects.Active(username)
+	if err != nil || !ok {
+		return ws, err
+	}
+	ws.Key = projectPrefix + p.ID
+	ws.Project = p
+	ws.Role = p.Members[username]
+	return ws, nil
+}
+
+// Workspace finds the workspace of the user that made a request.
+func (s Server) Workspace(c *gin.Context) (Workspace, error) {
+	if v, ok := c.Get(workspaceContextKey); ok {
+		return v.(Workspace), nil
+	}
+	ws, err := s.UserWorkspace(s.Perm.UserState().Username(c.Request))
+	if err != nil {
+		return ws, err
+	}
+	c.Set(workspaceContextKey, ws)
+	return ws, nil
+}
+
+// RequireRole is middleware that only lets users with a role in their workspace through.
+func (s Server) RequireRole(required Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ws, err := s.Workspace(c)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			c.Abort()
+			return
+		}
+		if !ws.Can(required) {
+			c.String(http.StatusForbidden, fmt.Sprintf("the %s role in %s is required", required, ws.Project.Name))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequirePluginRole is middleware that enforces roles on the routes of a plugin. Viewing a plugin only requires
+// the viewer role, and so does posting a query to a plugin that accepts them; anything else requires an editor.
+func (s Server) RequirePluginRole(details PluginDetails) gin.HandlerFunc {
+	viewer, editor := s.RequireRole(RoleViewer), s.RequireRole(RoleEditor)
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet || (c.Request.Method == http.MethodPost && details.AcceptsQueryPosts) {
+			viewer(c)
+			return
+		}
+		editor(c)
+	}
+}
+
+// ProjectMembership is a project that a user is a member of, and their role in it.
+type ProjectMembership struct {
+	Project
+	Role Role
+}
+
+// memberships lists the projects of a user with their role in each.
+func (s Server) memberships(username string) ([]ProjectMembership, error) {
+	projects, err := s.Projects.List(username)
+	if err != nil {
+		return nil, err
+	}
+	m := make([]ProjectMembership, len(projects))
+	for i, p := range projects {
+		m[i] = ProjectMembership{Project: p, Role: p.Members[username]}
+	}
+	sort.SliceStable(m, func(i, j int) bool {
+		return m[i].Name < m[j].Name
+	})
+	return m, nil
+}
+
+// projectsError writes the response for an error raised by the project store.
+func projectsError(c *gin.Context, err error) {
+	switch err {
+	case ErrProjectNotFound:
+		c.String(http.StatusNotFound, err.Error())
+	case ErrProjectNameEmpty, ErrProjectLastOwner, ErrUnknownRole:
+		c.String(http.StatusBadRequest, err.Error())
+	case ErrProjectForbidden:
+		c.String(http.StatusForbidden, err.Error())
+	default:
+		c.String(http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (s Server) ApiProjectsList(c *gin.Context) {
+	username := s.Perm.UserState().Username(c.Request)
+	if !s.Perm.UserState().IsLoggedIn(username) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+	m, err := s.memberships(username)
+	if err != nil {
+		projectsError(c, err)
+		return
+	}
+	ws, err := s.Workspace(c)
+	if err != nil {
+		projectsError(c, err)
+		return
+	}
+	if m == nil {
+		m = []ProjectMembership{}
+	}
+	c.JSON(http.StatusOK, struct {
+		Active   string
+		Projects []ProjectMembership
+	}{Active: ws.Project.ID, Projects: m})
+}
+
+func (s Server) ApiProjectsCreate(c *gin.Context) {
+	username := s.Perm.UserState().Username(c.Request)
+	if !s.Perm.UserState().IsLoggedIn(username) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+	p, err := s.Projects.Create(username, c.PostForm("name"))
+	if err != nil {
+		projectsError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// ApiProjectsActivate switches the user to the project in the "id" parameter, or to their personal workspace when
+// it is empty.
+func (s Server) ApiProjectsActivate(c *gin.Context) {
+	username := s.Perm.UserState().Username(c.Request)
+	if !s.Perm.UserState().IsLoggedIn(username) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+	err := s.Projects.SetActive(username, c.PostForm("id"))
+	if err != nil {
+		projectsError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// ApiProjectsMember gives the user in the "username" parameter the role in "role" in the project in "id", or removes
+// them from the project when the role is empty.
+func (s Server) ApiProjectsMember(c *gin.Context) {
+	username := s.Perm.UserState().Username(c.Request)
+	if !s.Perm.UserState().IsLoggedIn(username) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+	member := c.PostForm("username")
+	if !s.Perm.UserState().HasUser(member) {
+		c.String(http.StatusBadRequest, fmt.Sprintf("no user %s", member))
+		return
+	}
+	p, err := s.Projects.SetMember(username, c.PostForm("id"), member, Role(c.PostForm("role")))
+	if err != nil {
+		projectsError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
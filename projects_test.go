@@ -0,0 +1,154 @@
+package searchrefiner
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func testProjects(t *testing.T) *ProjectStore {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), StatePath), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	p, err := NewProjectStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestProjectStoreSetMember(t *testing.T) {
+	s := testProjects(t)
+	if _, err := s.Create("owner", ""); err != ErrProjectNameEmpty {
+		t.Errorf("expected a project without a name to be rejected, got %v", err)
+	}
+	p, err := s.Create("owner", "review")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Members["owner"] != RoleOwner {
+		t.Fatalf("expected the creator to own the project, got %v", p.Members)
+	}
+
+	tests := []struct {
+		name, by, username string
+		role               Role
+		err                error
+	}{
+		{"unknown role", "owner", "editor", "admin", ErrUnknownRole},
+		{"unknown project", "owner", "editor", RoleEditor, ErrProjectNotFound},
+		{"add editor", "owner", "editor", RoleEditor, nil},
+		{"editor adds member", "editor", "viewer", RoleViewer, ErrProjectForbidden},
+		{"non-member adds member", "stranger", "viewer", RoleViewer, ErrProjectForbidden},
+		{"add viewer", "owner", "viewer", RoleViewer, nil},
+		{"demote last owner", "owner", "owner", RoleEditor, ErrProjectLastOwner},
+		{"remove last owner", "owner", "owner", "", ErrProjectLastOwner},
+		{"add owner", "owner", "editor", RoleOwner, nil},
+		{"demote other owner", "editor", "owner", RoleViewer, nil},
+		{"remove viewer", "editor", "viewer", "", nil},
+	}
+	for _, tt := range tests {
+		id := p.ID
+		if tt.err == ErrProjectNotFound {
+			id = "999"
+		}
+		if _, err := s.SetMember(tt.by, id, tt.username, tt.role); err != tt.err {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	p, err = s.Get(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Role{"owner": RoleViewer, "editor": RoleOwner}
+	if len(p.Members) != len(expected) {
+		t.Fatalf("expected the members %v, got %v", expected, p.Members)
+	}
+	for u, r := range expected {
+		if p.Members[u] != r {
+			t.Errorf("expected %s to be a %s, got %s", u, r, p.Members[u])
+		}
+	}
+}
+
+func TestProjectStoreActive(t *testing.T) {
+	s := testProjects(t)
+	p, err := s.Create("owner", "review")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetMember("owner", p.ID, "member", RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetActive("stranger", p.ID); err != ErrProjectNotFound {
+		t.Errorf("expected a non-member not to work in the project, got %v", err)
+	}
+	if err := s.SetActive("member", p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if active, ok, err := s.Active("member"); err != nil || !ok || active.ID != p.ID {
+		t.Errorf("expected the member to work in the project, got %v %v %v", active, ok, err)
+	}
+	if projects, err := s.List("member"); err != nil || len(projects) != 1 {
+		t.Errorf("expected the member to list the project, got %v %v", projects, err)
+	}
+
+	// A member that is removed from the project returns to their personal workspace.
+	if _, err := s.SetMember("owner", p.ID, "member", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.Active("member"); err != nil || ok {
+		t.Errorf("expected a removed member to work in their personal workspace, got %v %v", ok, err)
+	}
+	if projects, err := s.List("member"); err != nil || len(projects) != 0 {
+		t.Errorf("expected a removed member not to list the project, got %v %v", projects, err)
+	}
+
+	if err := s.SetActive("owner", p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetActive("owner", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.Active("owner"); err != nil || ok {
+		t.Errorf("expected the owner to return to their personal workspace, got %v %v", ok, err)
+	}
+}
+
+func TestRequirePluginRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		role      Role
+		method    string
+		accepts   bool
+		forbidden bool
+	}{
+		{RoleViewer, http.MethodGet, false, false},
+		{RoleViewer, http.MethodPost, false, true},
+		{RoleViewer, http.MethodPost, true, false},
+		{RoleViewer, http.MethodDelete, true, true},
+		{RoleEditor, http.MethodPost, false, false},
+		{RoleEditor, http.MethodDelete, false, false},
+		{"", http.MethodGet, false, true},
+	}
+	for _, tt := range tests {
+		g := gin.New()
+		g.Handle(tt.method, "/plugin/test", func(c *gin.Context) {
+			c.Set(workspaceContextKey, Workspace{Key: projectPrefix + "1", Username: "user", Project: Project{ID: "1", Name: "review"}, Role: tt.role})
+		}, Server{}.RequirePluginRole(PluginDetails{AcceptsQueryPosts: tt.accepts}), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(tt.method, "/plugin/test", nil))
+		if forbidden := rec.Code == http.StatusForbidden; forbidden != tt.forbidden {
+			t.Errorf("%s %s (accepts query posts: %v): expected forbidden: %v, got status %d", tt.role, tt.method, tt.accepts, tt.forbidden, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package searchrefiner
+
+import (
+	"errors"
+	"github.com/hscells/quickumlsrest"
+	"sort"
+	"strings"
+)
+
+// SuggestionSourceQuiche suggests the names of the UMLS concepts a term maps to in the QuickUMLS cache.
+const SuggestionSourceQuiche = "Quiche"
+
+// quicheSynonymWeight discounts synonyms of a concept relative to its preferred name.
+const quicheSynonymWeight = 0.9
+
+// QuicheIndex maps the terms in a QuickUMLS (quiche) cache to UMLS concepts, and concepts to the terms
+// that name them, so that the preferred names and synonyms of a concept can be found without MetaMap.
+type QuicheIndex struct {
+	cache    quickumlsrest.Cache
+	concepts map[string][]quickumlsrest.Candidate
+}
+
+// NewQuicheIndex indexes the concepts in a quiche cache.
+func NewQuicheIndex(c quickumlsrest.Cache) *QuicheIndex {
+	q := &QuicheIndex{cache: c, concepts: make(map[string][]quickumlsrest.Candidate)}
+	seen := make(map[string]bool)
+	for _, candidates := range c {
+		for _, candidate := range candidates {
+			key := candidate.CUI + "\x00" + strings.ToLower(candidate.Term)
+			if len(candidate.Term) == 0 || seen[key] {
+				continue
+			}
+			seen[key] = true
+			q.concepts[candidate.CUI] = append(q.concepts[candidate.CUI], candidate)
+		}
+	}
+	return q
+}
+
+// Match finds the concepts of a term. When the term is not in the cache, the concepts of each of its
+// words are used instead.
+func (q *QuicheIndex) Match(term string) []quickumlsrest.Candidate {
+	term = strings.ToLower(strings.TrimSpace(term))
+	if candidates, ok := q.cache[term]; ok {
+		return candidates
+	}
+	var candidates []quickumlsrest.Candidate
+	for _, word := range strings.Fields(term) {
+		candidates = append(candidates, q.cache[word]...)
+	}
+	return candidates
+}
+
+// Synonyms are the terms that name a concept.
+func (q *QuicheIndex) Synonyms(cui string) []quickumlsrest.Candidate {
+	return q.concepts[cui]
+}
+
+// getQuicheWordRanking suggests the preferred names and synonyms of the concepts that a term maps to.
+// Each name is scored by how similar the term is to its concept, with preferred names ranked above synonyms.
+func (s Server) getQuicheWordRanking(word string, size int) ([]suggestion, error) {
+	if s.Quiche == nil {
+		return nil, errors.New("the quiche cache has not been loaded")
+	}
+
+	if size == 0 {
+		size = s.Config.Services.DefaultRetSize
+	} else if size > s.Config.Services.MaxRetSize {
+		size = s.Config.Services.MaxRetSize
+	}
+
+	scores := make(map[string]float64)
+	for _, concept := range s.Quiche.Match(word) {
+		for _, synonym := range s.Quiche.Synonyms(concept.CUI) {
+			term := strings.ToLower(synonym.Term)
+			if term == strings.ToLower(strings.TrimSpace(word)) {
+				continue
+			}
+			score := concept.Similarity
+			if synonym.Preferred == 0 {
+				score *= quicheSynonymWeight
+			}
+			if score > scores[term] {
+				scores[term] = score
+			}
+		}
+	}
+
+	ret := make([]suggestion, 0, len(scores))
+	for term, score := range scores {
+		ret = append(ret, suggestion{Score: score, Term: term, Source: SuggestionSourceQuiche})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Score == ret[j].Score {
+			return ret[i].Term < ret[j].Term
+		}
+		return ret[i].Score > ret[j].Score
+	})
+
+	if len(ret) < size {
+		return ret, nil
+	}
+	return ret[:size], nil
+}
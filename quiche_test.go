@@ -0,0 +1,98 @@
+package searchrefiner
+
+import (
+	"github.com/hscells/quickumlsrest"
+	"reflect"
+	"testing"
+)
+
+// testQuiche is a quiche cache of two concepts. Heart attack (C0027051) is named by its preferred name and two
+// synonyms, and heart (C0018787) only by its preferred name.
+func testQuiche() *QuicheIndex {
+	attack := []quickumlsrest.Candidate{
+		{CUI: "C0027051", Term: "Myocardial Infarction", Preferred: 1, Similarity: 1},
+		{CUI: "C0027051", Term: "heart attack", Similarity: 1},
+		{CUI: "C0027051", Term: "MI", Similarity: 1},
+	}
+	return NewQuicheIndex(quickumlsrest.Cache{
+		"heart attack":          {{CUI: "C0027051", Term: "heart attack", Similarity: 1}},
+		"myocardial infarction": attack,
+		"heart":                 {{CUI: "C0018787", Term: "Heart", Preferred: 1, Similarity: 0.8}},
+		"attack":                {{CUI: "C0027051", Term: "heart attack", Similarity: 0.5}},
+		// The same name of a concept under another term is only indexed once.
+		"infarction": {{CUI: "C0027051", Term: "myocardial infarction", Preferred: 1, Similarity: 0.7}},
+	})
+}
+
+func TestQuicheIndexMatch(t *testing.T) {
+	q := testQuiche()
+	tests := []struct {
+		term string
+		cuis []string
+	}{
+		{" Heart Attack ", []string{"C0027051"}},
+		{"heart failure", []string{"C0018787"}},
+		{"attack on the heart", []string{"C0027051", "C0018787"}},
+		{"lung", nil},
+	}
+	for _, tt := range tests {
+		var cuis []string
+		for _, c := range q.Match(tt.term) {
+			cuis = append(cuis, c.CUI)
+		}
+		if !reflect.DeepEqual(cuis, tt.cuis) {
+			t.Errorf("%q: expected the concepts %v, got %v", tt.term, tt.cuis, cuis)
+		}
+	}
+	if synonyms := q.Synonyms("C0027051"); len(synonyms) != 3 {
+		t.Errorf("expected three names of heart attack, got %+v", synonyms)
+	}
+}
+
+func TestGetQuicheWordRanking(t *testing.T) {
+	s := Server{Quiche: testQuiche()}
+	s.Config.Services.DefaultRetSize = 10
+	s.Config.Services.MaxRetSize = 2
+	tests := []struct {
+		word     string
+		size     int
+		expected []suggestion
+	}{
+		// Preferred names rank above synonyms, and the term itself is not suggested.
+		{"Heart Attack", 0, []suggestion{
+			{Score: 1, Term: "myocardial infarction", Source: SuggestionSourceQuiche},
+			{Score: 0.9, Term: "mi", Source: SuggestionSourceQuiche},
+		}},
+		// Each word is matched when the term is not in the cache.
+		{"heart failure", 0, []suggestion{
+			{Score: 0.8, Term: "heart", Source: SuggestionSourceQuiche},
+		}},
+		{"acute heart attack", 0, []suggestion{
+			{Score: 0.8, Term: "heart", Source: SuggestionSourceQuiche},
+			{Score: 0.5, Term: "myocardial infarction", Source: SuggestionSourceQuiche},
+			{Score: 0.45, Term: "heart attack", Source: SuggestionSourceQuiche},
+			{Score: 0.45, Term: "mi", Source: SuggestionSourceQuiche},
+		}},
+		// The number of suggestions is capped.
+		{"myocardial infarction", 5, []suggestion{
+			{Score: 0.9, Term: "heart attack", Source: SuggestionSourceQuiche},
+			{Score: 0.9, Term: "mi", Source: SuggestionSourceQuiche},
+		}},
+		{"myocardial infarction", 1, []suggestion{
+			{Score: 0.9, Term: "heart attack", Source: SuggestionSourceQuiche},
+		}},
+	}
+	for _, tt := range tests {
+		ret, err := s.getQuicheWordRanking(tt.word, tt.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ret, tt.expected) {
+			t.Errorf("%q: expected %+v, got %+v", tt.word, tt.expected, ret)
+		}
+	}
+
+	if _, err := (Server{}).getQuicheWordRanking("heart", 0); err == nil {
+		t.Error("expected an error when the quiche cache has not been loaded")
+	}
+}
@@ -0,0 +1,95 @@
+// Command example is a minimal remote plugin, which greets the user that requests it with the greeting it is
+// configured with, and counts the queries that have been run. To try it, build it as the executable of a plugin
+// directory of searchrefiner:
+//
+//	go build -o plugin/example/plugin ./remote/example
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ielab/searchrefiner/remote"
+	"html"
+	"log"
+	"net/http"
+	"sync"
+)
+
+type example struct {
+	mu       sync.Mutex
+	started  bool
+	greeting string
+	queries  int
+}
+
+func (e *example) Configure(config json.RawMessage) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.greeting = "Hello"
+	if len(config) == 0 {
+		return nil
+	}
+	var c struct {
+		Greeting string
+	}
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return err
+	}
+	if len(c.Greeting) > 0 {
+		e.greeting = c.Greeting
+	}
+	return nil
+}
+
+func (e *example) Startup() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.started = true
+}
+
+func (e *example) HandleEvent(ev remote.Event) {
+	if ev.Type == "QueryExecuted" {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.queries++
+	}
+}
+
+func (e *example) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := remote.FromRequest(r)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch r.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<p>%s, <b>%s</b>, working in %s as %s.</p><p><a href="%s/status">Status</a></p>`,
+			html.EscapeString(e.greeting), html.EscapeString(req.User), html.EscapeString(req.Workspace), req.Role, req.Prefix)
+	case "/status":
+		fmt.Fprintf(w, "started: %t, queries: %d", e.started, e.queries)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (e *example) Health() error {
+	return nil
+}
+
+func (e *example) Shutdown(ctx context.Context) error {
+	log.Println("example plugin shutting down")
+	return nil
+}
+
+func main() {
+	log.Fatalln(remote.Serve(remote.Details{
+		Title:       "Example",
+		Description: "A minimal plugin that runs as a separate process.",
+		Author:      "ielab",
+		Version:     "0.0.1",
+		ProjectURL:  "https://ielab.io/searchrefiner",
+		Permission:  remote.PermissionUser,
+		Events:      []string{"QueryExecuted"},
+	}, &example{}))
+}
@@ -0,0 +1,216 @@
+// Package remote is the protocol between searchrefiner and plugins that run as separate processes. Unlike plugins
+// loaded from a plugin.so file, a remote plugin does not have to be built with the same Go toolchain and
+// dependencies as the server, and a plugin that crashes does not take the server down with it.
+//
+// searchrefiner starts the executable named "plugin" in the directory of the plugin, with the path of a Unix socket
+// in the SEARCHREFINER_PLUGIN_SOCKET environment variable. The plugin serves HTTP on that socket: the details of
+// the plugin are requested from DetailsPath, the configuration of the plugin is posted to ConfigurePath,
+// StartupPath is posted to once the server has started, HealthPath is requested to check the health of the plugin,
+// EventPath is posted an Event for each event the plugin listed in its details, and ShutdownPath is posted to
+// before the server exits. Every other request is a request to /plugin/<name> that the server has proxied, with
+// /plugin/<name> stripped from the path and the user that made it described by the X-Searchrefiner headers. A
+// plugin written in Go only needs to call Serve:
+//
+//	func main() {
+//		log.Fatalln(remote.Serve(remote.Details{Title: "Example", Permission: remote.PermissionUser}, handler))
+//	}
+//
+// This package only depends on the standard library, so that importing it does not tie a plugin to the
+// dependencies of searchrefiner.
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// SocketEnv is the environment variable that holds the path of the socket a plugin must listen on.
+const SocketEnv = "SEARCHREFINER_PLUGIN_SOCKET"
+
+// Paths that searchrefiner requests from a plugin itself, rather than on behalf of a user.
+const (
+	DetailsPath   = "/_searchrefiner/details"
+	ConfigurePath = "/_searchrefiner/configure"
+	StartupPath   = "/_searchrefiner/startup"
+	HealthPath    = "/_searchrefiner/health"
+	EventPath     = "/_searchrefiner/event"
+	ShutdownPath  = "/_searchrefiner/shutdown"
+)
+
+// Headers that describe the user a proxied request was made by. searchrefiner removes them from the requests it
+// receives, so a plugin can trust them.
+const (
+	// HeaderUser is the username of the user, and is empty when they are not logged in.
+	HeaderUser = "X-Searchrefiner-User"
+	// HeaderWorkspace is the key of the workspace the user is working in: their username, or the project they
+	// have made active.
+	HeaderWorkspace = "X-Searchrefiner-Workspace"
+	// HeaderRole is the role of the user in their workspace.
+	HeaderRole = "X-Searchrefiner-Role"
+	// HeaderPrefix is the path the plugin is served under, e.g., /plugin/example, for building links.
+	HeaderPrefix = "X-Searchrefiner-Prefix"
+)
+
+// Permissions that may be required to use a plugin, which are the same as those of plugins loaded from plugin.so.
+const (
+	PermissionAdmin = iota
+	PermissionUser
+	PermissionPublic
+)
+
+// Details are the details of a plugin shown on the plugins page of searchrefiner, and the permission needed to use
+// it.
+type Details struct {
+	Title       string
+	Description string
+	Author      string
+	Version     string
+	ProjectURL  string
+
+	AcceptsQueryPosts bool
+	Permission        int
+	// Events are the events the plugin is sent, e.g., "QueryExecuted". The events are those of the EventBus of
+	// searchrefiner: QueryParsed, QueryExecuted, SeedsChanged, and UserLoggedIn.
+	Events []string
+}
+
+// Event is an event of searchrefiner. Data is the event encoded as JSON, with the fields of the event of the same
+// Type in searchrefiner.
+type Event struct {
+	Type string
+	Data json.RawMessage
+}
+
+// Request is who a proxied request was made by.
+type Request struct {
+	User      string
+	Workspace string
+	Role      string
+	Prefix    string
+}
+
+// FromRequest reads who a proxied request was made by from its headers.
+func FromRequest(r *http.Request) Request {
+	return Request{
+		User:      r.Header.Get(HeaderUser),
+		Workspace: r.Header.Get(HeaderWorkspace),
+		Role:      r.Header.Get(HeaderRole),
+		Prefix:    r.Header.Get(HeaderPrefix),
+	}
+}
+
+// Starter may be implemented by the handler of a plugin to be told when searchrefiner has started.
+type Starter interface {
+	Startup()
+}
+
+// Configurer may be implemented by the handler of a plugin to receive its configuration from config.json.
+type Configurer interface {
+	Configure(config json.RawMessage) error
+}
+
+// HealthChecker may be implemented by the handler of a plugin to report that something it depends on is down.
+type HealthChecker interface {
+	Health() error
+}
+
+// EventHandler may be implemented by the handler of a plugin to receive the events listed in its details.
+type EventHandler interface {
+	HandleEvent(e Event)
+}
+
+// Shutdowner may be implemented by the handler of a plugin to flush its state before searchrefiner exits.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// Handler serves the requests that searchrefiner makes of a plugin itself, and passes all other requests to h.
+func Handler(d Details, h http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(DetailsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
+	})
+	mux.HandleFunc(ConfigurePath, func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := h.(Configurer); ok {
+			b, err := ioutil.ReadAll(r.Body)
+			if err == nil {
+				err = c.Configure(b)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc(StartupPath, func(w http.ResponseWriter, r *http.Request) {
+		if s, ok := h.(Starter); ok {
+			s.Startup()
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc(HealthPath, func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := h.(HealthChecker); ok {
+			if err := c.Health(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc(EventPath, func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := h.(EventHandler); ok {
+			var e Event
+			if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			h.HandleEvent(e)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc(ShutdownPath, func(w http.ResponseWriter, r *http.Request) {
+		if s, ok := h.(Shutdowner); ok {
+			if err := s.Shutdown(r.Context()); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.Handle("/", h)
+	return mux
+}
+
+// Serve listens on the socket that searchrefiner started the plugin with, and serves the plugin on it.
+func Serve(d Details, h http.Handler) error {
+	socket := os.Getenv(SocketEnv)
+	if len(socket) == 0 {
+		return errors.New(SocketEnv + " is not set; remote plugins are started by searchrefiner")
+	}
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	// The plugin exits with searchrefiner, which is noticed by the plugin being adopted by another process.
+	go func(parent int) {
+		for range time.Tick(time.Second) {
+			if os.Getppid() != parent {
+				l.Close()
+				os.Exit(0)
+			}
+		}
+	}(os.Getppid())
+
+	return http.Serve(l, Handler(d, h))
+}
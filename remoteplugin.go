@@ -0,0 +1,368 @@
+package searchrefiner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ielab/searchrefiner/remote"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemotePluginExecutable is the name of the executable in the directory of a plugin that is run as a remote plugin.
+const RemotePluginExecutable = "plugin"
+
+const (
+	// remoteStartTimeout bounds how long a remote plugin may take to start listening on its socket.
+	remoteStartTimeout = 10 * time.Second
+	// remoteMaxBackoff bounds how long the supervisor waits before restarting a remote plugin that keeps exiting.
+	remoteMaxBackoff = time.Minute
+	// remoteEventQueue bounds how many events may wait to be sent to a remote plugin before further events are
+	// dropped.
+	remoteEventQueue = 256
+)
+
+// RemotePlugin is a plugin that runs as a separate process, which searchrefiner talks to over a Unix socket using
+// the protocol in the remote package. It implements Plugin, so it is registered like plugins loaded from plugin.so,
+// and the process is restarted whenever it exits.
+type RemotePlugin struct {
+	Name string
+	URL  string
+
+	dir     string
+	socket  string
+	client  *http.Client
+	proxy   *httputil.ReverseProxy
+	details remote.Details
+
+	subscribe sync.Once
+	events    chan remote.Event
+
+	// mu guards the configuration, which the supervisor sends to the plugin again after restarting it, and the
+	// state of the process.
+	mu      sync.Mutex
+	config  json.RawMessage
+	cmd     *exec.Cmd
+	running bool
+	stopped bool
+}
+
+// IsRemotePlugin reports whether the plugin in dir is run as a separate process.
+func IsRemotePlugin(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, RemotePluginExecutable))
+	return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+}
+
+// StartRemotePlugin starts the remote plugin in dir, which is served at url, and supervises it.
+func StartRemotePlugin(dir, url string) (*RemotePlugin, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(dir)
+	p := &RemotePlugin{
+		Name:   name,
+		URL:    url,
+		dir:    dir,
+		socket: filepath.Join(os.TempDir(), fmt.Sprintf("searchrefiner-%d-%s.sock", os.Getpid(), name)),
+	}
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", p.socket)
+	}
+	p.client = &http.Client{Transport: &http.Transport{DialContext: dial}, Timeout: remoteStartTimeout}
+	p.proxy = &httputil.ReverseProxy{
+		Director:  p.direct,
+		Transport: &http.Transport{DialContext: dial},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Errorf("[remote] %s: %v", p.Name, err)
+			http.Error(w, fmt.Sprintf("plugin %s is unavailable", p.Name), http.StatusBadGateway)
+		},
+	}
+
+	cmd, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Get("http://plugin" + remote.DetailsPath)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("details request returned status %d", resp.StatusCode)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&p.details)
+		}
+	}
+	if err != nil {
+		// The process is not supervised yet, so it is waited for here so that it does not linger as a zombie.
+		p.Stop()
+		cmd.Wait()
+		return nil, fmt.Errorf("plugin %s: %v", name, err)
+	}
+	go p.supervise(cmd)
+	return p, nil
+}
+
+// start runs the executable of the plugin, and waits until it is listening on its socket.
+func (p *RemotePlugin) start() (*exec.Cmd, error) {
+	os.Remove(p.socket)
+	cmd := exec.Command(filepath.Join(p.dir, RemotePluginExecutable))
+	cmd.Dir = p.dir
+	cmd.Env = append(os.Environ(), remote.SocketEnv+"="+p.socket)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("plugin %s has been stopped", p.Name)
+	}
+	err := cmd.Start()
+	if err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	p.cmd = cmd
+	p.running = true
+	p.mu.Unlock()
+
+	for deadline := time.Now().Add(remoteStartTimeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		conn, err := net.Dial("unix", p.socket)
+		if err == nil {
+			conn.Close()
+			return cmd, nil
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	return nil, fmt.Errorf("plugin %s did not listen on %s within %s", p.Name, p.socket, remoteStartTimeout)
+}
+
+// supervise restarts the process of the plugin whenever it exits, backing off while it keeps exiting.
+func (p *RemotePlugin) supervise(cmd *exec.Cmd) {
+	backoff := time.Second
+	for {
+		began := time.Now()
+		err := cmd.Wait()
+		p.mu.Lock()
+		p.running = false
+		stopped := p.stopped
+		p.mu.Unlock()
+		if stopped {
+			return
+		}
+		// A plugin that ran for a while before exiting is restarted straight away.
+		if time.Since(began) > remoteMaxBackoff {
+			log.Errorf("[remote] %s exited (%v), restarting", p.Name, err)
+			backoff = time.Second
+		} else {
+			log.Errorf("[remote] %s exited (%v), restarting in %s", p.Name, err, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > remoteMaxBackoff {
+				backoff = remoteMaxBackoff
+			}
+		}
+		for {
+			cmd, err = p.start()
+			if err == nil {
+				break
+			}
+			log.Errorf("[remote] %v", err)
+			p.mu.Lock()
+			stopped := p.stopped
+			p.mu.Unlock()
+			if stopped {
+				return
+			}
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > remoteMaxBackoff {
+				backoff = remoteMaxBackoff
+			}
+		}
+		log.Infof("[remote] %s restarted", p.Name)
+		p.mu.Lock()
+		config := p.config
+		p.mu.Unlock()
+		if err := p.Configure(config); err != nil {
+			log.Errorf("[remote] %s: %v", p.Name, err)
+		}
+		p.Startup(ServerConfiguration)
+	}
+}
+
+// Stop stops the process of the plugin, and stops it from being restarted.
+func (p *RemotePlugin) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	if p.cmd != nil && p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+	os.Remove(p.socket)
+}
+
+// direct rewrites a request to /plugin/<name>/... into a request to the plugin.
+func (p *RemotePlugin) direct(r *http.Request) {
+	r.URL.Scheme = "http"
+	r.URL.Host = "plugin"
+	r.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, path.Clean("/"+p.URL)), "/")
+	r.URL.RawPath = ""
+	r.Host = "plugin"
+}
+
+// post posts to one of the paths that the plugin serves for searchrefiner, returning the error it responds with.
+func (p *RemotePlugin) post(ctx context.Context, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://plugin"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return p.do(req)
+}
+
+func (p *RemotePlugin) do(req *http.Request) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s", strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// Configure sends the plugin its configuration, which it is sent again whenever it is restarted.
+func (p *RemotePlugin) Configure(config json.RawMessage) error {
+	p.mu.Lock()
+	p.config = config
+	p.mu.Unlock()
+	return p.post(context.Background(), remote.ConfigurePath, config)
+}
+
+// Health reports whether the process of the plugin is running, and whether the plugin reports that it is healthy.
+func (p *RemotePlugin) Health() error {
+	p.mu.Lock()
+	running := p.running
+	p.mu.Unlock()
+	if !running {
+		return fmt.Errorf("plugin %s is not running", p.Name)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://plugin"+remote.HealthPath, nil)
+	if err != nil {
+		return err
+	}
+	return p.do(req)
+}
+
+// Shutdown asks the plugin to flush its state, and then stops its process.
+func (p *RemotePlugin) Shutdown(ctx context.Context) error {
+	defer p.Stop()
+	return p.post(ctx, remote.ShutdownPath, nil)
+}
+
+func (p *RemotePlugin) Startup(s Server) {
+	p.subscribe.Do(func() { p.subscribeEvents(s.Events) })
+	err := p.post(context.Background(), remote.StartupPath, nil)
+	if err != nil {
+		log.Errorf("[remote] %s: %v", p.Name, err)
+	}
+}
+
+// subscribeEvents subscribes to the events the plugin listed in its details. The events are sent to the plugin in
+// the order they were published by a goroutine of their own, so that a slow plugin does not hold up the requests
+// that publish them.
+func (p *RemotePlugin) subscribeEvents(b *EventBus) {
+	if len(p.details.Events) == 0 {
+		return
+	}
+	p.events = make(chan remote.Event, remoteEventQueue)
+	go p.sendEvents()
+	for _, event := range p.details.Events {
+		event := event
+		switch event {
+		case "QueryParsed":
+			b.OnQueryParsed(func(e QueryParsed) { p.queueEvent(event, e) })
+		case "QueryExecuted":
+			b.OnQueryExecuted(func(e QueryExecuted) { p.queueEvent(event, e) })
+		case "SeedsChanged":
+			b.OnSeedsChanged(func(e SeedsChanged) { p.queueEvent(event, e) })
+		case "UserLoggedIn":
+			b.OnUserLoggedIn(func(e UserLoggedIn) { p.queueEvent(event, e) })
+		default:
+			log.Errorf("[remote] %s: unknown event %s", p.Name, event)
+		}
+	}
+}
+
+func (p *RemotePlugin) queueEvent(event string, e interface{}) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("[remote] %s: %s: %v", p.Name, event, err)
+		return
+	}
+	select {
+	case p.events <- remote.Event{Type: event, Data: b}:
+	default:
+		log.Errorf("[remote] %s: dropped a %s event, as the plugin is not keeping up", p.Name, event)
+	}
+}
+
+func (p *RemotePlugin) sendEvents() {
+	for e := range p.events {
+		b, err := json.Marshal(e)
+		if err == nil {
+			err = p.post(context.Background(), remote.EventPath, b)
+		}
+		if err != nil {
+			log.Errorf("[remote] %s: %s: %v", p.Name, e.Type, err)
+		}
+	}
+}
+
+// Serve proxies a request to the plugin, describing the user that made it in the headers of the request.
+func (p *RemotePlugin) Serve(s Server, c *gin.Context) {
+	for _, h := range []string{remote.HeaderUser, remote.HeaderWorkspace, remote.HeaderRole, remote.HeaderPrefix} {
+		c.Request.Header.Del(h)
+	}
+	username := s.Perm.UserState().Username(c.Request)
+	if len(username) > 0 {
+		ws, err := s.Workspace(c)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Request.Header.Set(remote.HeaderUser, ws.Username)
+		c.Request.Header.Set(remote.HeaderWorkspace, ws.Key)
+		c.Request.Header.Set(remote.HeaderRole, string(ws.Role))
+	}
+	c.Request.Header.Set(remote.HeaderPrefix, path.Clean("/"+p.URL))
+	p.proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+func (p *RemotePlugin) PermissionType() PluginPermission {
+	return PluginPermission(p.details.Permission)
+}
+
+func (p *RemotePlugin) Details() PluginDetails {
+	return PluginDetails{
+		Title:             p.details.Title,
+		Description:       p.details.Description,
+		Author:            p.details.Author,
+		Version:           p.details.Version,
+		ProjectURL:        p.details.ProjectURL,
+		AcceptsQueryPosts: p.details.AcceptsQueryPosts,
+	}
+}
@@ -0,0 +1,122 @@
+package searchrefiner
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ielab/searchrefiner/remote"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testPluginEnv makes the test binary serve as a remote plugin, so that it can be started by StartRemotePlugin.
+const testPluginEnv = "SEARCHREFINER_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(testPluginEnv) {
+	case "serve":
+		log.Fatalln(remote.Serve(remote.Details{Title: "test", Permission: remote.PermissionUser}, http.NotFoundHandler()))
+	case "broken":
+		// A plugin that listens on its socket, but fails to describe itself. It records its PID in its directory.
+		err := ioutil.WriteFile("pid", []byte(strconv.Itoa(os.Getpid())), 0644)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		l, err := net.Listen("unix", os.Getenv(remote.SocketEnv))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Fatalln(http.Serve(l, http.NotFoundHandler()))
+	}
+	os.Exit(m.Run())
+}
+
+// testRemotePluginDir creates a plugin directory with the test binary as the executable of a remote plugin, which
+// serves as the plugin in mode.
+func testRemotePluginDir(t *testing.T, mode string) string {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "test")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(exe, filepath.Join(dir, RemotePluginExecutable)); err != nil {
+		t.Fatal(err)
+	}
+	// The supervisor starts the plugin again with the same environment, so it is kept until the test has finished.
+	os.Setenv(testPluginEnv, mode)
+	t.Cleanup(func() { os.Unsetenv(testPluginEnv) })
+	return dir
+}
+
+// testRemotePlugin starts the test binary as a remote plugin.
+func testRemotePlugin(t *testing.T) *RemotePlugin {
+	t.Helper()
+	p, err := StartRemotePlugin(testRemotePluginDir(t, "serve"), "plugin/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Stop)
+	return p
+}
+
+// TestRemotePluginConfigureWhileRestarting configures a remote plugin while its supervisor restarts it, and sends
+// it its configuration again. Run with -race.
+func TestRemotePluginConfigureWhileRestarting(t *testing.T) {
+	p := testRemotePlugin(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// The plugin is not running while it restarts, so configuring it may fail.
+			p.Configure(json.RawMessage(fmt.Sprintf(`{"n": %d}`, i)))
+		}(i)
+	}
+	p.mu.Lock()
+	p.cmd.Process.Kill()
+	p.mu.Unlock()
+	wg.Wait()
+
+	deadline := time.Now().Add(remoteStartTimeout + 2*time.Second)
+	for p.Health() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the plugin was not restarted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestRemotePluginDetailsError checks that a plugin that fails to describe itself is stopped and waited for, rather
+// than left as a zombie.
+func TestRemotePluginDetailsError(t *testing.T) {
+	dir := testRemotePluginDir(t, "broken")
+	if _, err := StartRemotePlugin(dir, "plugin/test"); err == nil {
+		t.Fatal("expected a plugin that fails to describe itself not to start")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(string(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	var status syscall.WaitStatus
+	if wpid, _ := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); wpid == pid {
+		t.Errorf("process %d of the plugin was left as a zombie", pid)
+	}
+}
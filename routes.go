@@ -0,0 +1,70 @@
+package searchrefiner
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// PluginHandler handles a request to a route that a plugin registered.
+type PluginHandler func(Server, *gin.Context)
+
+// PluginRouter may be implemented by a plugin to register its own routes under its path, e.g.,
+// /plugin/queryvis/api/tree, rather than multiplexing every request through Serve. The path of the plugin itself is
+// still served by Serve.
+type PluginRouter interface {
+	Routes(r *PluginRoutes)
+}
+
+// PluginRoutes registers the routes of a plugin. Each route requires a permission, like a plugin does, and a role
+// in the workspace of the user.
+type PluginRoutes struct {
+	server     *Server
+	group      *gin.RouterGroup
+	permission PluginPermission
+}
+
+// NewPluginRoutes creates the routes of a plugin under a group, which by default require the permission of the
+// plugin. The server is a pointer so that handlers see the server as it is when they are called, rather than as it
+// was when they were registered.
+func NewPluginRoutes(s *Server, g *gin.RouterGroup, permission PluginPermission) *PluginRoutes {
+	return &PluginRoutes{server: s, group: g, permission: permission}
+}
+
+// RequirePermission is middleware that only lets administrators through for PluginAdmin, and logged in users
+// through for PluginUser.
+func (s Server) RequirePermission(permission PluginPermission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var ok bool
+		switch permission {
+		case PluginAdmin:
+			ok = s.Perm.UserState().AdminRights(c.Request)
+		case PluginUser:
+			ok = s.Perm.UserState().UserRights(c.Request)
+		default:
+			ok = true
+		}
+		if !ok {
+			c.HTML(http.StatusForbidden, "error.html", ErrorPage{Error: "unauthorised user", BackLink: "/"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Handle registers a route that requires a permission and a role in the workspace of the user.
+func (r *PluginRoutes) Handle(method, path string, permission PluginPermission, role Role, h PluginHandler) {
+	r.group.Handle(method, path, r.server.RequirePermission(permission), r.server.RequireRole(role), func(c *gin.Context) {
+		h(*r.server, c)
+	})
+}
+
+// GET registers a route for viewing, which requires the permission of the plugin and the viewer role.
+func (r *PluginRoutes) GET(path string, h PluginHandler) {
+	r.Handle(http.MethodGet, path, r.permission, RoleViewer, h)
+}
+
+// POST registers a route for making changes, which requires the permission of the plugin and the editor role.
+func (r *PluginRoutes) POST(path string, h PluginHandler) {
+	r.Handle(http.MethodPost, path, r.permission, RoleEditor, h)
+}
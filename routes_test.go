@@ -0,0 +1,85 @@
+package searchrefiner
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/xyproto/permissionbolt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestPluginRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	perm, err := permissionbolt.NewWithConf(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := make(map[string][]*http.Cookie)
+	for _, username := range []string{"admin", "editor", "viewer"} {
+		perm.UserState().AddUser(username, "password", username+"@example.com")
+		perm.UserState().MarkConfirmed(username)
+		login := httptest.NewRecorder()
+		if err := perm.UserState().Login(login, username); err != nil {
+			t.Fatal(err)
+		}
+		cookies[username] = login.Result().Cookies()
+	}
+	perm.UserState().SetAdminStatus("admin")
+
+	// The editor and the viewer work in a project that the administrator owns.
+	projects := testProjects(t)
+	p, err := projects.Create("admin", "review")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for username, role := range map[string]Role{"editor": RoleEditor, "viewer": RoleViewer} {
+		if _, err := projects.SetMember("admin", p.ID, username, role); err != nil {
+			t.Fatal(err)
+		}
+		if err := projects.SetActive(username, p.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Server{Perm: perm, Projects: projects}
+	g := gin.New()
+	g.SetHTMLTemplate(template.Must(template.New("error.html").Parse("{{ .Error }}")))
+	r := NewPluginRoutes(s, g.Group("/plugin/test"), PluginUser)
+	ok := func(s Server, c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+	r.GET("/view", ok)
+	r.POST("/edit", ok)
+	r.Handle(http.MethodPost, "/admin", PluginAdmin, RoleViewer, ok)
+	r.Handle(http.MethodGet, "/public", PluginPublic, RoleViewer, ok)
+
+	tests := []struct {
+		username, method, path string
+		status                 int
+	}{
+		{"", http.MethodGet, "/view", http.StatusForbidden},
+		{"viewer", http.MethodGet, "/view", http.StatusOK},
+		{"viewer", http.MethodPost, "/edit", http.StatusForbidden},
+		{"editor", http.MethodPost, "/edit", http.StatusOK},
+		{"admin", http.MethodPost, "/edit", http.StatusOK},
+		{"", http.MethodPost, "/admin", http.StatusForbidden},
+		{"editor", http.MethodPost, "/admin", http.StatusForbidden},
+		{"viewer", http.MethodPost, "/admin", http.StatusForbidden},
+		{"admin", http.MethodPost, "/admin", http.StatusOK},
+		{"", http.MethodGet, "/public", http.StatusOK},
+		{"viewer", http.MethodGet, "/public", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/plugin/test"+tt.path, nil)
+		for _, c := range cookies[tt.username] {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%q %s %s: expected %d, got %d: %s", tt.username, tt.method, tt.path, tt.status, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package searchrefiner
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/hscells/groove/combinator"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrSeedsNotFound  = errors.New("seed collection not found")
+	ErrSeedsNameEmpty = errors.New("seed collection must have a name")
+)
+
+var (
+	seedsBucket      = []byte("seeds")
+	seedsCollections = []byte("collections")
+	seedsActiveKey   = []byte("active")
+)
+
+const defaultSeedName = "Default"
+
+// SeedCollection is a named set of seed studies (known relevant PMIDs) that queries are evaluated against.
+type SeedCollection struct {
+	ID        string
+	Name      string
+	Documents combinator.Documents
+	// Source records where the seed studies came from, e.g., "manual" or the name of an imported file.
+	Source   string
+	Created  time.Time
+	Modified time.Time
+}
+
+// SeedStore persists the seed collections of each user and which one of them is active. As with the HistoryStore,
+// the collections of a project are stored under the key of its Workspace.
+type SeedStore struct {
+	db *bolt.DB
+}
+
+// NewSeedStore creates a seed collection store backed by an open bolt database.
+func NewSeedStore(db *bolt.DB) (*SeedStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(seedsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SeedStore{db: db}, nil
+}
+
+func seedKey(id string) ([]byte, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, ErrSeedsNotFound
+	}
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, n)
+	return k, nil
+}
+
+// userSeeds returns the bucket containing the collections of a user, creating it if the transaction is writable.
+func userSeeds(tx *bolt.Tx, username string) (*bolt.Bucket, error) {
+	if !tx.Writable() {
+		u := tx.Bucket(seedsBucket).Bucket([]byte(username))
+		if u == nil {
+			return nil, nil
+		}
+		return u.Bucket(seedsCollections), nil
+	}
+	u, err := tx.Bucket(seedsBucket).CreateBucketIfNotExists([]byte(username))
+	if err != nil {
+		return nil, err
+	}
+	return u.CreateBucketIfNotExists(seedsCollections)
+}
+
+func getSeedCollection(b *bolt.Bucket, id string) (SeedCollection, error) {
+	var sc SeedCollection
+	k, err := seedKey(id)
+	if err != nil {
+		return sc, err
+	}
+	v := b.Get(k)
+	if v == nil {
+		return sc, ErrSeedsNotFound
+	}
+	err = json.Unmarshal(v, &sc)
+	return sc, err
+}
+
+func putSeedCollection(b *bolt.Bucket, sc SeedCollection) error {
+	k, err := seedKey(sc.ID)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	return b.Put(k, v)
+}
+
+// List returns all of the collections of a user in the order they were created.
+func (s *SeedStore) List(username string) ([]SeedCollection, error) {
+	var collections []SeedCollection
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := userSeeds(tx, username)
+		if err != nil || b == nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var sc SeedCollection
+			if err := json.Unmarshal(v, &sc); err != nil {
+				return err
+			}
+			collections = append(collections, sc)
+			return nil
+		})
+	})
+	return collections, err
+}
+
+// Get returns a single collection of a user.
+func (s *SeedStore) Get(username, id string) (SeedCollection, error) {
+	var sc SeedCollection
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := userSeeds(tx, username)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			return ErrSeedsNotFound
+		}
+		sc, err = getSeedCollection(b, id)
+		return err
+	})
+	return sc, err
+}
+
+// Create adds a new collection for a user. If the user has no active collection, the new one becomes active.
+func (s *SeedStore) Create(username, name, source string, docs combinator.Documents) (SeedCollection, error) {
+	var sc SeedCollection
+	if len(name) == 0 {
+		return sc, ErrSeedsNameEmpty
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		sc, err = createSeedCollection(tx, username, name, source, docs)
+		return err
+	})
+	return sc, err
+}
+
+// createSeedCollection adds a new collection for a user within a writable transaction, making it active if the user
+// has no active collection.
+func createSeedCollection(tx *bolt.Tx, username, name, source string, docs combinator.Documents) (SeedCollection, error) {
+	var sc SeedCollection
+	b, err := userSeeds(tx, username)
+	if err != nil {
+		return sc, err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return sc, err
+	}
+	now := time.Now()
+	sc = SeedCollection{
+		ID:        strconv.FormatUint(seq, 10),
+		Name:      name,
+		Documents: docs,
+		Source:    source,
+		Created:   now,
+		Modified:  now,
+	}
+	err = putSeedCollection(b, sc)
+	if err != nil {
+		return sc, err
+	}
+	u := tx.Bucket(seedsBucket).Bucket([]byte(username))
+	if u.Get(seedsActiveKey) == nil {
+		return sc, u.Put(seedsActiveKey, []byte(sc.ID))
+	}
+	return sc, nil
+}
+
+// update applies fn to a collection of a user and stores the result.
+func (s *SeedStore) update(username, id string, fn func(sc *SeedCollection)) (SeedCollection, error) {
+	var sc SeedCollection
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := userSeeds(tx, username)
+		if err != nil {
+			return err
+		}
+		sc, err = getSeedCollection(b, id)
+		if err != nil {
+			return err
+		}
+		fn(&sc)
+		sc.Modified = time.Now()
+		return putSeedCollection(b, sc)
+	})
+	return sc, err
+}
+
+// Rename changes the name of a collection of a user.
+func (s *SeedStore) Rename(username, id, name string) (SeedCollection, error) {
+	if len(name) == 0 {
+		return SeedCollection{}, ErrSeedsNameEmpty
+	}
+	return s.update(username, id, func(sc *SeedCollection) {
+		sc.Name = name
+	})
+}
+
+// SetDocuments replaces the seed studies in a collection of a user and records where they came from.
+func (s *SeedStore) SetDocuments(username, id, source string, docs combinator.Documents) (SeedCollection, error) {
+	return s.update(username, id, func(sc *SeedCollection) {
+		sc.Documents = docs
+		sc.Source = source
+	})
+}
+
+// Delete removes a collection of a user. If it was the active collection, no collection is active afterwards.
+func (s *SeedStore) Delete(username, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := userSeeds(tx, username)
+		if err != nil {
+			return err
+		}
+		k, err := seedKey(id)
+		if err != nil {
+			return err
+		}
+		if b.Get(k) == nil {
+			return ErrSeedsNotFound
+		}
+		err = b.Delete(k)
+		if err != nil {
+			return err
+		}
+		u := tx.Bucket(seedsBucket).Bucket([]byte(username))
+		if string(u.Get(seedsActiveKey)) == id {
+			return u.Delete(seedsActiveKey)
+		}
+		return nil
+	})
+}
+
+// SetActive picks the collection of a user that queries are evaluated against.
+func (s *SeedStore) SetActive(username, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := userSeeds(tx, username)
+		if err != nil {
+			return err
+		}
+		if _, err := getSeedCollection(b, id); err != nil {
+			return err
+		}
+		return tx.Bucket(seedsBucket).Bucket([]byte(username)).Put(seedsActiveKey, []byte(id))
+	})
+}
+
+// Active returns the active collection of a user. The boolean is false if the user has no active collection.
+func (s *SeedStore) Active(username string) (SeedCollection, bool, error) {
+	var (
+		sc SeedCollection
+		ok bool
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		u := tx.Bucket(seedsBucket).Bucket([]byte(username))
+		if u == nil {
+			return nil
+		}
+		id := u.Get(seedsActiveKey)
+		if id == nil {
+			return nil
+		}
+		var err error
+		sc, err = getSeedCollection(u.Bucket(seedsCollections), string(id))
+		if err != nil {
+			return err
+		}
+		ok = true
+		return nil
+	})
+	return sc, ok, err
+}
+
+// Relevant returns the seed studies of the active collection of a user.
+func (s *SeedStore) Relevant(username string) (combinator.Documents, error) {
+	sc, _, err := s.Active(username)
+	return sc.Documents, err
+}
+
+// SetRelevant replaces the seed studies of the active collection of a user,
+// creating a default collection if the user does not have an active one.
+func (s *SeedStore) SetRelevant(username, source string, docs combinator.Documents) (SeedCollection, error) {
+	var sc SeedCollection
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := userSeeds(tx, username)
+		if err != nil {
+			return err
+		}
+		id := tx.Bucket(seedsBucket).Bucket([]byte(username)).Get(seedsActiveKey)
+		if id == nil {
+			sc, err = createSeedCollection(tx, username, defaultSeedName, source, docs)
+			return err
+		}
+		sc, err = getSeedCollection(b, string(id))
+		if err != nil {
+			return err
+		}
+		sc.Documents = docs
+		sc.Source = source
+		sc.Modified = time.Now()
+		return putSeedCollection(b, sc)
+	})
+	return sc, err
+}
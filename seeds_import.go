@@ -0,0 +1,402 @@
+package searchrefiner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/cqr"
+	"github.com/hscells/groove/combinator"
+	"github.com/hscells/transmute/fields"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	SeedFormatRIS     = "ris"
+	SeedFormatEndNote = "endnote"
+	SeedFormatNBIB    = "nbib"
+	SeedFormatPMID    = "pmid"
+)
+
+// seedRecord is a single citation read from an imported file.
+type seedRecord struct {
+	PMID   string `json:"pmid,omitempty"`
+	DOI    string `json:"doi,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type seedImportResponse struct {
+	Collection SeedCollection
+	Format     string
+	Records    int
+	Matched    int
+	Resolved   int
+	Unmatched  []seedRecord
+}
+
+var (
+	pubmedURLRegexp = regexp.MustCompile(`(?:pubmed\.ncbi\.nlm\.nih\.gov/|ncbi\.nlm\.nih\.gov/pubmed/)([0-9]+)`)
+	doiRegexp       = regexp.MustCompile(`10\.[0-9]{4,9}/\S+`)
+	pmidRegexp      = regexp.MustCompile(`^[0-9]{1,9}$`)
+	tagRegexp       = regexp.MustCompile(`^[A-Z][A-Z0-9]{1,3}$`)
+)
+
+// detectSeedFormat guesses the format of an imported file from its name and contents.
+func detectSeedFormat(filename string, b []byte) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".ris":
+		return SeedFormatRIS
+	case ".xml":
+		return SeedFormatEndNote
+	case ".nbib":
+		return SeedFormatNBIB
+	}
+	t := bytes.TrimSpace(b)
+	switch {
+	case bytes.HasPrefix(t, []byte("<")):
+		return SeedFormatEndNote
+	case bytes.Contains(t, []byte("TY  -")):
+		return SeedFormatRIS
+	case bytes.Contains(t, []byte("PMID-")):
+		return SeedFormatNBIB
+	}
+	return SeedFormatPMID
+}
+
+// extractDOI pulls a DOI out of a field value that may contain a URL or a "[doi]" suffix.
+func extractDOI(v string) string {
+	d := doiRegexp.FindString(v)
+	return strings.TrimRight(d, ".,;")
+}
+
+// extractPMID pulls a PMID out of an accession number or PubMed URL.
+func extractPMID(v string) string {
+	v = strings.TrimSpace(v)
+	if pmidRegexp.MatchString(v) {
+		return v
+	}
+	if m := pubmedURLRegexp.FindStringSubmatch(v); len(m) == 2 {
+		return m[1]
+	}
+	return ""
+}
+
+// parseTaggedRecords reads files made up of two-to-four letter tags followed by a dash, such as RIS and MEDLINE
+// (NBIB). The function tag is called for every tag and value, and end is called at the end of every record.
+func parseTaggedRecords(r io.Reader, tag func(t, v string), end func()) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 1024*1024), 10*1024*1024)
+	var t, v string
+	flush := func() {
+		if len(t) > 0 {
+			tag(t, strings.TrimSpace(v))
+		}
+		t, v = "", ""
+	}
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if len(strings.TrimSpace(line)) == 0 {
+			flush()
+			end()
+			continue
+		}
+		// Continuation lines are indented.
+		if strings.HasPrefix(line, "      ") && len(t) > 0 {
+			v += " " + strings.TrimSpace(line)
+			continue
+		}
+		i := strings.Index(line, "-")
+		if i < 2 || i > 6 || !tagRegexp.MatchString(strings.TrimSpace(line[:i])) {
+			// Wrapped lines that are not indented belong to the previous tag.
+			if len(t) > 0 {
+				v += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+		flush()
+		t = strings.TrimSpace(line[:i])
+		v = line[i+1:]
+	}
+	flush()
+	end()
+	return s.Err()
+}
+
+func parseRIS(r io.Reader) ([]seedRecord, error) {
+	var (
+		records []seedRecord
+		rec     seedRecord
+		open    bool
+	)
+	end := func() {
+		if open && (len(rec.PMID) > 0 || len(rec.DOI) > 0 || len(rec.Title) > 0) {
+			records = append(records, rec)
+		}
+		rec = seedRecord{}
+		open = false
+	}
+	err := parseTaggedRecords(r, func(t, v string) {
+		switch t {
+		case "TY":
+			open = true
+		case "ER":
+			end()
+		case "AN", "PM", "UR", "L2":
+			if p := extractPMID(v); len(p) > 0 && len(rec.PMID) == 0 {
+				rec.PMID = p
+			}
+		case "DO", "M3", "DI":
+			if d := extractDOI(v); len(d) > 0 && len(rec.DOI) == 0 {
+				rec.DOI = d
+			}
+		case "TI", "T1":
+			if len(rec.Title) == 0 {
+				rec.Title = v
+			}
+		}
+	}, func() {})
+	end()
+	return records, err
+}
+
+func parseNBIB(r io.Reader) ([]seedRecord, error) {
+	var (
+		records []seedRecord
+		rec     seedRecord
+	)
+	err := parseTaggedRecords(r, func(t, v string) {
+		switch t {
+		case "PMID":
+			rec.PMID = extractPMID(v)
+		case "LID", "AID":
+			if strings.HasSuffix(v, "[doi]") && len(rec.DOI) == 0 {
+				rec.DOI = extractDOI(v)
+			}
+		case "TI":
+			rec.Title = v
+		}
+	}, func() {
+		if len(rec.PMID) > 0 || len(rec.DOI) > 0 || len(rec.Title) > 0 {
+			records = append(records, rec)
+		}
+		rec = seedRecord{}
+	})
+	return records, err
+}
+
+// endnoteText is a field of an EndNote XML record, where text may be wrapped in style elements.
+type endnoteText struct {
+	Inner string `xml:",innerxml"`
+}
+
+func (e endnoteText) String() string {
+	var b strings.Builder
+	d := xml.NewDecoder(strings.NewReader(e.Inner))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		if c, ok := tok.(xml.CharData); ok {
+			b.Write(c)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+type endnoteRecord struct {
+	Title       endnoteText   `xml:"titles>title"`
+	DOI         endnoteText   `xml:"electronic-resource-num"`
+	Accession   endnoteText   `xml:"accession-num"`
+	RelatedURLs []endnoteText `xml:"urls>related-urls>url"`
+}
+
+func parseEndNote(r io.Reader) ([]seedRecord, error) {
+	var x struct {
+		Records []endnoteRecord `xml:"records>record"`
+	}
+	err := xml.NewDecoder(r).Decode(&x)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]seedRecord, len(x.Records))
+	for i, e := range x.Records {
+		records[i] = seedRecord{
+			PMID:  extractPMID(e.Accession.String()),
+			DOI:   extractDOI(e.DOI.String()),
+			Title: e.Title.String(),
+		}
+		if len(records[i].PMID) == 0 {
+			for _, u := range e.RelatedURLs {
+				if p := extractPMID(u.String()); len(p) > 0 {
+					records[i].PMID = p
+					break
+				}
+			}
+		}
+	}
+	return records, nil
+}
+
+func parsePMIDs(r io.Reader) ([]seedRecord, error) {
+	var records []seedRecord
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		for _, f := range strings.FieldsFunc(s.Text(), func(r rune) bool {
+			return r == ',' || r == ';' || r == ' ' || r == '\t'
+		}) {
+			if p := extractPMID(f); len(p) > 0 {
+				records = append(records, seedRecord{PMID: p})
+			} else {
+				records = append(records, seedRecord{Title: f, Reason: "not a PMID"})
+			}
+		}
+	}
+	return records, s.Err()
+}
+
+// parseSeedRecords reads the citations in a file of the given format.
+func parseSeedRecords(format string, r io.Reader) ([]seedRecord, error) {
+	switch format {
+	case SeedFormatRIS:
+		return parseRIS(r)
+	case SeedFormatNBIB:
+		return parseNBIB(r)
+	case SeedFormatEndNote:
+		return parseEndNote(r)
+	case SeedFormatPMID:
+		return parsePMIDs(r)
+	}
+	return nil, fmt.Errorf("unknown seed study format %s", format)
+}
+
+// resolveSeedRecord looks up the PMID of a record without one, first by DOI and then by title.
+// A record is only resolved when the search identifies exactly one article.
+func (s Server) resolveSeedRecord(rec seedRecord) (string, error) {
+	var queries []cqr.CommonQueryRepresentation
+	if len(rec.DOI) > 0 {
+		queries = append(queries, cqr.NewKeyword(fmt.Sprintf(`"%s"`, rec.DOI), fields.LocationID))
+	}
+	if len(rec.Title) > 0 {
+		t := strings.NewReplacer(`"`, "", "[", " ", "]", " ", "(", " ", ")", " ").Replace(rec.Title)
+		t = strings.TrimRight(strings.TrimSpace(t), ".")
+		if len(t) > 0 {
+			queries = append(queries, cqr.NewKeyword(fmt.Sprintf(`"%s"`, t), fields.Title))
+		}
+	}
+	for _, q := range queries {
+		pmids, err := s.Backend.Search(q, 0, 2)
+		if err != nil {
+			return "", err
+		}
+		if len(pmids) == 1 {
+			return strconv.Itoa(pmids[0]), nil
+		}
+	}
+	return "", nil
+}
+
+// ApiSettingsRelevantImport imports seed studies from an uploaded RIS, EndNote XML, NBIB, or PMID file.
+// The seed studies replace those in the active collection, or in a new collection if a name is given.
+func (s Server) ApiSettingsRelevantImport(c *gin.Context) {
+	ws, err := s.Workspace(c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	f, err := fh.Open()
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	format := c.PostForm("format")
+	if len(format) == 0 {
+		format = detectSeedFormat(fh.Filename, b)
+	}
+
+	records, err := parseSeedRecords(format, bytes.NewReader(b))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp := seedImportResponse{Format: format, Records: len(records)}
+	seen := make(map[combinator.Document]struct{})
+	var docs combinator.Documents
+	for _, rec := range records {
+		if len(rec.Reason) > 0 {
+			resp.Unmatched = append(resp.Unmatched, rec)
+			continue
+		}
+		pmid := rec.PMID
+		if len(pmid) == 0 {
+			pmid, err = s.resolveSeedRecord(rec)
+			if err != nil {
+				// A failed lookup only loses this record, not the rest of the import.
+				log.Warnf("[importseeds] could not resolve %+v: %v", rec, err)
+				rec.Reason = fmt.Sprintf("lookup failed: %v", err)
+				resp.Unmatched = append(resp.Unmatched, rec)
+				continue
+			}
+			if len(pmid) == 0 {
+				rec.Reason = "no unique match found by DOI or title"
+				resp.Unmatched = append(resp.Unmatched, rec)
+				continue
+			}
+			resp.Resolved++
+		}
+		id, err := strconv.ParseUint(pmid, 10, 32)
+		if err != nil {
+			rec.Reason = "invalid PMID"
+			resp.Unmatched = append(resp.Unmatched, rec)
+			continue
+		}
+		resp.Matched++
+		if _, ok := seen[combinator.Document(id)]; ok {
+			continue
+		}
+		seen[combinator.Document(id)] = struct{}{}
+		docs = append(docs, combinator.Document(id))
+	}
+
+	source := fmt.Sprintf("import:%s:%s", format, fh.Filename)
+	if name, ok := c.GetPostForm("name"); ok && len(name) > 0 {
+		resp.Collection, err = s.Seeds.Create(ws.Key, name, source, docs)
+		if err == nil {
+			err = s.Seeds.SetActive(ws.Key, resp.Collection.ID)
+		}
+	} else {
+		resp.Collection, err = s.Seeds.SetRelevant(ws.Key, source, docs)
+	}
+	if err != nil {
+		seedsError(c, err)
+		return
+	}
+
+	s.Events.PublishSeedsChanged(SeedsChanged{Workspace: ws, Change: SeedsImported, Collection: resp.Collection})
+
+	log.Infof("[importseeds] %s:%s:%s:%d:%d", ws.Username, ws.Key, source, resp.Matched, len(resp.Unmatched))
+	c.JSON(http.StatusOK, resp)
+}
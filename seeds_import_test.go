@@ -0,0 +1,226 @@
+package searchrefiner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/cqr"
+	"github.com/hscells/groove/combinator"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readSeedFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "seeds", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseSeedRecords(t *testing.T) {
+	tests := []struct {
+		file, format string
+		expected     []seedRecord
+	}{
+		{"seeds.ris", SeedFormatRIS, []seedRecord{
+			{PMID: "90000001", DOI: "10.1000/early.statin", Title: "Early statin therapy after acute myocardial infarction"},
+			{DOI: "10.1000/only.doi", Title: "A record with only a DOI"},
+			{Title: "A title that is wrapped over two lines"},
+			{PMID: "90000003"},
+			{Title: "A record that is never ended"},
+		}},
+		{"seeds.nbib", SeedFormatNBIB, []seedRecord{
+			{PMID: "90000001", DOI: "10.1000/early.statin", Title: "Early statin therapy after acute myocardial infarction: a randomized controlled trial."},
+			{PMID: "90000002", DOI: "10.1000/statins.older", Title: "Statins for the primary prevention of cardiovascular disease in older adults."},
+			{Title: "A record with only a title"},
+		}},
+		{"seeds.xml", SeedFormatEndNote, []seedRecord{
+			{PMID: "90000001", DOI: "10.1000/early.statin", Title: "Early statin therapy after acute myocardial infarction"},
+			{PMID: "90000003", Title: "A record found through its URL"},
+			{Title: "A record with only a title"},
+		}},
+		{"seeds.txt", SeedFormatPMID, []seedRecord{
+			{PMID: "90000001"},
+			{PMID: "90000002"},
+			{PMID: "90000003"},
+			{PMID: "90000004"},
+			{Title: "not-a-pmid", Reason: "not a PMID"},
+			{Title: "1234567890", Reason: "not a PMID"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			b := readSeedFixture(t, tt.file)
+			if format := detectSeedFormat(tt.file, b); format != tt.format {
+				t.Errorf("expected the format %s, got %s", tt.format, format)
+			}
+			records, err := parseSeedRecords(tt.format, bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(records, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, records)
+			}
+		})
+	}
+}
+
+func TestParseSeedRecordsMalformed(t *testing.T) {
+	if _, err := parseEndNote(bytes.NewReader(readSeedFixture(t, "malformed.xml"))); err == nil {
+		t.Error("expected truncated EndNote XML to be an error")
+	}
+	if _, err := parseSeedRecords("csv", strings.NewReader("90000001")); err == nil {
+		t.Error("expected an unknown format to be an error")
+	}
+	for _, parse := range []func(r *bytes.Reader) ([]seedRecord, error){
+		func(r *bytes.Reader) ([]seedRecord, error) { return parseRIS(r) },
+		func(r *bytes.Reader) ([]seedRecord, error) { return parseNBIB(r) },
+	} {
+		records, err := parse(bytes.NewReader([]byte("not a tagged file\n- \nAB-\n\n\n")))
+		if err != nil {
+			t.Error(err)
+		}
+		if len(records) != 0 {
+			t.Errorf("expected no records in an untagged file, got %+v", records)
+		}
+	}
+}
+
+func TestDetectSeedFormat(t *testing.T) {
+	tests := []struct {
+		filename, contents, format string
+	}{
+		{"refs.RIS", "", SeedFormatRIS},
+		{"refs.xml", "", SeedFormatEndNote},
+		{"refs.nbib", "", SeedFormatNBIB},
+		{"refs.txt", "\n  <?xml version=\"1.0\"?><xml/>", SeedFormatEndNote},
+		{"refs", "TY  - JOUR\nER  - ", SeedFormatRIS},
+		{"refs", "PMID- 1\nTI  - t", SeedFormatNBIB},
+		{"refs", "1\n2\n", SeedFormatPMID},
+		{"", "", SeedFormatPMID},
+	}
+	for _, tt := range tests {
+		if format := detectSeedFormat(tt.filename, []byte(tt.contents)); format != tt.format {
+			t.Errorf("%s %q: expected %s, got %s", tt.filename, tt.contents, tt.format, format)
+		}
+	}
+}
+
+// stubBackend is a search backend whose searches are answered by a function. The rest of the backend is
+// unimplemented, and panics if used.
+type stubBackend struct {
+	SearchBackend
+	search func(q cqr.CommonQueryRepresentation) ([]int, error)
+}
+
+func (b stubBackend) Search(q cqr.CommonQueryRepresentation, start, size int) ([]int, error) {
+	return b.search(q)
+}
+
+// importSeeds posts a file to ApiSettingsRelevantImport for the workspace of a user.
+func importSeeds(t *testing.T, s Server, filename string, b []byte, form map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fw, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(b)
+	for k, v := range form {
+		w.WriteField(k, v)
+	}
+	w.Close()
+
+	g := gin.New()
+	g.POST("/import", func(c *gin.Context) {
+		c.Set(workspaceContextKey, Workspace{Key: "user", Username: "user", Role: RoleOwner})
+	}, s.ApiSettingsRelevantImport)
+	req := httptest.NewRequest(http.MethodPost, "/import", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestApiSettingsRelevantImport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := bolt.Open(filepath.Join(t.TempDir(), StatePath), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	seeds, err := NewSeedStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{Seeds: seeds, Backend: stubBackend{search: func(q cqr.CommonQueryRepresentation) ([]int, error) {
+		kw := q.(cqr.Keyword)
+		switch {
+		case strings.Contains(kw.QueryString, "only.doi"):
+			return []int{90000009}, nil
+		case strings.Contains(kw.QueryString, "wrapped"):
+			return nil, errors.New("backend unavailable")
+		}
+		return []int{}, nil
+	}}}
+
+	rec := importSeeds(t, s, "seeds.ris", readSeedFixture(t, "seeds.ris"), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the import to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp seedImportResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Format != SeedFormatRIS || resp.Records != 5 || resp.Matched != 3 || resp.Resolved != 1 {
+		t.Errorf("unexpected import %+v", resp)
+	}
+	reasons := make(map[string]string)
+	for _, u := range resp.Unmatched {
+		reasons[u.Title] = u.Reason
+	}
+	if reasons["A title that is wrapped over two lines"] != "lookup failed: backend unavailable" {
+		t.Errorf("expected the failed lookup to be unmatched, got %+v", resp.Unmatched)
+	}
+	if reasons["A record that is never ended"] != "no unique match found by DOI or title" {
+		t.Errorf("expected the record without a match to be unmatched, got %+v", resp.Unmatched)
+	}
+	expected := combinator.Documents{90000001, 90000009, 90000003}
+	if !reflect.DeepEqual(resp.Collection.Documents, expected) {
+		t.Errorf("expected the seed studies %v, got %v", expected, resp.Collection.Documents)
+	}
+	if resp.Collection.Name != defaultSeedName || resp.Collection.Source != "import:ris:seeds.ris" {
+		t.Errorf("expected the default collection to be replaced, got %+v", resp.Collection)
+	}
+
+	// A named import creates a new collection, and makes it active.
+	rec = importSeeds(t, s, "pmids", readSeedFixture(t, "seeds.txt"), map[string]string{"name": "Imported"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the import to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	sc, ok, err := seeds.Active("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || sc.Name != "Imported" || len(sc.Documents) != 4 {
+		t.Errorf("expected the named collection of 4 seed studies to be active, got %+v", sc)
+	}
+
+	if rec := importSeeds(t, s, "refs.xml", readSeedFixture(t, "malformed.xml"), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected malformed EndNote XML to be a bad request, got %d", rec.Code)
+	}
+	if rec := importSeeds(t, s, "refs", []byte("1"), map[string]string{"format": "csv"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown format to be a bad request, got %d", rec.Code)
+	}
+}
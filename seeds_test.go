@@ -0,0 +1,51 @@
+package searchrefiner
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/hscells/groove/combinator"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSeedStoreSetRelevantConcurrent(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), StatePath), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s, err := NewSeedStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.SetRelevant("user", "manual", combinator.Documents{combinator.Document(i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	collections, err := s.List("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collections) != 1 {
+		t.Fatalf("expected one default collection, got %d", len(collections))
+	}
+	sc, ok, err := s.Active("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || sc.ID != collections[0].ID || sc.Name != defaultSeedName {
+		t.Errorf("expected %s to be the active collection, got %+v", defaultSeedName, sc)
+	}
+	if len(sc.Documents) != 1 {
+		t.Errorf("expected one seed study, got %v", sc.Documents)
+	}
+}
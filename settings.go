@@ -6,27 +6,45 @@ import (
 	"net/http"
 )
 
-func GetSettings(s Server, c *gin.Context) Settings {
-	username := s.Perm.UserState().Username(c.Request)
-
+func GetSettings(s Server, c *gin.Context) (Settings, error) {
 	var us Settings
-	if v, ok := s.Settings[username]; ok {
-		us = v
-	} else {
-		// Configure initial values for Settings struct.
+	ws, err := s.Workspace(c)
+	if err != nil {
+		return us, err
 	}
+	collections, err := s.Seeds.List(ws.Key)
+	if err != nil {
+		return us, err
+	}
+	active, _, err := s.Seeds.Active(ws.Key)
+	if err != nil {
+		return us, err
+	}
+	projects, err := s.memberships(ws.Username)
+	if err != nil {
+		return us, err
+	}
+
+	us.Workspace = ws
+	us.Projects = projects
+	us.Collections = collections
+	us.Active = active
+	us.Relevant = active.Documents
 
-	return us
+	return us, nil
 }
 
 func (s Server) HandleSettings(c *gin.Context) {
-	c.HTML(http.StatusOK, "settings.html", GetSettings(s, c))
+	sets, err := GetSettings(s, c)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+		return
+	}
+	c.HTML(http.StatusOK, "settings.html", sets)
 	return
 }
 
 func (s Server) ApiSettingsRelevantSet(c *gin.Context) {
-	sets := GetSettings(s, c)
-
 	var rel []int64
 	err := c.BindJSON(&rel)
 	if err != nil {
@@ -39,11 +57,107 @@ func (s Server) ApiSettingsRelevantSet(c *gin.Context) {
 		d[i] = combinator.Document(r)
 	}
 
-	username := s.Perm.UserState().Username(c.Request)
-	sets.Relevant = d
-
-	s.Settings[username] = sets
+	ws, err := s.Workspace(c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	sc, err := s.Seeds.SetRelevant(ws.Key, "manual", d)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.Events.PublishSeedsChanged(SeedsChanged{Workspace: ws, Change: SeedsSet, Collection: sc})
 
 	c.Status(http.StatusOK)
 	return
 }
+
+// seedsError writes the response for an error raised by the seed store.
+func seedsError(c *gin.Context, err error) {
+	switch err {
+	case ErrSeedsNotFound:
+		c.String(http.StatusNotFound, err.Error())
+	case ErrSeedsNameEmpty:
+		c.String(http.StatusBadRequest, err.Error())
+	default:
+		c.String(http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (s Server) ApiSeedsList(c *gin.Context) {
+	sets, err := GetSettings(s, c)
+	if err != nil {
+		seedsError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, struct {
+		Active      string
+		Collections []SeedCollection
+	}{Active: sets.Active.ID, Collections: sets.Collections})
+}
+
+func (s Server) ApiSeedsCreate(c *gin.Context) {
+	ws, err := s.Workspace(c)
+	if err != nil {
+		seedsError(c, err)
+		return
+	}
+	sc, err := s.Seeds.Create(ws.Key, c.PostForm("name"), "manual", combinator.Documents{})
+	if err != nil {
+		seedsError(c, err)
+		return
+	}
+	s.Events.PublishSeedsChanged(SeedsChanged{Workspace: ws, Change: SeedsCreated, Collection: sc})
+	c.JSON(http.StatusOK, sc)
+}
+
+func (s Server) ApiSeedsRename(c *gin.Context) {
+	ws, err := s.Workspace(c)
+	if err != nil {
+		seedsError(c, err)
+		return
+	}
+	sc, err := s.Seeds.Rename(ws.Key, c.PostForm("id"), c.PostForm("name"))
+	if err != nil {
+		seedsError(c, err)
+		return
+	}
+	s.Events.PublishSeedsChanged(SeedsChanged{Workspace: ws, Change: SeedsRenamed, Collection: sc})
+	c.JSON(http.StatusOK, sc)
+}
+
+func (s Server) ApiSeedsDelete(c *gin.Context) {
+	ws, err := s.Workspace(c)
+	if err != nil {
+		seedsError(c, err)
+		return
+	}
+	err = s.Seeds.Delete(ws.Key, c.PostForm("id"))
+	if err != nil {
+		seedsError(c, err)
+		return
+	}
+	s.Events.PublishSeedsChanged(SeedsChanged{Workspace: ws, Change: SeedsDeleted, Collection: SeedCollection{ID: c.PostForm("id")}})
+	c.Status(http.StatusOK)
+}
+
+func (s Server) ApiSeedsActivate(c *gin.Context) {
+	ws, err := s.Workspace(c)
+	if err != nil {
+		seedsError(c, err)
+		return
+	}
+	err = s.Seeds.SetActive(ws.Key, c.PostForm("id"))
+	if err != nil {
+		seedsError(c, err)
+		return
+	}
+	sc, err := s.Seeds.Get(ws.Key, c.PostForm("id"))
+	if err != nil {
+		seedsError(c, err)
+		return
+	}
+	s.Events.PublishSeedsChanged(SeedsChanged{Workspace: ws, Change: SeedsActive, Collection: sc})
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,81 @@
+package searchrefiner
+
+import (
+	"sync"
+)
+
+// State contains the mutable state of the server that is shared between handlers and plugins.
+// Server is passed by value to every handler, so State must only ever be used through a pointer,
+// and all access to it must go through the accessor methods so that concurrent requests are safe.
+type State struct {
+	mu      sync.RWMutex
+	storage map[string]*PluginStorage
+	plugins map[string]Plugin
+}
+
+// NewState creates the shared server state from any plugin storage that has already been opened.
+func NewState(storage map[string]*PluginStorage) *State {
+	if storage == nil {
+		storage = make(map[string]*PluginStorage)
+	}
+	return &State{
+		storage: storage,
+		plugins: make(map[string]Plugin),
+	}
+}
+
+// Storage returns the storage for a plugin, if it has been opened.
+func (s *State) Storage(plugin string) (*PluginStorage, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ps, ok := s.storage[plugin]
+	return ps, ok
+}
+
+// OpenStorage returns the storage for a plugin, opening it if it has not been opened yet.
+func (s *State) OpenStorage(plugin string) (*PluginStorage, error) {
+	if ps, ok := s.Storage(plugin); ok {
+		return ps, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Another request may have opened the storage while waiting for the lock.
+	if ps, ok := s.storage[plugin]; ok {
+		return ps, nil
+	}
+	ps, err := OpenPluginStorage(plugin)
+	if err != nil {
+		return nil, err
+	}
+	s.storage[plugin] = ps
+	return ps, nil
+}
+
+// AllStorage returns a snapshot of all of the plugin storage that has been opened.
+func (s *State) AllStorage() map[string]*PluginStorage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := make(map[string]*PluginStorage, len(s.storage))
+	for k, v := range s.storage {
+		st[k] = v
+	}
+	return st
+}
+
+// AddPlugin records a plugin that has been loaded, by the path it is served at.
+func (s *State) AddPlugin(url string, p Plugin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plugins[url] = p
+}
+
+// LoadedPlugins returns a snapshot of the plugins that have been loaded, by the path they are served at.
+func (s *State) LoadedPlugins() map[string]Plugin {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pl := make(map[string]Plugin, len(s.plugins))
+	for k, v := range s.plugins {
+		pl[k] = v
+	}
+	return pl
+}
@@ -0,0 +1,286 @@
+package searchrefiner
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/groove/combinator"
+	"github.com/xyproto/permissionbolt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// inTempDir runs a test in a temporary directory, as plugin storage is opened relative to the working directory.
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+type testPlugin struct{}
+
+func (testPlugin) Startup(Server)                   {}
+func (testPlugin) Serve(Server, *gin.Context)       {}
+func (testPlugin) PermissionType() PluginPermission { return PluginPublic }
+func (testPlugin) Details() PluginDetails           { return PluginDetails{} }
+
+// TestStateConcurrentAccess opens, reads and writes plugin storage, and registers plugins, from many goroutines
+// at once. Run with -race.
+func TestStateConcurrentAccess(t *testing.T) {
+	inTempDir(t)
+	s := NewState(nil)
+	defer func() {
+		for _, ps := range s.AllStorage() {
+			ps.Close()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			plugin := fmt.Sprintf("plugin%d", i%4)
+			ps, err := s.OpenStorage(plugin)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := ps.PutValue("bucket", fmt.Sprint(i), "value"); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := ps.GetValues("bucket"); err != nil {
+				errs <- err
+				return
+			}
+			s.AddPlugin(fmt.Sprintf("/plugin/%d", i), testPlugin{})
+			s.LoadedPlugins()
+			s.AllStorage()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if n := len(s.AllStorage()); n != 4 {
+		t.Errorf("expected the storage of 4 plugins to be opened once each, got %d", n)
+	}
+	if n := len(s.LoadedPlugins()); n != 32 {
+		t.Errorf("expected 32 plugins, got %d", n)
+	}
+	for i := 0; i < 4; i++ {
+		ps, _ := s.Storage(fmt.Sprintf("plugin%d", i))
+		v, err := ps.GetValues("bucket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != 8 {
+			t.Errorf("plugin%d: expected 8 values, got %d", i, len(v))
+		}
+	}
+}
+
+// TestStoresConcurrentAccess adds to and reads the query history and seed studies of the same user from many
+// goroutines at once. Run with -race.
+func TestStoresConcurrentAccess(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), StatePath), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	history, err := NewHistoryStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds, err := NewSeedStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := history.Add("user", Query{QueryString: fmt.Sprint(i), Strategy: "shared"}); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := history.Recent("user"); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := seeds.SetRelevant("user", "test", combinator.Documents{combinator.Document(i)}); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := seeds.Relevant("user"); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	versions, err := history.Versions("user", "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 16 {
+		t.Fatalf("expected 16 versions, got %d", len(versions))
+	}
+	seen := make(map[int]bool)
+	for _, v := range versions {
+		if seen[v.Version] {
+			t.Errorf("version %d was recorded more than once", v.Version)
+		}
+		seen[v.Version] = true
+	}
+}
+
+// TestHandlersConcurrentAccess makes requests to the history, seed study and plugin storage endpoints of the same
+// user from many goroutines at once, through the handlers that serve them. Run with -race.
+func TestHandlersConcurrentAccess(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := inTempDir(t)
+	perm, err := permissionbolt.NewWithConf(filepath.Join(dir, "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	perm.UserState().AddUser("user", "password", "user@example.com")
+	perm.UserState().MarkConfirmed("user")
+	login := httptest.NewRecorder()
+	if err := perm.UserState().Login(login, "user"); err != nil {
+		t.Fatal(err)
+	}
+	cookies := login.Result().Cookies()
+
+	db, err := bolt.Open(filepath.Join(dir, StatePath), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	history, err := NewHistoryStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds, err := NewSeedStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects, err := NewProjectStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counted int32
+	s := Server{
+		Perm:     perm,
+		History:  history,
+		Seeds:    seeds,
+		Projects: projects,
+		State:    NewState(nil),
+		Events:   NewEventBus(),
+		Backend:  countingBackend{n: &counted},
+	}
+	defer func() {
+		for _, ps := range s.State.AllStorage() {
+			ps.Close()
+		}
+	}()
+
+	g := gin.New()
+	editor := s.RequireRole(RoleEditor)
+	g.GET("/api/history", s.ApiHistoryGet)
+	g.POST("/api/history", editor, s.ApiHistoryAdd)
+	g.POST("/api/settings/relevant", editor, s.ApiSettingsRelevantSet)
+	g.GET("/api/settings/seeds", s.ApiSeedsList)
+	g.POST("/admin/api/storage", s.ApiAdminUpdateStorage)
+	g.POST("/admin/api/storage/csv", s.ApiAdminCSVStorage)
+
+	do := func(method, path, contentType string, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if len(contentType) > 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+	const form = "application/x-www-form-urlencoded"
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 128)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			requests := []struct {
+				method, path, contentType, body string
+				status                          int
+			}{
+				{http.MethodPost, "/api/history", form, url.Values{"query": {fmt.Sprintf("heart%d[tiab]", i)}, "lang": {"pubmed"}, "strategy": {"shared"}}.Encode(), http.StatusOK},
+				{http.MethodGet, "/api/history", "", "", http.StatusOK},
+				{http.MethodPost, "/api/settings/relevant", "application/json", fmt.Sprintf("[%d, %d]", i, i+1), http.StatusOK},
+				{http.MethodGet, "/api/settings/seeds", "", "", http.StatusOK},
+				{http.MethodPost, "/admin/api/storage", form, url.Values{"plugin": {fmt.Sprintf("plugin%d", i%4)}, "bucket": {"bucket"}, "key": {fmt.Sprint(i)}, "value": {"value"}}.Encode(), http.StatusFound},
+				{http.MethodPost, "/admin/api/storage/csv", form, url.Values{"plugin": {fmt.Sprintf("plugin%d", i%4)}, "bucket": {"bucket"}}.Encode(), http.StatusFound},
+			}
+			for _, r := range requests {
+				if status, body := do(r.method, r.path, r.contentType, r.body); status != r.status {
+					errs <- fmt.Errorf("%s %s: expected status %d, got %d: %s", r.method, r.path, r.status, status, body)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	versions, err := history.Versions("user", "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 16 {
+		t.Errorf("expected 16 versions, got %d", len(versions))
+	}
+	collections, err := seeds.List("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collections) != 1 || len(collections[0].Documents) != 2 {
+		t.Errorf("expected a single collection of 2 seed studies, got %+v", collections)
+	}
+	for i := 0; i < 4; i++ {
+		status, body := do(http.MethodPost, "/admin/api/storage/csv", form, url.Values{"plugin": {fmt.Sprintf("plugin%d", i)}, "bucket": {"bucket"}}.Encode())
+		if status != http.StatusFound || strings.Count(body, "value") != 4 {
+			t.Errorf("plugin%d: expected 4 values, got %d: %s", i, status, body)
+		}
+	}
+}
@@ -22,9 +22,12 @@ func (p *PluginStorage) Close() error {
 func OpenPluginStorage(plugin string) (*PluginStorage, error) {
 	err := os.MkdirAll(PluginStoragePath, 0664)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 	db, err := bolt.Open(path.Join(PluginStoragePath, plugin), 0664, nil)
+	if err != nil {
+		return nil, err
+	}
 	return &PluginStorage{
 		db:     db,
 		plugin: plugin,
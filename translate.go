@@ -0,0 +1,314 @@
+package searchrefiner
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/cqr"
+	"github.com/hscells/transmute/fields"
+	tpipeline "github.com/hscells/transmute/pipeline"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Statuses of a translated clause.
+const (
+	// ClauseMapped clauses search the same fields after translation.
+	ClauseMapped = "mapped"
+	// ClauseApproximated clauses search different fields, or use a different operator, after translation.
+	ClauseApproximated = "approximated"
+	// ClauseDropped clauses lose their fields in translation, and are searched in all fields instead.
+	ClauseDropped = "dropped"
+)
+
+// TranslatedClause describes how a single clause of a query was translated.
+type TranslatedClause struct {
+	Original         string   `json:"original"`
+	Translated       string   `json:"translated"`
+	Fields           []string `json:"fields,omitempty"`
+	TranslatedFields []string `json:"translated_fields,omitempty"`
+	Status           string   `json:"status"`
+	Reason           string   `json:"reason,omitempty"`
+	// Hits are only reported when the search backend can count the clause.
+	OriginalHits   *float64 `json:"original_hits,omitempty"`
+	TranslatedHits *float64 `json:"translated_hits,omitempty"`
+}
+
+// TranslationReport is a query translated into another language, and what was lost or approximated doing so.
+type TranslationReport struct {
+	Source         string                    `json:"source"`
+	Target         string                    `json:"target"`
+	Query          string                    `json:"query"`
+	Translated     string                    `json:"translated"`
+	Clauses        []TranslatedClause        `json:"clauses"`
+	Untranslatable []UntranslatableConstruct `json:"untranslatable,omitempty"`
+}
+
+// compileClause translates a single clause with a pipeline that compiles the common query representation.
+// Languages that are written line by line translate a single clause into several lines, which can be made readable
+// with clauseText.
+func compileClause(compiler tpipeline.TransmutePipeline, q cqr.CommonQueryRepresentation) (string, error) {
+	b, err := json.Marshal(q)
+	if err != nil {
+		return "", err
+	}
+	cq, err := compiler.Execute(string(b))
+	if err != nil {
+		return "", err
+	}
+	s, err := cq.String()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// clauseText is the first line of a translated clause, without its line number.
+func clauseText(s string) string {
+	s = strings.SplitN(s, "\n", 2)[0]
+	if loc := medlineNumber.FindStringIndex(s); loc != nil {
+		s = s[loc[1]:]
+	}
+	return strings.TrimSpace(s)
+}
+
+// unwrap removes the Boolean queries that only group a single clause.
+func unwrap(q cqr.CommonQueryRepresentation) cqr.CommonQueryRepresentation {
+	for {
+		b, ok := q.(cqr.BooleanQuery)
+		if !ok || len(b.Children) != 1 {
+			return q
+		}
+		q = b.Children[0]
+	}
+}
+
+// sortedFields returns a sorted copy of the fields of a keyword.
+func sortedFields(f []string) []string {
+	s := append([]string(nil), f...)
+	sort.Strings(s)
+	return s
+}
+
+func sameFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func allFields(f []string) bool {
+	return len(f) == 0 || (len(f) == 1 && f[0] == fields.AllFields)
+}
+
+// maxTranslationCounts bounds how many clauses are counted when translating a query, as each count is a request
+// to the search backend.
+const maxTranslationCounts = 100
+
+// translator translates the clauses of a query from one language to another.
+type translator struct {
+	s                      Server
+	source, target         string
+	sourceCompiler, output tpipeline.TransmutePipeline
+	input                  tpipeline.TransmutePipeline
+	// counts is how many more clauses may be counted, or nil when clauses are not counted.
+	counts *int32
+}
+
+// hits counts the documents that a clause retrieves in the background. The count is nil when clauses are not
+// counted, when too many have been counted already, or when the backend cannot count the clause.
+func (t translator) hits(q cqr.CommonQueryRepresentation) <-chan *float64 {
+	ch := make(chan *float64, 1)
+	if t.s.Backend == nil || t.counts == nil || atomic.AddInt32(t.counts, -1) < 0 {
+		ch <- nil
+		return ch
+	}
+	go func() {
+		n, err := t.s.Backend.RetrievalSize(q)
+		if err != nil {
+			log.Warnf("[translate] could not count %s: %v", q, err)
+			ch <- nil
+			return
+		}
+		ch <- &n
+	}()
+	return ch
+}
+
+// keyword translates a keyword, and then parses the translation to find which fields it searches in the target.
+// The original and translated keywords are counted concurrently, but keywords are translated one at a time, so at
+// most two counts are made at once.
+func (t translator) keyword(kw cqr.Keyword) (clause TranslatedClause) {
+	originalHits := t.hits(kw)
+	defer func() {
+		clause.OriginalHits = <-originalHits
+	}()
+
+	clause = TranslatedClause{Fields: sortedFields(kw.Fields), Status: ClauseMapped}
+	if s, err := compileClause(t.sourceCompiler, kw); err == nil {
+		clause.Original = clauseText(s)
+	} else {
+		clause.Original = kw.QueryString
+	}
+
+	translated, err := compileClause(t.output, kw)
+	if err != nil {
+		clause.Status = ClauseDropped
+		clause.Reason = err.Error()
+		return clause
+	}
+	clause.Translated = clauseText(translated)
+
+	if u := untranslatableKeyword(kw, t.target); len(u) > 0 {
+		clause.Status = ClauseApproximated
+		clause.Reason = u[0].Reason
+	}
+
+	cq, err := t.input.Execute(translated)
+	if err != nil {
+		return clause
+	}
+	repr, err := cq.Representation()
+	if err != nil {
+		return clause
+	}
+	q, ok := repr.(cqr.CommonQueryRepresentation)
+	if !ok {
+		return clause
+	}
+	back, ok := unwrap(q).(cqr.Keyword)
+	if !ok {
+		return clause
+	}
+	clause.TranslatedFields = sortedFields(back.Fields)
+	translatedHits := t.hits(back)
+	switch {
+	case sameFields(clause.Fields, clause.TranslatedFields):
+	case allFields(clause.TranslatedFields) && !allFields(clause.Fields):
+		clause.Status = ClauseDropped
+		if len(clause.Reason) == 0 {
+			clause.Reason = "the fields have no equivalent, so the keyword is searched in all fields"
+		}
+	default:
+		clause.Status = ClauseApproximated
+		if len(clause.Reason) == 0 {
+			clause.Reason = fmt.Sprintf("searched in %s instead of %s", strings.Join(clause.TranslatedFields, ","), strings.Join(clause.Fields, ","))
+		}
+	}
+	clause.TranslatedHits = <-translatedHits
+	return clause
+}
+
+// clauses translates every clause of a query, keywords and the operators that cannot be translated faithfully.
+func (t translator) clauses(q cqr.CommonQueryRepresentation) []TranslatedClause {
+	var clauses []TranslatedClause
+	switch v := q.(type) {
+	case cqr.Keyword:
+		clauses = append(clauses, t.keyword(v))
+	case cqr.BooleanQuery:
+		if strings.HasPrefix(strings.ToLower(v.Operator), "adj") && t.target == "pubmed" {
+			clauses = append(clauses, TranslatedClause{
+				Original:   v.Operator,
+				Translated: strings.ToUpper(cqr.AND),
+				Status:     ClauseApproximated,
+				Reason:     "PubMed has no adjacency operator, so it is searched as AND",
+			})
+		}
+		for _, child := range v.Children {
+			clauses = append(clauses, t.clauses(child)...)
+		}
+	}
+	return clauses
+}
+
+// ApiTranslate translates the query in the "query" parameter from the language in "lang" to the language in
+// "target", and reports how each clause was translated. The parser options of RequestParser apply to the query.
+// The clauses are only counted on the search backend when "hits" is true.
+func (s Server) ApiTranslate(c *gin.Context) {
+	rawQuery := c.PostForm("query")
+	if len(rawQuery) == 0 {
+		c.String(http.StatusBadRequest, "no query to translate")
+		return
+	}
+
+	parser, source, err := RequestParser(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	sourceCompiler, _, err := Languages.Compiler(source)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	output, target, err := Languages.Compiler(c.PostForm("target"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	input, _, err := Languages.Parser(target)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Infof("[translate] %s->%s:%s", source, target, rawQuery)
+
+	cq, err := parser.Execute(rawQuery)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	repr, err := cq.Representation()
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	q, ok := repr.(cqr.CommonQueryRepresentation)
+	if !ok {
+		c.String(http.StatusInternalServerError, "query could not be parsed")
+		return
+	}
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	tq, err := output.Execute(string(b))
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	translated, err := tq.StringPretty()
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	t := translator{s: s, source: source, target: target, sourceCompiler: sourceCompiler, output: output, input: input}
+	if c.PostForm("hits") == "true" {
+		n := int32(maxTranslationCounts)
+		t.counts = &n
+	}
+	report := TranslationReport{
+		Source:         source,
+		Target:         target,
+		Query:          rawQuery,
+		Translated:     translated,
+		Clauses:        t.clauses(q),
+		Untranslatable: append(UntranslatableInput(rawQuery, source), Untranslatable(q, target)...),
+	}
+	if report.Clauses == nil {
+		report.Clauses = []TranslatedClause{}
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,133 @@
+package searchrefiner
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/cqr"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// translate posts a query to ApiTranslate.
+func translate(t *testing.T, s Server, form url.Values) TranslationReport {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	g.POST("/translate", s.ApiTranslate)
+	req := httptest.NewRequest(http.MethodPost, "/translate", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the query to be translated, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var report TranslationReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestTranslateClauses(t *testing.T) {
+	type clause struct {
+		original, translated, status string
+	}
+	tests := []struct {
+		name, source, target, query string
+		expected                    []clause
+	}{
+		{"medline to pubmed", "medline", "pubmed", "1. heart.tw.\n2. exp Heart Diseases/\n3. cardiac.ab.\n4. or/1-3", []clause{
+			{"heart.tw.", "(heart[Text Word])", ClauseMapped},
+			{"exp Heart Diseases/", "(Heart Diseases[Mesh Terms])", ClauseMapped},
+			{"cardiac.ab.", "(cardiac[All Fields])", ClauseDropped},
+		}},
+		{"pubmed to embase", "pubmed", "embase", "heart[tiab] OR heart diseases[mh] OR lung[ti] OR review[pt]", []clause{
+			{"(heart[Title/Abstract])", "heart:ti,ab", ClauseMapped},
+			{"(heart diseases[Mesh Terms])", "'heart diseases'/exp", ClauseApproximated},
+			{"(lung[Title])", "lung:ti", ClauseMapped},
+			{"(review[Publication Type])", "review:it", ClauseMapped},
+		}},
+		{"adjacency to AND", "medline", "pubmed", "1. (heart adj3 attack).tw.\n2. lung.tw.\n3. or/1-2", []clause{
+			{"lung.tw.", "(lung[Text Word])", ClauseMapped},
+			{"adj3", "AND", ClauseApproximated},
+			{"heart.tw.", "(heart[Text Word])", ClauseMapped},
+			{"attack.tw.", "(attack[Text Word])", ClauseMapped},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := translate(t, Server{}, url.Values{"query": {tt.query}, "lang": {tt.source}, "target": {tt.target}})
+			if len(report.Clauses) != len(tt.expected) {
+				t.Fatalf("expected %d clauses, got %+v", len(tt.expected), report.Clauses)
+			}
+			// The parser does not keep the clauses of a query in order, so they are compared in any order.
+			expected := make(map[clause]bool)
+			for _, c := range tt.expected {
+				expected[c] = true
+			}
+			for i, c := range report.Clauses {
+				if got := (clause{c.Original, c.Translated, c.Status}); !expected[got] {
+					t.Errorf("clause %d: unexpected %+v, expected one of %+v", i, got, tt.expected)
+				}
+				if c.Status != ClauseMapped && len(c.Reason) == 0 {
+					t.Errorf("clause %d: expected a reason for a %s clause", i, c.Status)
+				}
+				if c.OriginalHits != nil || c.TranslatedHits != nil {
+					t.Errorf("clause %d: expected no counts without a backend", i)
+				}
+			}
+		})
+	}
+}
+
+// countingBackend counts every clause as retrieving a single citation, and how many clauses it counted.
+type countingBackend struct {
+	SearchBackend
+	n *int32
+}
+
+func (b countingBackend) RetrievalSize(cqr.CommonQueryRepresentation) (float64, error) {
+	atomic.AddInt32(b.n, 1)
+	return 1, nil
+}
+
+func TestTranslateHits(t *testing.T) {
+	var n int32
+	s := Server{Backend: countingBackend{n: &n}}
+	form := url.Values{"query": {"heart[tiab] OR lung[tiab]"}, "lang": {"pubmed"}, "target": {"medline"}}
+
+	report := translate(t, s, form)
+	if n != 0 || report.Clauses[0].OriginalHits != nil {
+		t.Errorf("expected clauses not to be counted unless asked for, got %d counts", n)
+	}
+
+	form.Set("hits", "true")
+	report = translate(t, s, form)
+	for _, c := range report.Clauses {
+		if c.OriginalHits == nil || *c.OriginalHits != 1 || c.TranslatedHits == nil || *c.TranslatedHits != 1 {
+			t.Errorf("expected the original and translated clause to be counted, got %+v", c)
+		}
+	}
+	if n != 4 {
+		t.Errorf("expected 4 counts, got %d", n)
+	}
+
+	// A long query is only counted up to the limit.
+	n = 0
+	keywords := make([]string, maxTranslationCounts)
+	for i := range keywords {
+		keywords[i] = "heart" + strings.Repeat("a", i) + "[tiab]"
+	}
+	form.Set("query", strings.Join(keywords, " OR "))
+	report = translate(t, s, form)
+	if n != maxTranslationCounts {
+		t.Errorf("expected %d counts, got %d", maxTranslationCounts, n)
+	}
+	if c := report.Clauses[len(report.Clauses)-1]; c.OriginalHits != nil || c.TranslatedHits != nil {
+		t.Errorf("expected the last clause not to be counted, got %+v", c)
+	}
+}
@@ -0,0 +1,131 @@
+package searchrefiner
+
+import (
+	"fmt"
+	"github.com/hscells/cqr"
+	"github.com/hscells/transmute/fields"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// UntranslatableConstruct is a part of a query that cannot be expressed faithfully in another language.
+type UntranslatableConstruct struct {
+	Construct string `json:"construct"`
+	Reason    string `json:"reason"`
+}
+
+// ovidFieldSets are the sets of fields that have an Ovid field code.
+var ovidFieldSets = map[string]bool{
+	fields.AllFields:            true,
+	fields.TitleAbstract:        true,
+	fields.Abstract:             true,
+	fields.AuthorFull:           true,
+	fields.PublicationDate:      true,
+	fields.Authors:              true,
+	fields.AuthorLast:           true,
+	fields.Editor:               true,
+	fields.FloatingMeshHeadings: true,
+	fields.Title:                true,
+	fields.MeshHeadings:         true,
+	fields.PublicationType:      true,
+	fields.MeSHSubheading:       true,
+	fields.TextWord:             true,
+	fields.Journal:              true,
+}
+
+var (
+	embaseNextRegexp   = regexp.MustCompile(`(?i)\bNEXT/\d+`)
+	embaseSuffixRegexp = regexp.MustCompile(`(?i)(/[a-z_]+|:[a-z,]+)(\s|\)|$)`)
+)
+
+// UntranslatableInput lists the constructs of a query written in lang that are not parsed faithfully.
+func UntranslatableInput(query, lang string) []UntranslatableConstruct {
+	if lang != "embase" {
+		return nil
+	}
+	var u []UntranslatableConstruct
+	for _, m := range embaseNextRegexp.FindAllString(query, -1) {
+		u = append(u, UntranslatableConstruct{m, "NEXT is ordered, but is translated as unordered adjacency"})
+	}
+	for _, m := range embaseSuffixRegexp.FindAllStringSubmatch(query, -1) {
+		suffix := strings.ToLower(m[1])
+		switch suffix {
+		case "/exp", "/de", "/mj":
+			continue
+		case "/syn":
+			u = append(u, UntranslatableConstruct{m[1], "synonym searches are translated as subject heading searches"})
+			continue
+		}
+		if strings.HasPrefix(suffix, "/") {
+			u = append(u, UntranslatableConstruct{m[1], "unsupported suffix"})
+			continue
+		}
+		codes := strings.TrimPrefix(suffix, ":")
+		if _, ok := embaseFieldMapping[codes]; ok {
+			continue
+		}
+		for _, code := range strings.Split(codes, ",") {
+			if _, ok := embaseFieldMapping[code]; !ok {
+				u = append(u, UntranslatableConstruct{":" + code, "unknown field code, searched in all fields"})
+			}
+		}
+	}
+	return dedupeUntranslatable(u)
+}
+
+// Untranslatable lists the constructs of a query that cannot be expressed faithfully in lang.
+func Untranslatable(repr cqr.CommonQueryRepresentation, lang string) []UntranslatableConstruct {
+	var u []UntranslatableConstruct
+	var walk func(q cqr.CommonQueryRepresentation)
+	walk = func(q cqr.CommonQueryRepresentation) {
+		switch v := q.(type) {
+		case cqr.BooleanQuery:
+			op := strings.ToLower(v.Operator)
+			if strings.HasPrefix(op, "adj") && lang == "pubmed" {
+				u = append(u, UntranslatableConstruct{v.Operator, "PubMed has no adjacency operator, so it is searched as AND"})
+			}
+			for _, child := range v.Children {
+				walk(child)
+			}
+		case cqr.Keyword:
+			u = append(u, untranslatableKeyword(v, lang)...)
+		}
+	}
+	walk(repr)
+	return dedupeUntranslatable(u)
+}
+
+func untranslatableKeyword(kw cqr.Keyword, lang string) []UntranslatableConstruct {
+	f := append([]string(nil), kw.Fields...)
+	sort.Strings(f)
+	construct := fmt.Sprintf("%s [%s]", kw.QueryString, strings.Join(f, ","))
+	switch lang {
+	case "medline", "ovid":
+		if len(f) != 1 || !ovidFieldSets[f[0]] {
+			return []UntranslatableConstruct{{construct, "there is no Ovid field code for these fields"}}
+		}
+	case "embase":
+		if len(f) > 0 && isMeSHField(f[0]) {
+			return []UntranslatableConstruct{{construct, "MeSH headings are searched as Emtree headings, which may not exist or may differ"}}
+		}
+		for _, field := range f {
+			if _, ok := embaseFieldCodes[field]; !ok && field != fields.AllFields {
+				return []UntranslatableConstruct{{construct, fmt.Sprintf("there is no Embase field code for %s, so it is searched in all fields", field)}}
+			}
+		}
+	}
+	return nil
+}
+
+func dedupeUntranslatable(u []UntranslatableConstruct) []UntranslatableConstruct {
+	seen := make(map[UntranslatableConstruct]bool)
+	var ret []UntranslatableConstruct
+	for _, c := range u {
+		if !seen[c] {
+			seen[c] = true
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
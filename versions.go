@@ -0,0 +1,225 @@
+package searchrefiner
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hscells/cqr"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// QueryDiff is the difference between two versions of a search strategy, at the level of the clauses of their
+// common query representation, so that rewording or reordering a query without changing its clauses is not a change.
+type QueryDiff struct {
+	From      Query    `json:"from"`
+	To        Query    `json:"to"`
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Unchanged []string `json:"unchanged"`
+	// NumRetChange and NumRelRetChange are the changes in the number of citations and seed studies retrieved.
+	NumRetChange    int64 `json:"num_ret_change"`
+	NumRelRetChange int64 `json:"num_rel_ret_change"`
+}
+
+// queryClauses lists the keywords of a query, each with the path of Boolean operators above it, the fields it is
+// searched in, and its options (such as explosion and truncation). The query is parsed with the parser options it
+// was run with.
+func queryClauses(q Query) ([]string, error) {
+	compiler, _, err := Languages.ConfiguredParser(q.Language, q.ParserOptions)
+	if err != nil {
+		return nil, err
+	}
+	cq, err := compiler.Execute(q.QueryString)
+	if err != nil {
+		return nil, err
+	}
+	repr, err := cq.Representation()
+	if err != nil {
+		return nil, err
+	}
+	var clauses []string
+	var walk func(q cqr.CommonQueryRepresentation, path []string)
+	walk = func(q cqr.CommonQueryRepresentation, path []string) {
+		switch v := q.(type) {
+		case cqr.Keyword:
+			clause := fmt.Sprintf("%s [%s]", v.QueryString, strings.Join(sortedFields(v.Fields), ","))
+			if options := keywordOptions(v); len(options) > 0 {
+				clause = fmt.Sprintf("%s (%s)", clause, strings.Join(options, ", "))
+			}
+			if len(path) > 0 {
+				clause = strings.Join(path, "/") + ": " + clause
+			}
+			clauses = append(clauses, clause)
+		case cqr.BooleanQuery:
+			if len(v.Operator) > 0 {
+				path = append(path[:len(path):len(path)], strings.ToUpper(v.Operator))
+			}
+			for _, child := range v.Children {
+				walk(child, path)
+			}
+		}
+	}
+	if r, ok := repr.(cqr.CommonQueryRepresentation); ok {
+		walk(r, nil)
+	}
+	return clauses, nil
+}
+
+// keywordOptions lists the options that are set on a keyword, sorted by name.
+func keywordOptions(k cqr.Keyword) []string {
+	var options []string
+	for name, v := range k.Options {
+		switch v := v.(type) {
+		case bool:
+			if v {
+				options = append(options, name)
+			}
+		case nil:
+		default:
+			options = append(options, fmt.Sprintf("%s=%v", name, v))
+		}
+	}
+	sort.Strings(options)
+	return options
+}
+
+// DiffQueries finds the clauses that were added to and removed from a query between two versions.
+func DiffQueries(from, to Query) (QueryDiff, error) {
+	d := QueryDiff{
+		From:            from,
+		To:              to,
+		Added:           []string{},
+		Removed:         []string{},
+		Unchanged:       []string{},
+		NumRetChange:    to.NumRet - from.NumRet,
+		NumRelRetChange: to.NumRelRet - from.NumRelRet,
+	}
+	a, err := queryClauses(from)
+	if err != nil {
+		return d, fmt.Errorf("version %d: %v", from.ID, err)
+	}
+	b, err := queryClauses(to)
+	if err != nil {
+		return d, fmt.Errorf("version %d: %v", to.ID, err)
+	}
+	count := make(map[string]int)
+	for _, c := range a {
+		count[c]++
+	}
+	for _, c := range b {
+		if count[c] > 0 {
+			count[c]--
+			d.Unchanged = append(d.Unchanged, c)
+			continue
+		}
+		d.Added = append(d.Added, c)
+	}
+	for _, c := range a {
+		if count[c] > 0 {
+			count[c]--
+			d.Removed = append(d.Removed, c)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Unchanged)
+	return d, nil
+}
+
+// requestParent reads the ID of the version that the query of a request revises from its "parent" parameter.
+func requestParent(c *gin.Context) (uint64, error) {
+	p := c.PostForm("parent")
+	if len(p) == 0 {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(p, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid parent version %q", p)
+	}
+	return id, nil
+}
+
+// historyDiff diffs the versions in the "from" and "to" parameters of a request.
+func (s Server) historyDiff(c *gin.Context) (QueryDiff, int, error) {
+	ws, err := s.Workspace(c)
+	if err != nil {
+		return QueryDiff{}, http.StatusInternalServerError, err
+	}
+	var versions [2]Query
+	for i, param := range []string{"from", "to"} {
+		id, err := strconv.ParseUint(c.Query(param), 10, 64)
+		if err != nil {
+			return QueryDiff{}, http.StatusBadRequest, fmt.Errorf("invalid %s version %q", param, c.Query(param))
+		}
+		q, ok, err := s.History.Entry(ws.Key, id)
+		if err != nil {
+			return QueryDiff{}, http.StatusInternalServerError, err
+		}
+		if !ok {
+			return QueryDiff{}, http.StatusNotFound, fmt.Errorf("no query %d in history", id)
+		}
+		versions[i] = q
+	}
+	d, err := DiffQueries(versions[0], versions[1])
+	if err != nil {
+		return d, http.StatusBadRequest, err
+	}
+	return d, http.StatusOK, nil
+}
+
+// ApiHistoryVersions lists the versions of the search strategy in the "strategy" parameter.
+func (s Server) ApiHistoryVersions(c *gin.Context) {
+	if !s.Perm.UserState().IsLoggedIn(s.Perm.UserState().Username(c.Request)) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+	ws, err := s.Workspace(c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	versions, err := s.History.Versions(ws.Key, c.Query("strategy"))
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if versions == nil {
+		versions = []Query{}
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+// ApiHistoryDiff diffs the queries in the history with the IDs in the "from" and "to" parameters.
+func (s Server) ApiHistoryDiff(c *gin.Context) {
+	if !s.Perm.UserState().IsLoggedIn(s.Perm.UserState().Username(c.Request)) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+	d, status, err := s.historyDiff(c)
+	if err != nil {
+		c.String(status, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// HandleHistoryDiff shows the difference between the queries in the history with the IDs in the "from" and "to"
+// parameters.
+func (s Server) HandleHistoryDiff(c *gin.Context) {
+	if !s.Perm.UserState().IsLoggedIn(s.Perm.UserState().Username(c.Request)) {
+		c.Redirect(http.StatusTemporaryRedirect, "/account/login")
+		return
+	}
+	d, status, err := s.historyDiff(c)
+	if err != nil {
+		c.HTML(status, "error.html", ErrorPage{Error: err.Error(), BackLink: "/query"})
+		return
+	}
+	c.HTML(http.StatusOK, "diff.html", struct {
+		QueryDiff
+		Plugins     []InternalPluginDetails
+		PluginTitle string
+	}{QueryDiff: d, Plugins: s.Plugins, PluginTitle: "Query Versions"})
+}
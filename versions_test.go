@@ -0,0 +1,58 @@
+package searchrefiner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffQueries(t *testing.T) {
+	tests := []struct {
+		name           string
+		from, to       Query
+		added, removed []string
+	}{
+		{
+			name:  "reordered",
+			from:  Query{QueryString: "heart[tiab] AND attack[tiab]", Language: "pubmed"},
+			to:    Query{QueryString: "attack[tiab] AND heart[tiab]", Language: "pubmed"},
+			added: []string{}, removed: []string{},
+		},
+		{
+			name:    "operator",
+			from:    Query{QueryString: "heart[tiab] AND attack[tiab]", Language: "pubmed"},
+			to:      Query{QueryString: "heart[tiab] OR attack[tiab]", Language: "pubmed"},
+			added:   []string{"OR: attack [title_abstract] (exploded)", "OR: heart [title_abstract] (exploded)"},
+			removed: []string{"AND: attack [title_abstract] (exploded)", "AND: heart [title_abstract] (exploded)"},
+		},
+		{
+			name:    "truncation",
+			from:    Query{QueryString: "heart[tiab] AND attack[tiab]", Language: "pubmed"},
+			to:      Query{QueryString: "heart*[tiab] AND attack[tiab]", Language: "pubmed"},
+			added:   []string{"AND: heart* [title_abstract] (exploded, truncated)"},
+			removed: []string{"AND: heart [title_abstract] (exploded)"},
+		},
+		{
+			name:    "explosion",
+			from:    Query{QueryString: "heart[mh] AND attack[tiab]", Language: "pubmed"},
+			to:      Query{QueryString: "heart[mh:noexp] AND attack[tiab]", Language: "pubmed"},
+			added:   []string{"AND: heart [mesh_headings]"},
+			removed: []string{"AND: heart [mesh_headings] (exploded)"},
+		},
+		{
+			name:    "parser options",
+			from:    Query{QueryString: "heart[tiab] AND attack", Language: "pubmed"},
+			to:      Query{QueryString: "heart[tiab] AND attack", Language: "pubmed", ParserOptions: ParserOptions{DefaultField: "title"}},
+			added:   []string{"AND: attack [title] (exploded)"},
+			removed: []string{"AND: attack [all_fields] (exploded)"},
+		},
+	}
+	for _, test := range tests {
+		d, err := DiffQueries(test.from, test.to)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(d.Added, test.added) || !reflect.DeepEqual(d.Removed, test.removed) {
+			t.Errorf("%s: got added %q and removed %q, want %q and %q", test.name, d.Added, d.Removed, test.added, test.removed)
+		}
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/hscells/groove/combinator"
 	gpipeline "github.com/hscells/groove/pipeline"
 	"github.com/hscells/transmute"
-	tpipeline "github.com/hscells/transmute/pipeline"
 	"net/http"
 	"time"
 )
@@ -15,22 +14,16 @@ import (
 func (s Server) HandleResults(c *gin.Context) {
 	start := time.Now()
 	rawQuery := c.PostForm("query")
-	lang := c.PostForm("lang")
 
 	if len(rawQuery) == 0 {
 		c.Redirect(http.StatusFound, "/")
 		return
 	}
 
-	t := make(map[string]tpipeline.TransmutePipeline)
-	t["medline"] = transmute.Medline2Cqr
-	t["pubmed"] = transmute.Pubmed2Cqr
-
-	compiler := t["medline"]
-	if v, ok := t[lang]; ok {
-		compiler = v
-	} else {
-		lang = "medline"
+	compiler, lang, err := RequestParser(c)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+		return
 	}
 
 	cq, err := compiler.Execute(rawQuery)
@@ -57,25 +50,25 @@ func (s Server) HandleResults(c *gin.Context) {
 		return
 	}
 
-	pmids, err := s.Entrez.Search(q, s.Entrez.SearchSize(10))
+	repr, err := cq.Representation()
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
 		return
 	}
 
-	docs, err := s.Entrez.Fetch(pmids)
+	pmids, err := s.Backend.Search(repr.(cqr.CommonQueryRepresentation), 0, 10)
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
 		return
 	}
 
-	repr, err := cq.Representation()
+	docs, err := s.Backend.Fetch(pmids)
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
 		return
 	}
 
-	size, err := s.Entrez.RetrievalSize(repr.(cqr.CommonQueryRepresentation))
+	size, err := s.Backend.RetrievalSize(repr.(cqr.CommonQueryRepresentation))
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
 		return
@@ -89,6 +82,7 @@ func (s Server) HandleResults(c *gin.Context) {
 		TransformedQuery: q,
 		Documents:        docs,
 		Language:         lang,
+		DefaultField:     c.PostForm("field"),
 		Plugins:          s.Plugins,
 		PluginTitle:      "Results",
 	}
@@ -100,22 +94,21 @@ func (s Server) HandleQuery(c *gin.Context) {
 	start := time.Now()
 
 	rawQuery := c.PostForm("query")
-	lang := c.PostForm("lang")
 
 	if len(rawQuery) == 0 {
 		c.HTML(http.StatusOK, "query.html", searchResponse{Language: "medline"})
 		return
 	}
 
-	t := make(map[string]tpipeline.TransmutePipeline)
-	t["medline"] = transmute.Medline2Cqr
-	t["pubmed"] = transmute.Pubmed2Cqr
-
-	compiler := t["medline"]
-	if v, ok := t[lang]; ok {
-		compiler = v
-	} else {
-		lang = "medline"
+	options, err := RequestParserOptions(c)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+		return
+	}
+	compiler, lang, err := Languages.ConfiguredParser(c.PostForm("lang"), options)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+		return
 	}
 
 	cq, err := compiler.Execute(rawQuery)
@@ -136,7 +129,7 @@ func (s Server) HandleQuery(c *gin.Context) {
 		return
 	}
 
-	size, err := s.Entrez.RetrievalSize(repr.(cqr.CommonQueryRepresentation))
+	size, err := s.Backend.RetrievalSize(repr.(cqr.CommonQueryRepresentation))
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
 		return
@@ -148,19 +141,32 @@ func (s Server) HandleQuery(c *gin.Context) {
 		QueryString:      rawQuery,
 		TransformedQuery: transformed,
 		Language:         lang,
+		DefaultField:     c.PostForm("field"),
 
 		PluginTitle: "searchrefiner",
 	}
 
 	gq := gpipeline.NewQuery("searchrefiner", "0", repr.(cqr.CommonQueryRepresentation))
-	sr.BooleanClauses, err = analysis.BooleanClauses.Execute(gq, s.Entrez)
-	sr.BooleanFields, _ = analysis.BooleanFields.Execute(gq, s.Entrez)
-	sr.BooleanKeywords, _ = analysis.BooleanKeywords.Execute(gq, s.Entrez)
-	sr.MeshKeywords, _ = analysis.MeshKeywordCount.Execute(gq, s.Entrez)
+	sr.BooleanClauses, err = analysis.BooleanClauses.Execute(gq, s.Backend)
+	sr.BooleanFields, _ = analysis.BooleanFields.Execute(gq, s.Backend)
+	sr.BooleanKeywords, _ = analysis.BooleanKeywords.Execute(gq, s.Backend)
+	sr.MeshKeywords, _ = analysis.MeshKeywordCount.Execute(gq, s.Backend)
+	sr.MeshExploded, sr.MeshAvgDepth, sr.MeshMaxDepth = s.meshStatistics(repr.(cqr.CommonQueryRepresentation))
 
 	if s.Perm.UserState().UserRights(c.Request) {
-		username := s.Perm.UserState().Username(c.Request)
-		t, err := combinator.NewShallowLogicalTree(gq, s.Entrez, s.Settings[username].Relevant)
+		ws, err := s.Workspace(c)
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+			return
+		}
+		s.Events.PublishQueryParsed(QueryParsed{Workspace: ws, Query: rawQuery, Language: lang, CQR: repr.(cqr.CommonQueryRepresentation), Source: "query"})
+
+		rel, err := s.Seeds.Relevant(ws.Key)
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+			return
+		}
+		t, err := combinator.NewShallowLogicalTree(gq, s.Backend, rel)
 		if err != nil {
 			c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
 			return
@@ -172,16 +178,41 @@ func (s Server) HandleQuery(c *gin.Context) {
 			sr.RelRet = q.R
 		}
 
-		// Reverse the list of previous queries.
-		rev := make([]Query, len(s.Queries[username]))
-		j := 0
-		for i := len(s.Queries[username]) - 1; i >= 0; i-- {
-			rev[j] = s.Queries[username][i]
-			j++
+		sr.PreviousQueries, err = s.History.Recent(ws.Key)
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+			return
+		}
+
+		relevant := make([]string, len(rel))
+		for i, r := range rel {
+			relevant[i] = r.String()
 		}
-		sr.PreviousQueries = rev
 
-		s.Queries[username] = append(s.Queries[username], Query{QueryString: rawQuery, Language: lang, NumRet: sr.TotalHits})
+		parent, err := requestParent(c)
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+			return
+		}
+
+		// Viewers of a project may run queries, but only editors may add them to its history.
+		sr.Version, err = s.RecordQuery(ws, Query{
+			Time:          time.Now(),
+			QueryString:   rawQuery,
+			Language:      lang,
+			NumRet:        sr.TotalHits,
+			NumRelRet:     int64(sr.RelRet),
+			Relevant:      relevant,
+			Author:        ws.Username,
+			Parent:        parent,
+			Message:       c.PostForm("message"),
+			Lines:         ReportLines(t.Root, lang),
+			ParserOptions: options,
+		}, repr.(cqr.CommonQueryRepresentation), "query")
+		if err != nil {
+			c.HTML(historyStatus(err), "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+			return
+		}
 	}
 	sr.Plugins = s.Plugins
 	c.HTML(http.StatusOK, "query.html", sr)
@@ -191,13 +222,20 @@ func (s Server) HandleIndex(c *gin.Context) {
 	if !s.Perm.UserState().IsLoggedIn(s.Perm.UserState().Username(c.Request)) {
 		c.Redirect(http.StatusTemporaryRedirect, "/account/login")
 	}
-	username := s.Perm.UserState().Username(c.Request)
-	// reverse the list
-	q := make([]Query, len(s.Queries[username]))
-	j := 0
-	for i := len(s.Queries[username]) - 1; i >= 0; i-- {
-		q[j] = s.Queries[username][i]
-		j++
+	ws, err := s.Workspace(c)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+		return
+	}
+	q, err := s.History.Recent(ws.Key)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+		return
+	}
+	rel, err := s.Seeds.Relevant(ws.Key)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+		return
 	}
 
 	c.HTML(http.StatusOK, "index.html", struct {
@@ -205,11 +243,14 @@ func (s Server) HandleIndex(c *gin.Context) {
 		Queries  []Query
 		Language string
 		Relevant combinator.Documents
-	}{Plugins: s.Plugins, Queries: q, Language: "pubmed", Relevant: s.Settings[username].Relevant})
+	}{Plugins: s.Plugins, Queries: q, Language: "pubmed", Relevant: rel})
 }
 
 func (s Server) HandlePlugins(c *gin.Context) {
-	c.HTML(http.StatusOK, "plugins.html", s.Plugins)
+	c.HTML(http.StatusOK, "plugins.html", struct {
+		Plugins  []InternalPluginDetails
+		Disabled []DisabledPlugin
+	}{Plugins: s.Plugins, Disabled: s.DisabledPlugins})
 }
 
 func (s Server) HandlePluginWithControl(c *gin.Context) {
@@ -224,17 +265,11 @@ func (s Server) HandlePluginWithControl(c *gin.Context) {
 
 func HandleTransform(c *gin.Context) {
 	rawQuery := c.PostForm("query")
-	lang := c.PostForm("lang")
 
-	t := make(map[string]tpipeline.TransmutePipeline)
-	t["pubmed"] = transmute.Pubmed2Cqr
-	t["medline"] = transmute.Medline2Cqr
-
-	compiler := t["medline"]
-	if v, ok := t[lang]; ok {
-		compiler = v
-	} else {
-		lang = "medline"
+	compiler, lang, err := RequestParser(c)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+		return
 	}
 
 	cq, err := compiler.Execute(rawQuery)
@@ -256,8 +291,16 @@ func HandleTransform(c *gin.Context) {
 }
 
 func (s Server) HandleClear(c *gin.Context) {
-	username := s.Perm.UserState().Username(c.Request)
-	s.Queries[username] = []Query{}
+	ws, err := s.Workspace(c)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+		return
+	}
+	err = s.History.Clear(ws.Key)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", ErrorPage{Error: err.Error(), BackLink: "/"})
+		return
+	}
 	c.Redirect(http.StatusFound, "/")
 	return
 }